@@ -0,0 +1,47 @@
+package arghandler
+
+import (
+	"flag"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func BenchmarkFormat(b *testing.B) {
+	// A relay found in every list of a year, CollecTor has one an hour.
+	first := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	nodes := make([]exitnode.ExitNode, 365*24)
+	for i := range nodes {
+		nodes[i] = collectortest.Node(collectortest.Fingerprint(0), collectortest.Address(0), first.Add(time.Duration(i)*time.Hour))
+	}
+
+	for _, name := range Formats() {
+		b.Run(name, func(b *testing.B) {
+			var f FormatFlags
+			set := flag.NewFlagSet(name, flag.ContinueOnError)
+			f.AddFlags(set)
+			if err := set.Parse([]string{"-output", name, "-template", "{{.ExitNode}} {{.LastStatus}}"}); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			formatter, o, err := f.Parse()
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			r := Report{
+				Nodes:   nodes,
+				Query:   []Param{{Name: "ip", Value: collectortest.Address(0)}},
+				Months:  []Month{{Date: "2024-01", Source: "cache", Status: "ok"}},
+				Options: o,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := formatter.Format(io.Discard, r); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package arghandler
+
+import (
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// HTML is the Output name of the self-contained HTML report.
+const HTML = "html"
+
+func init() {
+	RegisterFormatter(HTML, FormatterFunc(htmlReport))
+}
+
+// Geometry of the SVG timeline, in pixels.
+const (
+	timelineWidth  = 900
+	timelineLabel  = 160
+	timelineRow    = 22
+	timelineMargin = 30
+)
+
+type htmlView struct {
+	Query     []Param
+	Months    []Month
+	Nodes     []htmlNode
+	FirstSeen string
+	LastSeen  string
+	Timeline  htmlTimeline
+}
+
+type htmlNode struct {
+	Fingerprint string
+	FirstSeen   string
+	LastSeen    string
+	Addresses   []htmlAddress
+}
+
+type htmlAddress struct {
+	Address   string
+	UpdatedAt string
+}
+
+type htmlTimeline struct {
+	Width, Height int
+	PlotLeft      int
+	PlotRight     int
+	AxisY         int
+	From, To      string
+	Rows          []htmlTimelineRow
+}
+
+type htmlTimelineRow struct {
+	Label string
+	Y     int
+	Dots  []htmlDot
+}
+
+type htmlDot struct {
+	X     int
+	Title string
+}
+
+// observation is a single sighting of a node with an address.
+type observation struct {
+	address string
+	at      time.Time
+}
+
+// htmlReport renders a single HTML file with no external assets: styles are
+// inline and the timeline is an inline SVG, so the file can be mailed around
+// or attached to a ticket as is.
+func htmlReport(w io.Writer, r Report) error {
+	return htmlTemplate.Execute(w, newHTMLView(r))
+}
+
+func newHTMLView(r Report) htmlView {
+	o := r.Options
+	// Collect the observations by fingerprint, nodes show up once for every
+	// file they were found in so the same sighting can be there many times.
+	byNode := map[string][]observation{}
+	seen := map[string]map[observation]bool{}
+	var fingerprints []string
+	for _, n := range r.Nodes {
+		if _, ok := byNode[n.ExitNode]; !ok {
+			fingerprints = append(fingerprints, n.ExitNode)
+			seen[n.ExitNode] = map[observation]bool{}
+		}
+		for _, a := range n.ExitAddresses {
+			obs := observation{address: a.ExitAddress, at: a.UpdatedAt}
+			if seen[n.ExitNode][obs] {
+				continue
+			}
+			seen[n.ExitNode][obs] = true
+			byNode[n.ExitNode] = append(byNode[n.ExitNode], obs)
+		}
+	}
+
+	v := htmlView{Query: r.Query, Months: r.Months}
+	var first, last time.Time
+	for _, f := range fingerprints {
+		observations := byNode[f]
+		sort.Slice(observations, func(i, j int) bool { return observations[i].at.Before(observations[j].at) })
+		n := htmlNode{Fingerprint: f}
+		for _, obs := range observations {
+			n.Addresses = append(n.Addresses, htmlAddress{Address: obs.address, UpdatedAt: o.Time(obs.at)})
+		}
+		if len(observations) > 0 {
+			n.FirstSeen = o.Time(observations[0].at)
+			n.LastSeen = o.Time(observations[len(observations)-1].at)
+			if first.IsZero() || observations[0].at.Before(first) {
+				first = observations[0].at
+			}
+			if observations[len(observations)-1].at.After(last) {
+				last = observations[len(observations)-1].at
+			}
+		}
+		v.Nodes = append(v.Nodes, n)
+	}
+
+	if !first.IsZero() {
+		v.FirstSeen = o.Time(first)
+		v.LastSeen = o.Time(last)
+	}
+
+	v.Timeline = htmlTimeline{
+		Width:     timelineWidth,
+		PlotLeft:  timelineLabel,
+		PlotRight: timelineWidth - timelineMargin,
+		From:      v.FirstSeen,
+		To:        v.LastSeen,
+	}
+	plot := float64(v.Timeline.PlotRight - v.Timeline.PlotLeft)
+	span := last.Sub(first)
+	for i, f := range fingerprints {
+		row := htmlTimelineRow{Label: f[:min(len(f), 16)], Y: timelineMargin + i*timelineRow}
+		for _, obs := range byNode[f] {
+			// A single instant has no span, put it in the middle.
+			x := plot / 2
+			if span > 0 {
+				x = plot * float64(obs.at.Sub(first)) / float64(span)
+			}
+			row.Dots = append(row.Dots, htmlDot{
+				X:     v.Timeline.PlotLeft + int(x),
+				Title: obs.address + " " + o.Time(obs.at),
+			})
+		}
+		v.Timeline.Rows = append(v.Timeline.Rows, row)
+	}
+	v.Timeline.AxisY = timelineMargin + len(fingerprints)*timelineRow
+	v.Timeline.Height = v.Timeline.AxisY + timelineMargin
+
+	return v
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>his-tor-y report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+code { font-family: monospace; }
+svg text { font-family: monospace; font-size: 11px; }
+</style>
+</head>
+<body>
+<h1>TOR exit node history</h1>
+
+<h2>Query</h2>
+<table>
+{{- range .Query}}
+<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{- end}}
+<tr><th>months scanned</th><td>{{range $i, $m := .Months}}{{if $i}}, {{end}}{{$m.Date}}{{end}}</td></tr>
+</table>
+{{- if .Months}}
+
+<h2>Sources</h2>
+<table>
+<tr><th>Month</th><th>Source</th></tr>
+{{- range .Months}}
+<tr><td>{{.Date}}</td><td>{{.Source}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+
+<h2>Summary</h2>
+<table>
+<tr><th>nodes</th><td>{{len .Nodes}}</td></tr>
+<tr><th>first seen</th><td>{{.FirstSeen}}</td></tr>
+<tr><th>last seen</th><td>{{.LastSeen}}</td></tr>
+</table>
+{{- if .Nodes}}
+
+<h2>Timeline</h2>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Timeline.Width}}" height="{{.Timeline.Height}}" viewBox="0 0 {{.Timeline.Width}} {{.Timeline.Height}}">
+<line x1="{{.Timeline.PlotLeft}}" y1="{{.Timeline.AxisY}}" x2="{{.Timeline.PlotRight}}" y2="{{.Timeline.AxisY}}" stroke="#888"/>
+<text x="{{.Timeline.PlotLeft}}" y="{{.Timeline.Height}}" dy="-10">{{.Timeline.From}}</text>
+<text x="{{.Timeline.PlotRight}}" y="{{.Timeline.Height}}" dy="-10" text-anchor="end">{{.Timeline.To}}</text>
+{{- range .Timeline.Rows}}
+<text x="4" y="{{.Y}}" dy="4">{{.Label}}</text>
+{{- $y := .Y}}
+{{- range .Dots}}
+<circle cx="{{.X}}" cy="{{$y}}" r="4" fill="#7d4698"><title>{{.Title}}</title></circle>
+{{- end}}
+{{- end}}
+</svg>
+
+<h2>Nodes</h2>
+{{- range .Nodes}}
+<h3><code>{{.Fingerprint}}</code></h3>
+<p>first seen {{.FirstSeen}}, last seen {{.LastSeen}}</p>
+<table>
+<tr><th>ExitAddress</th><th>UpdatedAt</th></tr>
+{{- range .Addresses}}
+<tr><td>{{.Address}}</td><td>{{.UpdatedAt}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,71 @@
+package arghandler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func TestHTMLReport(t *testing.T) {
+	r := testReport()
+	// The same sighting in a second file must not be shown twice.
+	r.Nodes = append(r.Nodes, r.Nodes[0])
+	later, _ := time.Parse(time.RFC3339, "2024-02-01T08:00:00Z")
+	r.Nodes = append(r.Nodes, exitnode.ExitNode{
+		ExitNode:      "23B49521BDC4588C7CCF3C38E552504118326B66",
+		ExitAddresses: []exitnode.ExitAddress{{ExitAddress: "<script>", UpdatedAt: later}},
+	})
+	r.Query = []Param{{Name: "ip", Value: "185.241.208.231"}}
+	r.Months = []Month{{Date: "2024-01", Source: "cache"}, {Date: "2024-02", Source: "mirror"}}
+
+	var buf bytes.Buffer
+	if err := htmlReport(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		"<td>185.241.208.231</td>",
+		"<td>2024-01, 2024-02</td>",
+		"<tr><td>2024-02</td><td>mirror</td></tr>",
+		"<tr><th>nodes</th><td>2</td></tr>",
+		"<tr><th>first seen</th><td>2024-01-30T10:21:54Z</td></tr>",
+		"<tr><th>last seen</th><td>2024-02-01T08:00:00Z</td></tr>",
+		"<code>FE39F07EBE7870DCE124AB30DF3ABD0700A43F75</code>",
+		"<svg ",
+		"&lt;script&gt;",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected report to contain %q", expected)
+		}
+	}
+
+	if strings.Count(out, "<td>1.2.3.4</td>") != 1 {
+		t.Errorf("expected duplicated sightings to be merged")
+	}
+	// 2 sightings for the first node and 1 for the second.
+	if strings.Count(out, "<circle ") != 3 {
+		t.Errorf("expected 3 dots in the timeline, got %d", strings.Count(out, "<circle "))
+	}
+	// Self-contained means no external assets, the SVG namespace is not
+	// fetched by browsers.
+	out = strings.ReplaceAll(out, `xmlns="http://www.w3.org/2000/svg"`, "")
+	for _, external := range []string{"<link", "<script", "src=", "http://", "https://"} {
+		if strings.Contains(out, external) {
+			t.Errorf("expected no external assets, found %q", external)
+		}
+	}
+}
+
+func TestHTMLReportEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := htmlReport(&buf, Report{Months: []Month{{Date: "2024-01"}}}); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), "<tr><th>nodes</th><td>0</td></tr>") || strings.Contains(buf.String(), "<svg") {
+		t.Errorf("expected an empty summary and no timeline")
+	}
+}
@@ -0,0 +1,100 @@
+package arghandler
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MISP is the Output name of the MISP event export.
+const MISP = "misp"
+
+func init() {
+	RegisterFormatter(MISP, FormatterFunc(mispEvent))
+}
+
+// mispTorExitTag is attached to the event and to every attribute.
+const mispTorExitTag = "tor:exit-node"
+
+type mispTag struct {
+	Name string `json:"name"`
+}
+
+type mispAttribute struct {
+	UUID      string    `json:"uuid"`
+	Type      string    `json:"type"`
+	Category  string    `json:"category"`
+	ToIDS     bool      `json:"to_ids"`
+	Value     string    `json:"value"`
+	Comment   string    `json:"comment"`
+	FirstSeen string    `json:"first_seen"`
+	LastSeen  string    `json:"last_seen"`
+	Timestamp string    `json:"timestamp"`
+	Tag       []mispTag `json:"Tag"`
+}
+
+type mispEventObject struct {
+	UUID          string          `json:"uuid"`
+	Info          string          `json:"info"`
+	Date          string          `json:"date"`
+	ThreatLevelID string          `json:"threat_level_id"`
+	Analysis      string          `json:"analysis"`
+	Distribution  string          `json:"distribution"`
+	Published     bool            `json:"published"`
+	Timestamp     string          `json:"timestamp"`
+	Tag           []mispTag       `json:"Tag"`
+	Attribute     []mispAttribute `json:"Attribute"`
+}
+
+// mispEvent exports an event ready to be imported in MISP, with an ip-dst
+// attribute for every address and relay pair. The relay fingerprint goes in
+// the attribute comment, the observation window in first_seen and last_seen.
+func mispEvent(w io.Writer, r Report) error {
+	t := now().UTC()
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+
+	info := "TOR exit node history"
+	var query []string
+	for _, p := range r.Query {
+		query = append(query, p.Name+"="+p.Value)
+	}
+	if len(query) > 0 {
+		info += " (" + strings.Join(query, " ") + ")"
+	}
+
+	e := mispEventObject{
+		UUID: uuidV4(),
+		Info: info,
+		Date: t.Format("2006-01-02"),
+		// 4 is undefined threat level, 2 is completed analysis and 0 is
+		// "your organisation only" distribution.
+		ThreatLevelID: "4",
+		Analysis:      "2",
+		Distribution:  "0",
+		Timestamp:     timestamp,
+		Tag:           []mispTag{{Name: mispTorExitTag}},
+		Attribute:     []mispAttribute{},
+	}
+
+	for _, s := range sightings(r.Nodes) {
+		e.Attribute = append(e.Attribute, mispAttribute{
+			UUID:      uuidV5(hisToryNamespace, "ip-dst:"+s.Address+":"+s.Fingerprint),
+			Type:      "ip-dst",
+			Category:  "Network activity",
+			Value:     s.Address,
+			Comment:   "TOR exit relay fingerprint " + s.Fingerprint,
+			FirstSeen: s.First.UTC().Format(time.RFC3339),
+			LastSeen:  s.Last.UTC().Format(time.RFC3339),
+			Timestamp: timestamp,
+			Tag:       []mispTag{{Name: mispTorExitTag}},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Event mispEventObject `json:"Event"`
+	}{e})
+}
@@ -0,0 +1,54 @@
+package arghandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestMISPEvent(t *testing.T) {
+	fixedNow(t)
+	r := testReport()
+	r.Nodes = append(r.Nodes, r.Nodes[0])
+	r.Query = []Param{{Name: "ip", Value: "1.2.3.4"}}
+
+	var buf bytes.Buffer
+	if err := mispEvent(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	var e struct {
+		Event mispEventObject
+	}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("Expected valid JSON, got: %v", err)
+	}
+
+	if e.Event.Info != "TOR exit node history (ip=1.2.3.4)" || e.Event.Date != "2024-03-01" {
+		t.Errorf("unexpected event %+v", e.Event)
+	}
+	if len(e.Event.Tag) != 1 || e.Event.Tag[0].Name != mispTorExitTag {
+		t.Errorf("expected event to be tagged %s", mispTorExitTag)
+	}
+	// Duplicated sightings are merged.
+	if len(e.Event.Attribute) != 2 {
+		t.Fatalf("expected 2 attributes, got %d", len(e.Event.Attribute))
+	}
+
+	a := e.Event.Attribute[0]
+	if a.Type != "ip-dst" || a.Value != "1.2.3.4" {
+		t.Errorf("unexpected attribute %+v", a)
+	}
+	if a.Comment != "TOR exit relay fingerprint FE39F07EBE7870DCE124AB30DF3ABD0700A43F75" {
+		t.Errorf("unexpected comment %s", a.Comment)
+	}
+	if a.FirstSeen != "2024-01-30T10:21:54Z" || a.LastSeen != "2024-01-30T10:21:54Z" {
+		t.Errorf("unexpected seen %s %s", a.FirstSeen, a.LastSeen)
+	}
+	if len(a.Tag) != 1 || a.Tag[0].Name != mispTorExitTag {
+		t.Errorf("expected attribute to be tagged %s", mispTorExitTag)
+	}
+	if a.Timestamp != "1709294400" {
+		t.Errorf("unexpected timestamp %s", a.Timestamp)
+	}
+}
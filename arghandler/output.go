@@ -1,5 +1,16 @@
 package arghandler
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
 // output - Custom type to hold value for the output style.
 type Output int
 
@@ -9,7 +20,135 @@ const (
 	Json
 )
 
-// String - Creating common behavior - give the type a String function
+// String - Creating common behavior - give the type a String function
 func (o Output) String() string {
 	return [...]string{"text", "json"}[o]
 }
+
+// Report is what a command hands over to a Formatter: the nodes it found
+// and, over time, whatever context a format may want to show next to them.
+type Report struct {
+	Nodes []exitnode.ExitNode
+	// Query lists the parameters the command was run with, in display order.
+	Query []Param
+	// Months lists the year-month periods that were scanned.
+	Months []Month
+	// BestEffort tells that Nodes may come from some of the Months only:
+	// the text and json outputs show the Status of each.
+	BestEffort bool
+	Options    FormatOptions
+}
+
+// Month is a scanned year-month period and where its data came from.
+type Month struct {
+	Date   string
+	Source string
+	// Status is how pulling the month went, like ok or missing, and Error
+	// why it failed if it did.
+	Status string
+	Error  string
+}
+
+// Param is a name and value pair describing a query parameter.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Formatter renders a Report on a writer. Every command shares the same set
+// of formatters, so a format registered here is available everywhere.
+type Formatter interface {
+	Format(io.Writer, Report) error
+}
+
+// FormatterFunc allows to use an ordinary function as a Formatter.
+type FormatterFunc func(io.Writer, Report) error
+
+// Format calls f(w, r).
+func (f FormatterFunc) Format(w io.Writer, r Report) error {
+	return f(w, r)
+}
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = make(map[string]Formatter)
+)
+
+func init() {
+	RegisterFormatter(Text.String(), FormatterFunc(table))
+	RegisterFormatter(Json.String(), FormatterFunc(jsonArray))
+}
+
+// RegisterFormatter makes a formatter available under the given -output name.
+// Like database/sql.Register it panics if the name is registered twice or if
+// the formatter is nil, both are programming errors.
+func RegisterFormatter(name string, f Formatter) {
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	if f == nil {
+		panic("arghandler: RegisterFormatter formatter is nil")
+	}
+	if _, dup := formatters[name]; dup {
+		panic("arghandler: RegisterFormatter called twice for " + name)
+	}
+	formatters[name] = f
+}
+
+// LookupFormatter returns the formatter registered under name. The error
+// lists the valid names so that it can be shown as is to the user.
+func LookupFormatter(name string) (Formatter, error) {
+	formattersMu.RLock()
+	f, ok := formatters[name]
+	formattersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output %q, valid outputs are: %s", name, strings.Join(Formats(), ", "))
+	}
+	return f, nil
+}
+
+// Formats returns the sorted names of all the registered formatters.
+func Formats() []string {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonMonth is a Month in the json output.
+type jsonMonth struct {
+	Month  string `json:"month"`
+	Status string `json:"status"`
+	Source string `json:"source,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// jsonArray renders the nodes as a JSON array. In best effort mode the
+// array goes in an object next to the months, so that a partial answer
+// cannot be mistaken for a complete one.
+func jsonArray(w io.Writer, r Report) error {
+	var v any = &r.Nodes
+	if r.BestEffort {
+		nodes := r.Nodes
+		if nodes == nil {
+			nodes = []exitnode.ExitNode{}
+		}
+		months := make([]jsonMonth, len(r.Months))
+		for i, m := range r.Months {
+			months[i] = jsonMonth{Month: m.Date, Status: m.Status, Source: m.Source, Error: m.Error}
+		}
+		v = struct {
+			Nodes  []exitnode.ExitNode `json:"nodes"`
+			Months []jsonMonth         `json:"months"`
+		}{nodes, months}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
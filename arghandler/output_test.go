@@ -0,0 +1,113 @@
+package arghandler
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func TestLookupFormatterBuiltins(t *testing.T) {
+	for _, name := range []string{Text.String(), Json.String()} {
+		if _, err := LookupFormatter(name); err != nil {
+			t.Errorf("expected %s to be registered, got: %v", name, err)
+		}
+	}
+}
+
+func TestLookupFormatterErrorOnUnknown(t *testing.T) {
+	_, err := LookupFormatter("yaml")
+	if err == nil {
+		t.Fatalf("Expected error, got: nil")
+	}
+	// The error is shown to the user, it should tell what the valid values are.
+	for _, name := range Formats() {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected error to list %s, got: %v", name, err)
+		}
+	}
+}
+
+// unregisterFormatter removes a formatter registered by a test, so the
+// registry is the same for the tests that follow and for -count runs.
+func unregisterFormatter(name string) {
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	delete(formatters, name)
+}
+
+func TestRegisterFormatter(t *testing.T) {
+	t.Cleanup(func() { unregisterFormatter("test-count") })
+	RegisterFormatter("test-count", FormatterFunc(func(w io.Writer, r Report) error {
+		_, err := io.WriteString(w, strings.Repeat("x", len(r.Nodes)))
+		return err
+	}))
+
+	f, err := LookupFormatter("test-count")
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = f.Format(&buf, Report{Nodes: make([]exitnode.ExitNode, 3)})
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if buf.String() != "xxx" {
+		t.Errorf("expected xxx, got: %s", buf.String())
+	}
+}
+
+func TestRegisterFormatterPanicsOnDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate registration")
+		}
+	}()
+	RegisterFormatter(Text.String(), FormatterFunc(table))
+}
+
+func TestJSONFormatter(t *testing.T) {
+	u, _ := time.Parse(time.RFC3339, "2024-01-30T10:21:54Z")
+	r := Report{Nodes: []exitnode.ExitNode{{
+		ExitNode:      "AAAA",
+		Published:     u,
+		LastStatus:    u,
+		ExitAddresses: []exitnode.ExitAddress{{ExitAddress: "1.2.3.4", UpdatedAt: u}},
+	}}}
+
+	f, _ := LookupFormatter(Json.String())
+	var buf bytes.Buffer
+	if err := f.Format(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	gold := `[{"ExitNode":"AAAA","Published":"2024-01-30T10:21:54Z","LastStatus":"2024-01-30T10:21:54Z","ExitAddresses":[{"ExitAddress":"1.2.3.4","UpdatedAt":"2024-01-30T10:21:54Z"}]}]`
+	if buf.String() != gold {
+		t.Errorf("Expected %s, got: %s", gold, buf.String())
+	}
+}
+
+func TestJSONFormatterBestEffort(t *testing.T) {
+	r := Report{
+		BestEffort: true,
+		Months: []Month{
+			{Date: "2024-01", Status: "ok", Source: "cache"},
+			{Date: "2024-02", Status: "corrupt", Error: "corrupt archive"},
+		},
+	}
+
+	f, _ := LookupFormatter(Json.String())
+	var buf bytes.Buffer
+	if err := f.Format(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	gold := `{"nodes":[],"months":[{"month":"2024-01","status":"ok","source":"cache"},{"month":"2024-02","status":"corrupt","error":"corrupt archive"}]}`
+	if buf.String() != gold {
+		t.Errorf("Expected %s, got: %s", gold, buf.String())
+	}
+}
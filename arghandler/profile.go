@@ -0,0 +1,84 @@
+package arghandler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profiles are the files asked with -cpuprofile, -memprofile and -trace,
+// written while a command runs for go tool pprof and go tool trace.
+type profiles struct {
+	cpu   string
+	mem   string
+	trace string
+}
+
+// start starts the CPU profile and the execution trace, the returned stop
+// ends them and writes the heap profile. Nothing is done for the empty
+// paths.
+func (p profiles) start() (stop func() error, err error) {
+	var stops []func() error
+	stopAll := func() error {
+		var errs []error
+		for i := len(stops) - 1; i >= 0; i-- {
+			errs = append(errs, stops[i]())
+		}
+		return errors.Join(errs...)
+	}
+
+	if p.cpu != "" {
+		f, err := os.Create(p.cpu)
+		if err != nil {
+			return nil, fmt.Errorf("cpu profile error: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cpu profile error: %w", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+
+	if p.trace != "" {
+		f, err := os.Create(p.trace)
+		if err != nil {
+			stopAll()
+			return nil, fmt.Errorf("trace error: %w", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stopAll()
+			return nil, fmt.Errorf("trace error: %w", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+
+	if p.mem != "" {
+		// Created now so that a bad path fails before the command runs.
+		f, err := os.Create(p.mem)
+		if err != nil {
+			stopAll()
+			return nil, fmt.Errorf("memory profile error: %w", err)
+		}
+		stops = append(stops, func() error {
+			// Up to date statistics of what is still in use.
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				f.Close()
+				return fmt.Errorf("memory profile error: %w", err)
+			}
+			return f.Close()
+		})
+	}
+
+	return stopAll, nil
+}
@@ -0,0 +1,51 @@
+package arghandler
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/robizz/his-tor-y/conf"
+)
+
+func TestRouterProfiles(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRouter(t, nil)
+	r.Register(&testCommand{})
+	cpu, mem, trace := filepath.Join(dir, "cpu.out"), filepath.Join(dir, "mem.out"), filepath.Join(dir, "trace.out")
+	err := r.Execute(context.Background(), conf.Config{}, []string{"main", "test", "-cpuprofile", cpu, "-memprofile", mem, "-trace", trace}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	for _, path := range []string{cpu, mem, trace} {
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			t.Errorf("expected %s to be written, got: %v", path, err)
+		}
+	}
+}
+
+func TestRouterErrorOnProfiles(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing", "out")
+	r := newTestRouter(t, nil)
+	c := &testCommand{}
+	r.Register(c)
+	for _, flag := range []string{"-cpuprofile", "-memprofile", "-trace"} {
+		t.Run(flag, func(t *testing.T) {
+			// The CPU profile is started first, it must be stopped when the
+			// others fail.
+			args := []string{"main", "test", "-cpuprofile", filepath.Join(dir, "cpu.out"), flag, missing}
+			err := r.Execute(context.Background(), conf.Config{}, args, io.Discard)
+			if err == nil {
+				t.Fatalf("Expected error, got: nil")
+			}
+		})
+	}
+	// Profiling is not left running.
+	err := r.Execute(context.Background(), conf.Config{}, []string{"main", "test", "-cpuprofile", filepath.Join(dir, "cpu.out")}, io.Discard)
+	if err != nil {
+		t.Errorf("Expected nil, got: %v", err)
+	}
+}
@@ -4,57 +4,388 @@
 package arghandler
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/robizz/his-tor-y/conf"
+	"github.com/robizz/his-tor-y/logging"
 )
 
 // We declare here the "command interface" because we abide to the rules:
 // “Go interfaces generally belong in the package that uses values of the interface type,
 // not the package that implements those values.”
+//
+// The router owns the flag.FlagSet: a command declares its flags in Flags,
+// and once they are parsed along with the global ones Parse receives the
+// typed Settings to validate everything before Execute.
 type Command interface {
-	Parse(conf.Config, []string) error
+	Name() string
+	// Summary is the one-line description shown in the help.
+	Summary() string
+	Flags(*flag.FlagSet)
+	Parse(Settings) error
 	Execute(context.Context, io.Writer) error
-	Help() string
+}
+
+// Settings are the global flags, already validated, handed to every command.
+type Settings struct {
+	Config conf.Config
+	// Origins tells where each Config value comes from.
+	Origins conf.Origins
+	Verbose bool
+	Quiet   bool
+	// Stderr is where diagnostics go, stdout is for the command output only.
+	Stderr io.Writer
+	// Logger writes on Stderr: warnings by default, everything with -verbose
+	// and only errors with -quiet.
+	Logger        *slog.Logger
+	Formatter     Formatter
+	FormatOptions FormatOptions
+	// Args are the positional arguments left after the flags.
+	Args []string
 }
 
 type Router struct {
 	commands map[string]Command
+	// Stderr is handed to the commands in Settings, it defaults to os.Stderr.
+	Stderr io.Writer
+	// Getenv reads the HISTORY_* configuration, it defaults to os.Getenv.
+	Getenv func(string) string
 }
 
 func NewRouter() *Router {
 	return &Router{
 		commands: make(map[string]Command),
+		Stderr:   os.Stderr,
+		Getenv:   os.Getenv,
 	}
 }
 
-func (r *Router) Register(name string, c Command) {
-	r.commands[name] = c
+func (r *Router) Register(c Command) {
+	r.commands[c.Name()] = c
+}
+
+// globalFlags are accepted before or after any command.
+type globalFlags struct {
+	config      string
+	cacheDir    string
+	concurrency int
+	rateLimit   string
+	// The extraction limits, see conf.Config.
+	maxFiles          int
+	maxFileBytes      string
+	maxExtractedBytes string
+	verbose           bool
+	logFormat         string
+	quiet             bool
+	format            FormatFlags
+	profile           profiles
+}
+
+func (g *globalFlags) addFlags(set *flag.FlagSet, c conf.Config) {
+	set.StringVar(&g.config, "config", "", "Path of a JSON configuration file (default $XDG_CONFIG_HOME/his-tor-y/config.json)")
+	set.StringVar(&g.cacheDir, "cache-dir", c.CacheDir, "Directory where downloaded archives are kept between runs")
+	set.IntVar(&g.concurrency, "concurrency", c.Concurrency, "Maximum number of months downloaded and extracted at the same time, 0 means no limit")
+	set.StringVar(&g.rateLimit, "rate-limit", c.RateLimit.String(), "Bandwidth cap of all the downloads together, in bytes per second like 500KB or 2MiB, 0 means no limit")
+	set.IntVar(&g.maxFiles, "max-files", c.MaxFiles, "Maximum number of entries in a monthly archive, 0 means no limit")
+	set.StringVar(&g.maxFileBytes, "max-file-bytes", c.MaxFileBytes.String(), "Maximum size of a file extracted from an archive, like 256MiB, 0 means no limit")
+	set.StringVar(&g.maxExtractedBytes, "max-extracted-bytes", c.MaxExtractedBytes.String(), "Maximum size of all the files extracted from an archive, like 2GiB, 0 means no limit")
+	set.BoolVar(&g.verbose, "verbose", false, "Print diagnostics on stderr")
+	set.BoolVar(&g.quiet, "quiet", false, "Print nothing but the output and errors")
+	set.StringVar(&g.logFormat, "log-format", logging.FormatText, "Format of the log on stderr: text or json")
+	set.StringVar(&g.profile.cpu, "cpuprofile", "", "Write a CPU profile of the command to this file, for go tool pprof")
+	set.StringVar(&g.profile.mem, "memprofile", "", "Write a heap profile at the end of the command to this file, for go tool pprof")
+	set.StringVar(&g.profile.trace, "trace", "", "Write an execution trace of the command to this file, for go tool trace")
+	g.format.AddFlags(set)
+}
+
+// UsageError is a command line that cannot be run: a missing or unknown
+// command, a bad flag or a bad setting. The errors of Command.Parse are
+// usage errors too.
+type UsageError struct {
+	Err error
+}
+
+func (e *UsageError) Error() string {
+	return e.Err.Error()
 }
 
-// what about the help here it should run after everything is registered right?
+func (e *UsageError) Unwrap() error {
+	return e.Err
+}
 
+// Execute parses the global flags, picks the command and runs it. conf holds
+// the defaults that the config file, the environment and the flags override.
 func (r *Router) Execute(ctx context.Context, conf conf.Config, args []string, stdout io.Writer) error {
 
-	if len(args) < 2 {
-		return errors.New("missing command")
+	if len(args) < 1 {
+		return &UsageError{fmt.Errorf("missing command, available commands: %s", strings.Join(r.names(), ", "))}
 	}
+	program := filepath.Base(args[0])
 
-	c, ok := r.commands[args[1]]
-	if !ok {
-		//print help here?
-		return errors.New("command not found")
+	var g globalFlags
+	global := r.newFlagSet(program)
+	g.addFlags(global, conf)
+	err := global.Parse(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		_, err = io.WriteString(stdout, r.Help(program))
+		return err
+	}
+	if err != nil {
+		return &UsageError{fmt.Errorf("parse error: %w", err)}
+	}
+
+	rest := global.Args()
+	if len(rest) < 1 {
+		return &UsageError{fmt.Errorf("missing command, available commands: %s", strings.Join(r.names(), ", "))}
+	}
+
+	name := rest[0]
+	if name == "help" {
+		if len(rest) > 1 {
+			c, err := r.lookup(rest[1])
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(stdout, r.usage(program, c, global))
+			return err
+		}
+		_, err := io.WriteString(stdout, r.Help(program))
+		return err
+	}
+
+	c, err := r.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	// Global flags are accepted after the command too: they are added to its
+	// flag set sharing the values already parsed.
+	set := r.newFlagSet(name)
+	c.Flags(set)
+	global.VisitAll(func(f *flag.Flag) {
+		set.Var(f.Value, f.Name, f.Usage)
+	})
+	err = set.Parse(rest[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		// history -h is asking for help, not failing.
+		_, err = io.WriteString(stdout, r.usage(program, c, global))
+		return err
+	}
+	if err != nil {
+		return &UsageError{fmt.Errorf("parse error: %w", err)}
+	}
+
+	explicit := map[string]bool{}
+	global.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	set.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
 
+	s, err := g.settings(conf, r.Getenv, explicit)
+	if err != nil {
+		return &UsageError{fmt.Errorf("parse error: %w", err)}
+	}
+	s.Stderr = r.Stderr
+	s.Logger, err = g.logger(r.Stderr)
+	if err != nil {
+		return &UsageError{fmt.Errorf("parse error: %w", err)}
 	}
+	s.Args = set.Args()
 
-	err := c.Parse(conf, args)
+	if err := c.Parse(s); err != nil {
+		return &UsageError{fmt.Errorf("parse error: %w", err)}
+	}
 
+	stop, err := g.profile.start()
 	if err != nil {
-		return fmt.Errorf("parse error: %w", err)
+		return err
+	}
+	err = c.Execute(ctx, stdout)
+	// The error of the command tells more than the one of the profiles.
+	if stopErr := stop(); stopErr != nil && err == nil {
+		err = fmt.Errorf("profile error: %w", stopErr)
 	}
+	return err
+}
+
+// logger returns the logger writing on w at the level picked by -verbose
+// and -quiet.
+func (g *globalFlags) logger(w io.Writer) (*slog.Logger, error) {
+	level := slog.LevelWarn
+	switch {
+	case g.quiet:
+		level = slog.LevelError
+	case g.verbose:
+		level = slog.LevelInfo
+	}
+	return logging.New(w, g.logFormat, level)
+}
 
-	return c.Execute(ctx, stdout)
+// settings layers the config file, the environment and the flags explicitly
+// set on top of the defaults in c.
+func (g *globalFlags) settings(c conf.Config, getenv func(string) string, explicit map[string]bool) (Settings, error) {
+	c, origins, err := conf.Load(c, g.config, getenv)
+	if err != nil {
+		return Settings{}, err
+	}
+	if explicit["cache-dir"] {
+		c.CacheDir = g.cacheDir
+		origins[conf.KeyCacheDir] = "flag -cache-dir"
+	}
+	if explicit["concurrency"] {
+		if err := c.Set(conf.KeyConcurrency, strconv.Itoa(g.concurrency)); err != nil {
+			return Settings{}, fmt.Errorf("flag -concurrency error: %w", err)
+		}
+		origins[conf.KeyConcurrency] = "flag -concurrency"
+	}
+	if explicit["rate-limit"] {
+		if err := c.Set(conf.KeyRateLimit, g.rateLimit); err != nil {
+			return Settings{}, fmt.Errorf("flag -rate-limit error: %w", err)
+		}
+		origins[conf.KeyRateLimit] = "flag -rate-limit"
+	}
+	for _, f := range []struct {
+		name  string
+		key   conf.Key
+		value string
+	}{
+		{"max-files", conf.KeyMaxFiles, strconv.Itoa(g.maxFiles)},
+		{"max-file-bytes", conf.KeyMaxFileBytes, g.maxFileBytes},
+		{"max-extracted-bytes", conf.KeyMaxExtractedBytes, g.maxExtractedBytes},
+	} {
+		if explicit[f.name] {
+			if err := c.Set(f.key, f.value); err != nil {
+				return Settings{}, fmt.Errorf("flag -%s error: %w", f.name, err)
+			}
+			origins[f.key] = "flag -" + f.name
+		}
+	}
+	if explicit["output"] {
+		c.Output = g.format.Output
+		origins[conf.KeyOutput] = "flag -output"
+	} else if c.Output != "" {
+		g.format.Output = c.Output
+	}
+
+	f, o, err := g.format.Parse()
+	if err != nil {
+		return Settings{}, err
+	}
+
+	return Settings{
+		Config:        c,
+		Origins:       origins,
+		Verbose:       g.verbose && !g.quiet,
+		Quiet:         g.quiet,
+		Formatter:     f,
+		FormatOptions: o,
+	}, nil
+}
+
+func (r *Router) newFlagSet(name string) *flag.FlagSet {
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+	// Errors and -h are reported by the router, keep the flag package quiet.
+	set.SetOutput(io.Discard)
+	return set
+}
+
+// Help lists the registered commands with their one-line summary.
+func (r *Router) Help(program string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Usage: %s [global flags] <command> [flags]\n\nCommands:\n", program)
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, name := range r.names() {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, r.commands[name].Summary())
+	}
+	tw.Flush()
+
+	var g globalFlags
+	global := r.newFlagSet(program)
+	g.addFlags(global, conf.Config{})
+	fmt.Fprintf(&buf, "\nGlobal flags:\n%s", defaults(global))
+	fmt.Fprintf(&buf, "\nRun '%s help <command>' for the flags of a command.\n", program)
+	return buf.String()
+}
+
+// usage builds the help of a command out of its summary and its flags with
+// their defaults, followed by the global flags.
+func (r *Router) usage(program string, c Command, global *flag.FlagSet) string {
+	set := r.newFlagSet(c.Name())
+	c.Flags(set)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n\nUsage: %s %s [flags]\n\nFlags:\n%s", c.Summary(), program, c.Name(), defaults(set))
+	fmt.Fprintf(&buf, "\nGlobal flags:\n%s", defaults(global))
+	return buf.String()
+}
+
+func defaults(set *flag.FlagSet) string {
+	var buf bytes.Buffer
+	out := set.Output()
+	set.SetOutput(&buf)
+	set.PrintDefaults()
+	set.SetOutput(out)
+	return buf.String()
+}
+
+func (r *Router) lookup(name string) (Command, error) {
+	c, ok := r.commands[name]
+	if !ok {
+		if suggestion := r.suggest(name); suggestion != "" {
+			return nil, &UsageError{fmt.Errorf("command %q not found, did you mean %q?", name, suggestion)}
+		}
+		return nil, &UsageError{fmt.Errorf("command %q not found, available commands: %s", name, strings.Join(r.names(), ", "))}
+	}
+	return c, nil
+}
+
+func (r *Router) names() []string {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// suggest returns the registered command closest to name, if it is close
+// enough to be a typo.
+func (r *Router) suggest(name string) string {
+	best, bestDistance := "", len(name)/2+1
+	for _, candidate := range r.names() {
+		if d := levenshtein(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// levenshtein is the edit distance between a and b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
 }
@@ -1,28 +1,58 @@
 package arghandler
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"flag"
 	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/robizz/his-tor-y/conf"
+	"github.com/robizz/his-tor-y/exitnode"
 )
 
-type testCommand struct{}
+type testCommand struct {
+	name     string
+	settings Settings
+}
 
-func (t *testCommand) Parse(conf conf.Config, args []string) error { return nil }
-func (t *testCommand) Execute(context.Context, io.Writer) error    { return nil }
-func (t *testCommand) Help() string                                { return "help" }
+func (t *testCommand) Name() string {
+	if t.name == "" {
+		return "test"
+	}
+	return t.name
+}
+func (t *testCommand) Summary() string                          { return "help" }
+func (t *testCommand) Flags(*flag.FlagSet)                      {}
+func (t *testCommand) Parse(s Settings) error                   { t.settings = s; return nil }
+func (t *testCommand) Execute(context.Context, io.Writer) error { return nil }
+
+// newTestRouter returns a router that does not read the real environment or
+// the config file of whoever runs the tests.
+func newTestRouter(t *testing.T, vars map[string]string) *Router {
+	r := NewRouter()
+	xdg := t.TempDir()
+	r.Getenv = func(name string) string {
+		if name == "XDG_CONFIG_HOME" {
+			return xdg
+		}
+		return vars[name]
+	}
+	return r
+}
 
 func TestRouter(t *testing.T) {
 
-	r := NewRouter()
+	r := newTestRouter(t, nil)
 
 	var commandName = "test"
 
-	r.Register(commandName, &testCommand{})
+	r.Register(&testCommand{name: commandName})
 
 	err := r.Execute(context.Background(), conf.Config{}, []string{"main", commandName}, os.Stdout)
 
@@ -34,9 +64,9 @@ func TestRouter(t *testing.T) {
 
 func TestRouterErrorOnNoArgs(t *testing.T) {
 
-	r := NewRouter()
+	r := newTestRouter(t, nil)
 
-	r.Register("test", &testCommand{})
+	r.Register(&testCommand{})
 
 	code := r.Execute(context.Background(), conf.Config{}, []string{}, os.Stdout)
 
@@ -48,9 +78,9 @@ func TestRouterErrorOnNoArgs(t *testing.T) {
 
 func TestRouterErrorOnNotEnoughArgs(t *testing.T) {
 
-	r := NewRouter()
+	r := newTestRouter(t, nil)
 
-	r.Register("test", &testCommand{})
+	r.Register(&testCommand{})
 
 	code := r.Execute(context.Background(), conf.Config{}, []string{"main"}, os.Stdout)
 
@@ -62,11 +92,11 @@ func TestRouterErrorOnNotEnoughArgs(t *testing.T) {
 
 func TestRouterErrorOnCommandNotFound(t *testing.T) {
 
-	r := NewRouter()
+	r := newTestRouter(t, nil)
 
 	var commandName = "test"
 
-	r.Register(commandName, &testCommand{})
+	r.Register(&testCommand{name: commandName})
 
 	code := r.Execute(context.Background(), conf.Config{}, []string{"main", "not" + commandName}, os.Stdout)
 
@@ -76,19 +106,17 @@ func TestRouterErrorOnCommandNotFound(t *testing.T) {
 
 }
 
-type testErrorParseCommand struct{}
+type testErrorParseCommand struct{ testCommand }
 
-func (t *testErrorParseCommand) Parse(conf conf.Config, args []string) error { return errors.New("") }
-func (t *testErrorParseCommand) Execute(context.Context, io.Writer) error    { return nil }
-func (t *testErrorParseCommand) Help() string                                { return "help" }
+func (t *testErrorParseCommand) Parse(Settings) error { return errors.New("") }
 
 func TestRouterErrorOnCommandParseError(t *testing.T) {
 
-	r := NewRouter()
+	r := newTestRouter(t, nil)
 
 	var commandName = "test"
 
-	r.Register(commandName, &testErrorParseCommand{})
+	r.Register(&testErrorParseCommand{testCommand{name: commandName}})
 
 	err := r.Execute(context.Background(), conf.Config{}, []string{"main", commandName}, os.Stdout)
 
@@ -97,3 +125,261 @@ func TestRouterErrorOnCommandParseError(t *testing.T) {
 	}
 
 }
+
+type testFlagsCommand struct {
+	testCommand
+	who string
+}
+
+func (t *testFlagsCommand) Summary() string { return "Greet somebody" }
+func (t *testFlagsCommand) Flags(set *flag.FlagSet) {
+	set.StringVar(&t.who, "name", "world", "Who to greet")
+}
+
+func TestRouterHelp(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.Register(&testFlagsCommand{})
+	r.Register(&testCommand{name: "other"})
+
+	for _, args := range [][]string{{"main", "help"}, {"main", "-h"}, {"main", "--help"}} {
+		var buf bytes.Buffer
+		err := r.Execute(context.Background(), conf.Config{}, args, &buf)
+		if err != nil {
+			t.Fatalf("Expected nil, got: %v", err)
+		}
+		gold := `Usage: main [global flags] <command> [flags]
+
+Commands:
+  other  help
+  test   Greet somebody
+
+Global flags:
+`
+		if !strings.HasPrefix(buf.String(), gold) || !strings.Contains(buf.String(), "-cache-dir") {
+			t.Errorf("Expected \n%s, got: \n%s", gold, buf.String())
+		}
+	}
+}
+
+func TestRouterHelpCommand(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.Register(&testFlagsCommand{})
+
+	for _, args := range [][]string{{"main", "help", "test"}, {"main", "test", "-h"}} {
+		var buf bytes.Buffer
+		err := r.Execute(context.Background(), conf.Config{}, args, &buf)
+		if err != nil {
+			t.Fatalf("Expected nil, got: %v", err)
+		}
+		if !strings.Contains(buf.String(), "Greet somebody") || !strings.Contains(buf.String(), `Who to greet (default "world")`) {
+			t.Errorf("Expected command usage with flags, got: \n%s", buf.String())
+		}
+	}
+
+	err := r.Execute(context.Background(), conf.Config{}, []string{"main", "help", "nope"}, io.Discard)
+	if err == nil {
+		t.Fatalf("Expected error, got: nil")
+	}
+}
+
+func TestRouterDidYouMean(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.Register(&testCommand{name: "history"})
+
+	err := r.Execute(context.Background(), conf.Config{}, []string{"main", "histroy"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), `did you mean "history"?`) {
+		t.Fatalf("Expected suggestion, got: %v", err)
+	}
+
+	err = r.Execute(context.Background(), conf.Config{}, []string{"main", "xyz"}, io.Discard)
+	if err == nil || strings.Contains(err.Error(), "did you mean") {
+		t.Fatalf("Expected no suggestion, got: %v", err)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"history", "history", 0},
+		{"histroy", "history", 2},
+		{"histor", "history", 1},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if d := levenshtein(tt.a, tt.b); d != tt.expected {
+			t.Errorf("levenshtein(%s, %s) = %d, expected %d", tt.a, tt.b, d, tt.expected)
+		}
+	}
+}
+
+func TestRouterGlobalFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"before", []string{"main", "-cache-dir", "/tmp/cache", "-verbose", "-output", "json", "test", "-name", "you", "extra"}},
+		{"after", []string{"main", "test", "-name", "you", "-cache-dir", "/tmp/cache", "-verbose", "-output", "json", "extra"}},
+		{"mixed", []string{"main", "-verbose", "test", "-output", "json", "-name", "you", "-cache-dir", "/tmp/cache", "extra"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, nil)
+			c := &testFlagsCommand{}
+			r.Register(c)
+			err := r.Execute(context.Background(), conf.Config{CacheDir: "/default"}, tt.args, io.Discard)
+			if err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			s := c.settings
+			if c.who != "you" || s.Config.CacheDir != "/tmp/cache" || !s.Verbose || s.Quiet {
+				t.Errorf("unexpected settings %+v, name %s", s, c.who)
+			}
+			var buf bytes.Buffer
+			if err := s.Formatter.Format(&buf, Report{Nodes: []exitnode.ExitNode{}}); err != nil || buf.String() != "[]" {
+				t.Errorf("expected json formatter, got: %s", buf.String())
+			}
+			if len(s.Args) != 1 || s.Args[0] != "extra" {
+				t.Errorf("unexpected args %v", s.Args)
+			}
+		})
+	}
+}
+
+func TestRouterGlobalFlagsDefaults(t *testing.T) {
+	r := newTestRouter(t, nil)
+	c := &testCommand{}
+	r.Register(c)
+	err := r.Execute(context.Background(), conf.Config{CacheDir: "/default"}, []string{"main", "-quiet", "-verbose", "test"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if c.settings.Config.CacheDir != "/default" || c.settings.Verbose || !c.settings.Quiet {
+		t.Errorf("unexpected settings %+v", c.settings)
+	}
+	if c.settings.Stderr != os.Stderr {
+		t.Errorf("expected os.Stderr by default")
+	}
+	if c.settings.Logger == nil || c.settings.Logger.Enabled(context.Background(), slog.LevelWarn) {
+		t.Errorf("expected only errors to be logged with -quiet")
+	}
+}
+
+func TestRouterConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"exit_node":{"download_url_template":"http://mirror/%s"},"cache_dir":"/from/file"}`), 0600)
+	if err != nil {
+		t.Fatalf("error setup config file: %v", err)
+	}
+
+	r := newTestRouter(t, nil)
+	c := &testCommand{}
+	r.Register(c)
+
+	err = r.Execute(context.Background(), conf.Config{}, []string{"main", "test", "-config", file}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if c.settings.Config.CacheDir != "/from/file" || c.settings.Config.ExitNode.DownloadURLTemplate != "http://mirror/%s" {
+		t.Errorf("unexpected config %+v", c.settings.Config)
+	}
+
+	// Flags win over the file.
+	err = r.Execute(context.Background(), conf.Config{}, []string{"main", "-cache-dir", "/from/flag", "test", "-config", file}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if c.settings.Config.CacheDir != "/from/flag" {
+		t.Errorf("unexpected config %+v", c.settings.Config)
+	}
+
+	err = r.Execute(context.Background(), conf.Config{}, []string{"main", "test", "-config", file + ".nope"}, io.Discard)
+	if err == nil {
+		t.Fatalf("Expected error, got: nil")
+	}
+}
+
+func TestRouterErrorOnGlobalFlags(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.Register(&testCommand{})
+	for _, args := range [][]string{
+		{"main"},
+		{"main", "nope"},
+		{"main", "-nope", "test"},
+		{"main", "test", "-output", "yaml"},
+		{"main", "test", "-concurrency", "-1"},
+		{"main", "test", "-rate-limit", "fast"},
+		{"main", "-log-format", "yaml", "test"},
+	} {
+		err := r.Execute(context.Background(), conf.Config{}, args, io.Discard)
+		var usage *UsageError
+		if !errors.As(err, &usage) {
+			t.Errorf("Expected usage error for %v, got: %v", args, err)
+		}
+	}
+}
+
+func TestRouterConfigEnvAndOrigins(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"HISTORY_CACHE_DIR": "/from/env", "HISTORY_OUTPUT": "json"})
+	c := &testCommand{}
+	r.Register(c)
+
+	err := r.Execute(context.Background(), conf.Default(), []string{"main", "test"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	s := c.settings
+	if s.Config.CacheDir != "/from/env" || s.Origins[conf.KeyCacheDir] != "env HISTORY_CACHE_DIR" {
+		t.Errorf("unexpected cache dir %s from %s", s.Config.CacheDir, s.Origins[conf.KeyCacheDir])
+	}
+	// The output from the environment becomes the default format.
+	var buf bytes.Buffer
+	if err := s.Formatter.Format(&buf, Report{Nodes: []exitnode.ExitNode{}}); err != nil || buf.String() != "[]" {
+		t.Errorf("expected json formatter, got: %s", buf.String())
+	}
+
+	err = r.Execute(context.Background(), conf.Default(), []string{"main", "test", "-cache-dir", "/from/flag", "-output", "text"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	s = c.settings
+	if s.Config.CacheDir != "/from/flag" || s.Origins[conf.KeyCacheDir] != "flag -cache-dir" {
+		t.Errorf("unexpected cache dir %s from %s", s.Config.CacheDir, s.Origins[conf.KeyCacheDir])
+	}
+	if s.Config.Output != "text" || s.Origins[conf.KeyOutput] != "flag -output" {
+		t.Errorf("unexpected output %s from %s", s.Config.Output, s.Origins[conf.KeyOutput])
+	}
+}
+
+func TestRouterDownloadLimits(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"HISTORY_RATE_LIMIT": "1MB"})
+	c := &testCommand{}
+	r.Register(c)
+
+	err := r.Execute(context.Background(), conf.Default(), []string{"main", "test", "-concurrency", "2"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	s := c.settings
+	if s.Config.Concurrency != 2 || s.Origins[conf.KeyConcurrency] != "flag -concurrency" {
+		t.Errorf("unexpected concurrency %d from %s", s.Config.Concurrency, s.Origins[conf.KeyConcurrency])
+	}
+	if s.Config.RateLimit != 1e6 || s.Origins[conf.KeyRateLimit] != "env HISTORY_RATE_LIMIT" {
+		t.Errorf("unexpected rate limit %s from %s", s.Config.RateLimit, s.Origins[conf.KeyRateLimit])
+	}
+
+	err = r.Execute(context.Background(), conf.Default(), []string{"main", "-rate-limit", "64KiB", "test"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	s = c.settings
+	if s.Config.RateLimit != 64<<10 || s.Origins[conf.KeyRateLimit] != "flag -rate-limit" {
+		t.Errorf("unexpected rate limit %s from %s", s.Config.RateLimit, s.Origins[conf.KeyRateLimit])
+	}
+	if s.Config.Concurrency != 4 || s.Origins[conf.KeyConcurrency] != "default" {
+		t.Errorf("unexpected concurrency %d from %s", s.Config.Concurrency, s.Origins[conf.KeyConcurrency])
+	}
+}
@@ -0,0 +1,225 @@
+package arghandler
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+// STIX is the Output name of the STIX 2.1 bundle export.
+const STIX = "stix"
+
+func init() {
+	RegisterFormatter(STIX, FormatterFunc(stixBundle))
+}
+
+// now is replaced in tests to get a stable output.
+var now = time.Now
+
+// stixSCONamespace is the namespace the STIX 2.1 spec mandates to build the
+// deterministic identifiers of cyber-observable objects.
+var stixSCONamespace = [16]byte{0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c, 0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7}
+
+// hisToryNamespace is used for the identifiers of the objects we create, so
+// that exporting the same sighting twice gives the same identifier and
+// platforms can deduplicate it. It is fe608eea-e8c5-470c-b4ea-d889a9535a3e.
+var hisToryNamespace = [16]byte{0xfe, 0x60, 0x8e, 0xea, 0xe8, 0xc5, 0x47, 0x0c, 0xb4, 0xea, 0xd8, 0x89, 0xa9, 0x53, 0x5a, 0x3e}
+
+type stixObject struct {
+	Type        string   `json:"type"`
+	SpecVersion string   `json:"spec_version"`
+	ID          string   `json:"id"`
+	Created     string   `json:"created,omitempty"`
+	Modified    string   `json:"modified,omitempty"`
+	Value       string   `json:"value,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Types       []string `json:"indicator_types,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	PatternType string   `json:"pattern_type,omitempty"`
+	ValidFrom   string   `json:"valid_from,omitempty"`
+	ValidUntil  string   `json:"valid_until,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	// relationship properties
+	RelationshipType string `json:"relationship_type,omitempty"`
+	SourceRef        string `json:"source_ref,omitempty"`
+	TargetRef        string `json:"target_ref,omitempty"`
+}
+
+type stixBundleObject struct {
+	Type    string       `json:"type"`
+	ID      string       `json:"id"`
+	Objects []stixObject `json:"objects"`
+}
+
+// sighting is an address used by a relay between First and Last.
+type sighting struct {
+	Fingerprint string
+	Address     string
+	First       time.Time
+	Last        time.Time
+}
+
+// sightings merges the exit addresses of the nodes by relay and address,
+// keeping the first and last time each pair was observed.
+func sightings(nodes []exitnode.ExitNode) []sighting {
+	type key struct{ fingerprint, address string }
+	index := map[key]int{}
+	var s []sighting
+	for _, n := range nodes {
+		for _, a := range n.ExitAddresses {
+			k := key{n.ExitNode, a.ExitAddress}
+			i, ok := index[k]
+			if !ok {
+				index[k] = len(s)
+				s = append(s, sighting{Fingerprint: n.ExitNode, Address: a.ExitAddress, First: a.UpdatedAt, Last: a.UpdatedAt})
+				continue
+			}
+			if a.UpdatedAt.Before(s[i].First) {
+				s[i].First = a.UpdatedAt
+			}
+			if a.UpdatedAt.After(s[i].Last) {
+				s[i].Last = a.UpdatedAt
+			}
+		}
+	}
+	sort.SliceStable(s, func(i, j int) bool {
+		if s[i].Address != s[j].Address {
+			return s[i].Address < s[j].Address
+		}
+		return s[i].Fingerprint < s[j].Fingerprint
+	})
+	return s
+}
+
+// stixBundle exports one ipv4-addr or ipv6-addr observable and one indicator
+// per address, linked by a based-on relationship. The indicator is valid from
+// the first to the last time the address was observed as a TOR exit.
+func stixBundle(w io.Writer, r Report) error {
+	created := stixTime(now())
+	b := stixBundleObject{
+		Type:    "bundle",
+		ID:      "bundle--" + uuidV4(),
+		Objects: []stixObject{},
+	}
+
+	// Group the sightings by address, an indicator is about the address
+	// whatever relay used it.
+	all := sightings(r.Nodes)
+	for i := 0; i < len(all); {
+		address := all[i].Address
+		first, last := all[i].First, all[i].Last
+		var fingerprints []string
+		for ; i < len(all) && all[i].Address == address; i++ {
+			fingerprints = append(fingerprints, all[i].Fingerprint)
+			if all[i].First.Before(first) {
+				first = all[i].First
+			}
+			if all[i].Last.After(last) {
+				last = all[i].Last
+			}
+		}
+		// The spec wants valid_until to be strictly after valid_from.
+		if !last.After(first) {
+			last = first.Add(time.Second)
+		}
+
+		kind := addressType(address)
+		observable := stixObject{
+			Type:        kind,
+			SpecVersion: "2.1",
+			ID:          kind + "--" + uuidV5(stixSCONamespace, `{"value":`+jsonString(address)+`}`),
+			Value:       address,
+		}
+		indicator := stixObject{
+			Type:        "indicator",
+			SpecVersion: "2.1",
+			ID:          "indicator--" + uuidV5(hisToryNamespace, "indicator:"+address),
+			Created:     created,
+			Modified:    created,
+			Name:        "TOR exit node " + address,
+			Description: "Observed as a TOR exit address of relay " + strings.Join(fingerprints, ", "),
+			Types:       []string{"anonymization"},
+			Pattern:     "[" + kind + ":value = '" + patternString(address) + "']",
+			PatternType: "stix",
+			ValidFrom:   stixTime(first),
+			ValidUntil:  stixTime(last),
+			Labels:      []string{"tor-exit"},
+		}
+		relationship := stixObject{
+			Type:             "relationship",
+			SpecVersion:      "2.1",
+			ID:               "relationship--" + uuidV5(hisToryNamespace, "based-on:"+address),
+			Created:          created,
+			Modified:         created,
+			RelationshipType: "based-on",
+			SourceRef:        indicator.ID,
+			TargetRef:        observable.ID,
+		}
+		b.Objects = append(b.Objects, observable, indicator, relationship)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(b)
+}
+
+// addressType is the type of the observable of address. Exit lists only
+// have IPv4 addresses, anything that is not IPv6 is taken as one.
+func addressType(address string) string {
+	if a, err := netip.ParseAddr(address); err == nil && !a.Is4() {
+		return "ipv6-addr"
+	}
+	return "ipv4-addr"
+}
+
+// patternString escapes s for a string literal of a STIX pattern, where
+// quotes and backslashes are escaped with a backslash.
+func patternString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+func stixTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// uuidV5 returns the RFC 4122 name based identifier of name in namespace.
+func uuidV5(namespace [16]byte, name string) string {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return formatUUID(u)
+}
+
+// uuidV4 returns a random RFC 4122 identifier.
+func uuidV4() string {
+	var u [16]byte
+	// Like uuid.New: without randomness there is no identifier to give.
+	if _, err := rand.Read(u[:]); err != nil {
+		panic("arghandler: crypto/rand failed: " + err.Error())
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return formatUUID(u)
+}
+
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
@@ -0,0 +1,121 @@
+package arghandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func fixedNow(t *testing.T) {
+	t.Helper()
+	now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { now = time.Now })
+}
+
+func TestUUIDV5(t *testing.T) {
+	// Identifier computed with python uuid.uuid5 as a reference.
+	got := uuidV5(stixSCONamespace, `{"value":"1.2.3.4"}`)
+	if got != "0198f97b-e65d-5025-87e5-58bc39d4bdb4" {
+		t.Errorf("unexpected uuid %s", got)
+	}
+}
+
+func TestSTIXBundle(t *testing.T) {
+	fixedNow(t)
+	r := testReport()
+	later, _ := time.Parse(time.RFC3339, "2024-02-01T08:00:00Z")
+	r.Nodes = append(r.Nodes, exitnode.ExitNode{
+		ExitNode:      "23B49521BDC4588C7CCF3C38E552504118326B66",
+		ExitAddresses: []exitnode.ExitAddress{{ExitAddress: "185.241.208.231", UpdatedAt: later}},
+	})
+
+	var buf bytes.Buffer
+	if err := stixBundle(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	var b stixBundleObject
+	if err := json.Unmarshal(buf.Bytes(), &b); err != nil {
+		t.Fatalf("Expected valid JSON, got: %v", err)
+	}
+	if b.Type != "bundle" || !strings.HasPrefix(b.ID, "bundle--") {
+		t.Errorf("unexpected bundle %s %s", b.Type, b.ID)
+	}
+	// 2 addresses, each with observable, indicator and relationship.
+	if len(b.Objects) != 6 {
+		t.Fatalf("expected 6 objects, got %d", len(b.Objects))
+	}
+
+	observable, indicator, relationship := b.Objects[0], b.Objects[1], b.Objects[2]
+	if observable.ID != "ipv4-addr--0198f97b-e65d-5025-87e5-58bc39d4bdb4" || observable.Value != "1.2.3.4" {
+		t.Errorf("unexpected observable %+v", observable)
+	}
+	// A single observation still gets a valid_until after valid_from.
+	if indicator.ValidFrom != "2024-01-30T10:21:54.000Z" || indicator.ValidUntil != "2024-01-30T10:21:55.000Z" {
+		t.Errorf("unexpected validity %s %s", indicator.ValidFrom, indicator.ValidUntil)
+	}
+	if relationship.SourceRef != indicator.ID || relationship.TargetRef != observable.ID {
+		t.Errorf("unexpected relationship %+v", relationship)
+	}
+
+	indicator = b.Objects[4]
+	if indicator.Pattern != "[ipv4-addr:value = '185.241.208.231']" {
+		t.Errorf("unexpected pattern %s", indicator.Pattern)
+	}
+	if indicator.ValidFrom != "2024-01-30T10:21:54.000Z" || indicator.ValidUntil != "2024-02-01T08:00:00.000Z" {
+		t.Errorf("unexpected validity %s %s", indicator.ValidFrom, indicator.ValidUntil)
+	}
+	if !strings.Contains(indicator.Description, "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75") ||
+		!strings.Contains(indicator.Description, "23B49521BDC4588C7CCF3C38E552504118326B66") {
+		t.Errorf("expected both relays in description, got %s", indicator.Description)
+	}
+	if indicator.Created != "2024-03-01T12:00:00.000Z" {
+		t.Errorf("unexpected created %s", indicator.Created)
+	}
+
+	// Identifiers are stable across exports.
+	var again bytes.Buffer
+	if err := stixBundle(&again, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	var b2 stixBundleObject
+	json.Unmarshal(again.Bytes(), &b2)
+	if b2.Objects[4].ID != indicator.ID {
+		t.Errorf("expected stable indicator id")
+	}
+}
+
+func TestSTIXBundlePatterns(t *testing.T) {
+	fixedNow(t)
+	at, _ := time.Parse(time.RFC3339, "2024-01-30T10:21:54Z")
+	r := Report{Nodes: []exitnode.ExitNode{{
+		ExitNode: "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75",
+		ExitAddresses: []exitnode.ExitAddress{
+			{ExitAddress: "2001:db8::1", UpdatedAt: at},
+			{ExitAddress: `1.2.3.4'] OR [x:y = '\`, UpdatedAt: at},
+		},
+	}}}
+
+	var buf bytes.Buffer
+	if err := stixBundle(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	var b stixBundleObject
+	if err := json.Unmarshal(buf.Bytes(), &b); err != nil {
+		t.Fatalf("Expected valid JSON, got: %v", err)
+	}
+	if len(b.Objects) != 6 {
+		t.Fatalf("expected 6 objects, got %d", len(b.Objects))
+	}
+	// Sorted by address: the odd one first.
+	if b.Objects[0].Type != "ipv4-addr" || b.Objects[1].Pattern != `[ipv4-addr:value = '1.2.3.4\'] OR [x:y = \'\\']` {
+		t.Errorf("unexpected observable %s, pattern %s", b.Objects[0].Type, b.Objects[1].Pattern)
+	}
+	if b.Objects[3].Type != "ipv6-addr" || !strings.HasPrefix(b.Objects[3].ID, "ipv6-addr--") || b.Objects[4].Pattern != "[ipv6-addr:value = '2001:db8::1']" {
+		t.Errorf("unexpected observable %+v, pattern %s", b.Objects[3], b.Objects[4].Pattern)
+	}
+}
@@ -0,0 +1,222 @@
+package arghandler
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+// Columns available in the text output, in their default order.
+const (
+	ColumnFingerprint = "fingerprint"
+	ColumnPublished   = "published"
+	ColumnLastStatus  = "last_status"
+	ColumnAddress     = "address"
+	ColumnUpdatedAt   = "updated_at"
+)
+
+// Time layouts selectable with -time-format.
+const (
+	TimeFormatRFC3339 = "rfc3339"
+	TimeFormatShort   = "short"
+)
+
+var defaultColumns = []string{ColumnFingerprint, ColumnPublished, ColumnLastStatus, ColumnAddress, ColumnUpdatedAt}
+
+var timeLayouts = map[string]string{
+	TimeFormatRFC3339: time.RFC3339,
+	TimeFormatShort:   "2006-01-02 15:04",
+}
+
+// header keeps the names the text output always had for each column.
+var header = map[string]string{
+	ColumnFingerprint: "ExitNode",
+	ColumnPublished:   "Published",
+	ColumnLastStatus:  "LastStatus",
+	ColumnAddress:     "ExitAddress",
+	ColumnUpdatedAt:   "UpdatedAt",
+}
+
+// FormatOptions tunes how formatters render a Report. The zero value is
+// usable: all the columns, a header line and RFC3339 times in UTC.
+type FormatOptions struct {
+	Columns    []string
+	NoHeader   bool
+	Location   *time.Location
+	TimeLayout string
+	// Template is only set for the template output.
+	Template *template.Template
+}
+
+// Time renders t the way the options ask for.
+func (o FormatOptions) Time(t time.Time) string {
+	loc := o.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	layout := o.TimeLayout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	return t.In(loc).Format(layout)
+}
+
+// FormatFlags holds the raw values of the output flags shared by every
+// command. AddFlags registers them, Parse validates them.
+type FormatFlags struct {
+	Output       string
+	Columns      string
+	NoHeader     bool
+	TimeZone     string
+	TimeFormat   string
+	Template     string
+	TemplateFile string
+}
+
+// AddFlags registers the output flags on set.
+func (f *FormatFlags) AddFlags(set *flag.FlagSet) {
+	set.StringVar(&f.Output, "output", Text.String(), "The output format, one of: "+strings.Join(Formats(), ", "))
+	set.StringVar(&f.Columns, "columns", strings.Join(defaultColumns, ","), "Comma separated list of columns to show in text output")
+	set.BoolVar(&f.NoHeader, "no-header", false, "Do not print the header line in text output")
+	set.StringVar(&f.TimeZone, "time-zone", "utc", "Time zone for dates: utc, local or an IANA name like Europe/Rome")
+	set.StringVar(&f.TimeFormat, "time-format", TimeFormatRFC3339, "Layout for dates: rfc3339 or short")
+	set.StringVar(&f.Template, "template", "", "Go text/template executed for each node with -output template")
+	set.StringVar(&f.TemplateFile, "template-file", "", "File containing the template to use with -output template")
+}
+
+// Parse validates the flag values and returns the selected formatter along
+// with the options to hand over in the Report.
+func (f *FormatFlags) Parse() (Formatter, FormatOptions, error) {
+	var o FormatOptions
+
+	formatter, err := LookupFormatter(f.Output)
+	if err != nil {
+		return nil, o, err
+	}
+
+	o.Columns, err = parseColumns(f.Columns)
+	if err != nil {
+		return nil, o, err
+	}
+
+	switch strings.ToLower(f.TimeZone) {
+	case "", "utc":
+		o.Location = time.UTC
+	case "local":
+		o.Location = time.Local
+	default:
+		o.Location, err = time.LoadLocation(f.TimeZone)
+		if err != nil {
+			return nil, o, fmt.Errorf("unknown time zone %q: %w", f.TimeZone, err)
+		}
+	}
+
+	layout, ok := timeLayouts[f.TimeFormat]
+	if !ok {
+		return nil, o, fmt.Errorf("unknown time format %q, valid formats are: %s, %s", f.TimeFormat, TimeFormatRFC3339, TimeFormatShort)
+	}
+	o.TimeLayout = layout
+	o.NoHeader = f.NoHeader
+
+	if f.Output == Template {
+		o.Template, err = parseTemplate(f.Template, f.TemplateFile, o)
+		if err != nil {
+			return nil, o, err
+		}
+	}
+
+	return formatter, o, nil
+}
+
+func parseColumns(s string) ([]string, error) {
+	var columns []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if _, ok := header[c]; !ok {
+			return nil, fmt.Errorf("unknown column %q, valid columns are: %s", c, strings.Join(defaultColumns, ", "))
+		}
+		columns = append(columns, c)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns selected, valid columns are: %s", strings.Join(defaultColumns, ", "))
+	}
+	return columns, nil
+}
+
+// table renders one line per exit address, aligning columns with a tabwriter.
+func table(w io.Writer, r Report) error {
+	columns := r.Options.Columns
+	if len(columns) == 0 {
+		columns = defaultColumns
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if !r.Options.NoHeader {
+		names := make([]string, len(columns))
+		for i, c := range columns {
+			names[i] = header[c]
+		}
+		fmt.Fprintln(tw, strings.Join(names, "\t"))
+	}
+
+	cells := make([]string, len(columns))
+	for _, n := range r.Nodes {
+		for _, a := range n.ExitAddresses {
+			for i, c := range columns {
+				cells[i] = cell(r.Options, c, n, a)
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if r.BestEffort {
+		return monthTable(w, r)
+	}
+	return nil
+}
+
+// monthTable renders the status of each month after a blank line, with
+// the source of the months pulled and the error of the others.
+func monthTable(w io.Writer, r Report) error {
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if !r.Options.NoHeader {
+		fmt.Fprintln(tw, "Month\tStatus\tDetail")
+	}
+	for _, m := range r.Months {
+		detail := m.Source
+		if m.Error != "" {
+			// The errors of many mirrors come one per line.
+			detail = strings.ReplaceAll(m.Error, "\n", "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.Date, m.Status, detail)
+	}
+	return tw.Flush()
+}
+
+func cell(o FormatOptions, column string, n exitnode.ExitNode, a exitnode.ExitAddress) string {
+	switch column {
+	case ColumnFingerprint:
+		return n.ExitNode
+	case ColumnPublished:
+		return o.Time(n.Published)
+	case ColumnLastStatus:
+		return o.Time(n.LastStatus)
+	case ColumnAddress:
+		return a.ExitAddress
+	case ColumnUpdatedAt:
+		return o.Time(a.UpdatedAt)
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package arghandler
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func testReport() Report {
+	p, _ := time.Parse(time.RFC3339, "2024-01-30T00:10:50Z")
+	u, _ := time.Parse(time.RFC3339, "2024-01-30T10:21:54Z")
+	return Report{Nodes: []exitnode.ExitNode{{
+		ExitNode:   "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75",
+		Published:  p,
+		LastStatus: p,
+		ExitAddresses: []exitnode.ExitAddress{
+			{ExitAddress: "185.241.208.231", UpdatedAt: u},
+			{ExitAddress: "1.2.3.4", UpdatedAt: u},
+		},
+	}}}
+}
+
+func TestTable(t *testing.T) {
+	var buf bytes.Buffer
+	if err := table(&buf, testReport()); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	gold := `ExitNode                                  Published             LastStatus            ExitAddress      UpdatedAt
+FE39F07EBE7870DCE124AB30DF3ABD0700A43F75  2024-01-30T00:10:50Z  2024-01-30T00:10:50Z  185.241.208.231  2024-01-30T10:21:54Z
+FE39F07EBE7870DCE124AB30DF3ABD0700A43F75  2024-01-30T00:10:50Z  2024-01-30T00:10:50Z  1.2.3.4          2024-01-30T10:21:54Z
+`
+	if buf.String() != gold {
+		t.Errorf("Expected \n%s, got: \n%s", gold, buf.String())
+	}
+}
+
+func TestTableBestEffort(t *testing.T) {
+	r := testReport()
+	r.BestEffort = true
+	r.Months = []Month{
+		{Date: "2024-01", Status: "ok", Source: "cache"},
+		{Date: "2024-02", Status: "missing", Error: "month 2024-02: a: not found\nb: not found"},
+	}
+	r.Options.Columns = []string{ColumnAddress}
+
+	var buf bytes.Buffer
+	if err := table(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	gold := `ExitAddress
+185.241.208.231
+1.2.3.4
+
+Month    Status   Detail
+2024-01  ok       cache
+2024-02  missing  month 2024-02: a: not found; b: not found
+`
+	if buf.String() != gold {
+		t.Errorf("Expected \n%s, got: \n%s", gold, buf.String())
+	}
+}
+
+func TestFormatFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		gold string
+	}{
+		{
+			[]string{"-columns", "address,fingerprint"},
+			`ExitAddress      ExitNode
+185.241.208.231  FE39F07EBE7870DCE124AB30DF3ABD0700A43F75
+1.2.3.4          FE39F07EBE7870DCE124AB30DF3ABD0700A43F75
+`,
+		},
+		{
+			[]string{"-columns", "address", "-no-header"},
+			`185.241.208.231
+1.2.3.4
+`,
+		},
+		{
+			[]string{"-columns", "updated_at", "-time-format", "short", "-time-zone", "Asia/Tokyo"},
+			`UpdatedAt
+2024-01-30 19:21
+2024-01-30 19:21
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			var f FormatFlags
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			f.AddFlags(set)
+			if err := set.Parse(tt.args); err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			formatter, o, err := f.Parse()
+			if err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			r := testReport()
+			r.Options = o
+			var buf bytes.Buffer
+			if err := formatter.Format(&buf, r); err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			if buf.String() != tt.gold {
+				t.Errorf("Expected \n%s, got: \n%s", tt.gold, buf.String())
+			}
+		})
+	}
+}
+
+func TestFormatFlagsErrors(t *testing.T) {
+	tests := []struct {
+		args                  []string
+		expectedErrorContains string
+	}{
+		{[]string{"-output", "yaml"}, "unknown output"},
+		{[]string{"-columns", "address,nope"}, "unknown column"},
+		{[]string{"-columns", ","}, "no columns selected"},
+		{[]string{"-time-zone", "Mars/Olympus"}, "unknown time zone"},
+		{[]string{"-time-format", "kitchen"}, "unknown time format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expectedErrorContains, func(t *testing.T) {
+			var f FormatFlags
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			f.AddFlags(set)
+			if err := set.Parse(tt.args); err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			_, _, err := f.Parse()
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErrorContains) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expectedErrorContains, err)
+			}
+		})
+	}
+}
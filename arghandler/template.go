@@ -0,0 +1,116 @@
+package arghandler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+// Template is the Output name of the user defined template format.
+const Template = "template"
+
+func init() {
+	RegisterFormatter(Template, FormatterFunc(executeTemplate))
+}
+
+// executeTemplate runs the user template once per node, each followed by a
+// new line, the same way docker ps --format does.
+func executeTemplate(w io.Writer, r Report) error {
+	if r.Options.Template == nil {
+		return errors.New("template output requires -template or -template-file")
+	}
+	for _, n := range r.Nodes {
+		if err := r.Options.Template.Execute(w, n); err != nil {
+			return fmt.Errorf("template error: %w", err)
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTemplate builds the template from the -template or -template-file
+// flag. The helper functions honour the time options, so it must be called
+// once those are known.
+//
+// The template is also executed against a sample node: this reports
+// references to unknown fields at parse time instead of halfway through the
+// output. The sample looks like a real node, not to reject templates that
+// only fail on empty data like {{slice .ExitNode 0 8}}.
+func parseTemplate(text, file string, o FormatOptions) (*template.Template, error) {
+	if text != "" && file != "" {
+		return nil, errors.New("-template and -template-file are mutually exclusive")
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("template file error: %w", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return nil, errors.New("template output requires -template or -template-file")
+	}
+
+	t, err := template.New("output").Funcs(templateFuncs(o)).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template error: %w", err)
+	}
+	if err := t.Execute(io.Discard, sampleNode); err != nil {
+		return nil, fmt.Errorf("template error: %w", err)
+	}
+	return t, nil
+}
+
+// sampleNode is a relay with two exit addresses, as found in the lists.
+var sampleNode = exitnode.ExitNode{
+	ExitNode:   "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75",
+	Published:  time.Date(2024, time.January, 30, 0, 10, 50, 0, time.UTC),
+	LastStatus: time.Date(2024, time.January, 30, 10, 0, 0, 0, time.UTC),
+	ExitAddresses: []exitnode.ExitAddress{
+		{ExitAddress: "185.241.208.231", UpdatedAt: time.Date(2024, time.January, 30, 10, 21, 54, 0, time.UTC), Addr: netip.AddrFrom4([4]byte{185, 241, 208, 231})},
+		{ExitAddress: "185.241.208.232", UpdatedAt: time.Date(2024, time.January, 30, 10, 21, 55, 0, time.UTC), Addr: netip.AddrFrom4([4]byte{185, 241, 208, 232})},
+	},
+}
+
+// templateFuncs are the helpers available in user templates:
+//
+//	time      formats a time with the -time-format/-time-zone options, or
+//	          with the layout passed as second argument ("rfc3339", "short"
+//	          or a Go layout like "2006-01-02").
+//	join      strings.Join.
+//	addresses the list of ExitAddress values of a node, handy with join.
+//	upper     strings.ToUpper.
+//	lower     strings.ToLower.
+func templateFuncs(o FormatOptions) template.FuncMap {
+	return template.FuncMap{
+		"time": func(t time.Time, layout ...string) string {
+			if len(layout) == 0 {
+				return o.Time(t)
+			}
+			l, ok := timeLayouts[layout[0]]
+			if !ok {
+				l = layout[0]
+			}
+			return FormatOptions{Location: o.Location, TimeLayout: l}.Time(t)
+		},
+		"join": strings.Join,
+		"addresses": func(n exitnode.ExitNode) []string {
+			addresses := make([]string, len(n.ExitAddresses))
+			for i, a := range n.ExitAddresses {
+				addresses[i] = a.ExitAddress
+			}
+			return addresses
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+	}
+}
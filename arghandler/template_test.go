@@ -0,0 +1,124 @@
+package arghandler
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		args []string
+		gold string
+	}{
+		{
+			[]string{"-template", "{{.ExitNode}} {{range .ExitAddresses}}{{.ExitAddress}};{{end}}"},
+			"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75 185.241.208.231;1.2.3.4;\n",
+		},
+		{
+			[]string{"-template", `{{lower .ExitNode}} {{join (addresses .) ","}}`},
+			"fe39f07ebe7870dce124ab30df3abd0700a43f75 185.241.208.231,1.2.3.4\n",
+		},
+		{
+			[]string{"-template", `{{time .Published}} {{time .Published "short"}} {{time .Published "2006"}}`, "-time-zone", "Asia/Tokyo"},
+			"2024-01-30T09:10:50+09:00 2024-01-30 09:10 2024\n",
+		},
+		{
+			// Fails on an empty node, not on a real one.
+			[]string{"-template", "{{slice .ExitNode 0 8}} {{(index .ExitAddresses 1).ExitAddress}}"},
+			"FE39F07E 1.2.3.4\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gold, func(t *testing.T) {
+			var f FormatFlags
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			f.AddFlags(set)
+			if err := set.Parse(append([]string{"-output", Template}, tt.args...)); err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			formatter, o, err := f.Parse()
+			if err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			r := testReport()
+			r.Options = o
+			var buf bytes.Buffer
+			if err := formatter.Format(&buf, r); err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			if buf.String() != tt.gold {
+				t.Errorf("Expected %q, got: %q", tt.gold, buf.String())
+			}
+		})
+	}
+}
+
+func TestTemplateErrorOnExecute(t *testing.T) {
+	f := FormatFlags{Output: Template, Columns: ColumnAddress, TimeFormat: TimeFormatRFC3339, Template: "{{slice .ExitNode 0 8}}"}
+	formatter, o, err := f.Parse()
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	r := Report{Nodes: []exitnode.ExitNode{{ExitNode: "AB"}}, Options: o}
+	err = formatter.Format(io.Discard, r)
+	if err == nil || !strings.Contains(err.Error(), "template error") {
+		t.Errorf("Expected template error, got: %v", err)
+	}
+}
+
+func TestTemplateFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "report.tmpl")
+	if err := os.WriteFile(file, []byte("{{.ExitNode}}"), 0600); err != nil {
+		t.Fatalf("error setup template file: %v", err)
+	}
+
+	f := FormatFlags{Output: Template, TemplateFile: file, Columns: ColumnAddress, TimeFormat: TimeFormatRFC3339}
+	formatter, o, err := f.Parse()
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	r := testReport()
+	r.Options = o
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, r); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if buf.String() != "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name                  string
+		flags                 FormatFlags
+		expectedErrorContains string
+	}{
+		{"missing", FormatFlags{}, "requires -template"},
+		{"syntax", FormatFlags{Template: "{{.ExitNode"}, "template error"},
+		{"unknown field", FormatFlags{Template: "{{.Nickname}}"}, "can't evaluate field Nickname"},
+		{"unknown function", FormatFlags{Template: "{{shout .ExitNode}}"}, "not defined"},
+		{"both", FormatFlags{Template: "x", TemplateFile: "y"}, "mutually exclusive"},
+		{"no file", FormatFlags{TemplateFile: filepath.Join(t.TempDir(), "nope")}, "template file error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.flags
+			f.Output, f.Columns, f.TimeFormat = Template, ColumnAddress, TimeFormatRFC3339
+			_, _, err := f.Parse()
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErrorContains) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expectedErrorContains, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Package collectortest is a fake CollecTor for tests and demos. It packs
+// exit lists made of Go values into monthly tar.xz archives, the way
+// CollecTor does, and serves them at the same paths, misbehaving on demand:
+// missing months, server errors, slow answers and corrupt archives, with or
+// without a digest to check them against.
+//
+//	s := collectortest.NewServer()
+//	defer s.Close()
+//	s.Set("2024-01", collectortest.Month{Lists: []collectortest.List{{
+//		Downloaded: at,
+//		Nodes:      []exitnode.ExitNode{collectortest.Node("FE39...", "185.241.208.232", at)},
+//	}}})
+//	s.Set("2024-02", collectortest.Month{Status: http.StatusNotFound})
+//	// download from s.URLTemplate()
+package collectortest
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/ulikunitz/xz"
+)
+
+// ArchivePath is where CollecTor serves the archive of a month, with a %s
+// in place of the year-month.
+const ArchivePath = archivePrefix + "%s.tar.xz"
+
+const archivePrefix = "/archive/exit-lists/exit-list-"
+
+// List is an exit list, CollecTor publishes one every hour or so.
+type List struct {
+	Downloaded time.Time
+	Nodes      []exitnode.ExitNode
+}
+
+// Node returns an exit node on address, last seen at at and published an
+// hour before: enough for most tests.
+func Node(fingerprint, address string, at time.Time) exitnode.ExitNode {
+	at = at.UTC().Truncate(time.Second)
+	return exitnode.ExitNode{
+		ExitNode:      fingerprint,
+		Published:     at.Add(-time.Hour),
+		LastStatus:    at,
+		ExitAddresses: []exitnode.ExitAddress{exitAddress(address, at)},
+	}
+}
+
+// exitAddress returns address updated at at, parsed the way exitnode does.
+func exitAddress(address string, at time.Time) exitnode.ExitAddress {
+	addr, _ := netip.ParseAddr(address)
+	return exitnode.ExitAddress{ExitAddress: address, UpdatedAt: at, Addr: addr}
+}
+
+// Fingerprint returns the fingerprint of the i-th synthetic node of Lists.
+func Fingerprint(i int) string {
+	return fmt.Sprintf("%X", sha1.Sum([]byte(strconv.Itoa(i))))
+}
+
+// Address returns the exit address of the i-th synthetic node of Lists.
+func Address(i int) string {
+	return fmt.Sprintf("185.%d.%d.%d", byte(i>>16), byte(i>>8), byte(i))
+}
+
+// Lists returns a synthetic month of exit lists, for benchmarks: perDay
+// lists a day, evenly spread, each with the same `nodes` exit nodes. Node i
+// is Fingerprint(i) on Address(i), every fifth one has a second address like
+// the relays with more than one exit. CollecTor has a list an hour with
+// about 1500 nodes.
+func Lists(month string, perDay, nodes int) ([]List, error) {
+	first, err := time.Parse("2006-01", month)
+	if err != nil {
+		return nil, err
+	}
+	var lists []List
+	for day := first; day.Before(first.AddDate(0, 1, 0)); day = day.AddDate(0, 0, 1) {
+		for k := 0; k < perDay; k++ {
+			at := day.Add(time.Duration(k)*24*time.Hour/time.Duration(perDay) + 2*time.Minute)
+			l := List{Downloaded: at, Nodes: make([]exitnode.ExitNode, nodes)}
+			for i := range l.Nodes {
+				n := Node(Fingerprint(i), Address(i), at)
+				if i%5 == 0 {
+					second := fmt.Sprintf("45.%d.%d.%d", byte(i>>16), byte(i>>8), byte(i))
+					n.ExitAddresses = append(n.ExitAddresses, exitAddress(second, n.LastStatus.Add(-time.Minute)))
+				}
+				l.Nodes[i] = n
+			}
+			lists = append(lists, l)
+		}
+	}
+	return lists, nil
+}
+
+// Archive returns the tar.xz of month holding lists, laid out like the ones
+// of CollecTor: exit-list-2024-01/01/2024-01-01-00-02-00, a folder per day
+// and a file per list named after the time it was downloaded.
+func Archive(month string, lists ...List) ([]byte, error) {
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(xw)
+	root := "exit-list-" + month + "/"
+	if err := tw.WriteHeader(&tar.Header{Name: root, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		return nil, err
+	}
+	days := map[string]bool{}
+	for _, l := range lists {
+		d := l.Downloaded.UTC()
+		day := root + d.Format("02") + "/"
+		if !days[day] {
+			days[day] = true
+			if err := tw.WriteHeader(&tar.Header{Name: day, Typeflag: tar.TypeDir, Mode: 0755, ModTime: d}); err != nil {
+				return nil, err
+			}
+		}
+		body := exitnode.Marshal(d, l.Nodes)
+		h := &tar.Header{Name: day + d.Format("2006-01-02-15-04-05"), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body)), ModTime: d}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(body); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := xw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Month is how a Handler serves the archive of a month.
+type Month struct {
+	Lists []List
+	// Status is answered instead of the archive when set, like 404 or 503.
+	Status int
+	// Delay is waited before answering, or until the client gives up.
+	Delay time.Duration
+	// Stall sends the first half of the archive, then hangs until the
+	// client gives up.
+	Stall bool
+	// Corrupt garbles the second half of the archive, Truncate cuts it off.
+	Corrupt  bool
+	Truncate bool
+	// Digest sends the SHA-256 of the archive in a Repr-Digest header, the
+	// one of the intact archive even when Corrupt or Truncate: a mirror
+	// serving a damaged copy of a published file.
+	Digest bool
+	// WrongRange cuts the first answer off halfway, like a dropped
+	// connection, then answers the Range requests that follow with the
+	// whole archive as a 206 starting at byte 0: a server getting the
+	// range wrong.
+	WrongRange bool
+	// ModTime is the Last-Modified of the archive, the time of the last
+	// list when zero.
+	ModTime time.Time
+}
+
+// served is a Month along with its archive.
+type served struct {
+	Month
+	archive  []byte
+	sum      [sha256.Size]byte
+	etag     string
+	requests int
+}
+
+// Handler serves archives at ArchivePath, a 404 for the months it was not
+// told about. Range and conditional requests are supported, with an ETag
+// changing along with the archive.
+type Handler struct {
+	mu     sync.Mutex
+	months map[string]*served
+}
+
+// NewHandler returns a Handler serving no month.
+func NewHandler() *Handler {
+	return &Handler{months: map[string]*served{}}
+}
+
+// Set tells how to serve month, a year-month like 2024-01, replacing what
+// was set before.
+func (h *Handler) Set(month string, m Month) error {
+	archive, err := Archive(month, m.Lists...)
+	if err != nil {
+		return fmt.Errorf("archive %s: %w", month, err)
+	}
+	if m.ModTime.IsZero() {
+		for _, l := range m.Lists {
+			if l.Downloaded.After(m.ModTime) {
+				m.ModTime = l.Downloaded
+			}
+		}
+	}
+	sum := sha256.Sum256(archive)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.months[month] = &served{
+		Month:   m,
+		archive: archive,
+		sum:     sum,
+		etag:    fmt.Sprintf(`"%x"`, sum),
+	}
+	return nil
+}
+
+// Requests returns how many requests month got, whatever the answer.
+func (h *Handler) Requests(month string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.months[month]; ok {
+		return s.requests
+	}
+	return 0
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	month, ok := strings.CutPrefix(r.URL.Path, archivePrefix)
+	month, ok2 := strings.CutSuffix(month, ".tar.xz")
+	h.mu.Lock()
+	s, found := h.months[month]
+	var requests int
+	if found {
+		s.requests++
+		requests = s.requests
+	}
+	h.mu.Unlock()
+	if !ok || !ok2 || !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if s.Delay > 0 {
+		timer := time.NewTimer(s.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if s.Status != 0 {
+		http.Error(w, http.StatusText(s.Status), s.Status)
+		return
+	}
+
+	archive := s.archive
+	switch {
+	case s.Corrupt:
+		archive = bytes.Clone(archive)
+		for i := len(archive) / 2; i < len(archive); i++ {
+			archive[i] ^= 0xff
+		}
+	case s.Truncate:
+		archive = archive[:len(archive)/2]
+	}
+	if s.Stall {
+		w.Header().Set("Content-Length", fmt.Sprint(len(archive)))
+		w.Write(archive[:len(archive)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	if s.Digest {
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(s.sum[:])+":")
+	}
+	if s.WrongRange {
+		switch {
+		case requests == 1:
+			w.Header().Set("Content-Length", fmt.Sprint(len(archive)))
+			w.Write(archive[:len(archive)/2])
+			w.(http.Flusher).Flush()
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		case r.Header.Get("Range") != "":
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(archive)-1, len(archive)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(archive)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(archive)
+			return
+		}
+	}
+	http.ServeContent(w, r, path.Base(r.URL.Path), s.ModTime, bytes.NewReader(archive))
+}
+
+// Server is a fake CollecTor listening on a local port.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a Server serving no month, to be closed once done.
+func NewServer() *Server {
+	h := NewHandler()
+	return &Server{Server: httptest.NewServer(h), Handler: h}
+}
+
+// URLTemplate returns the template of the archive URLs, with a %s in place
+// of the year-month, as expected by core.Options and the configuration.
+func (s *Server) URLTemplate() string {
+	return s.URL + ArchivePath
+}
@@ -0,0 +1,189 @@
+package collectortest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/xz"
+)
+
+var (
+	first  = time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	second = time.Date(2024, time.January, 2, 0, 2, 0, 0, time.UTC)
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	lists := []List{
+		{Downloaded: first, Nodes: []exitnode.ExitNode{Node("AAAA", "1.2.3.4", first)}},
+		{Downloaded: second, Nodes: []exitnode.ExitNode{Node("AAAA", "1.2.3.4", second), Node("BBBB", "5.6.7.8", second)}},
+	}
+	if err := s.Set("2024-01", Month{Lists: lists}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dir := t.TempDir()
+	archive, err := download.DownloadFile(context.Background(), dir, fmt.Sprintf(s.URLTemplate(), "2024-01"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if filepath.Base(archive) != "exit-list-2024-01.tar.xz" {
+		t.Errorf("unexpected archive name %s", archive)
+	}
+	if err := xz.ExtractTo(context.Background(), archive, dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The layout of CollecTor, and the lists read back as they were.
+	for i, name := range []string{"exit-list-2024-01/01/2024-01-01-00-02-00", "exit-list-2024-01/02/2024-01-02-00-02-00"} {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		nodes, err := exitnode.Unmarshal(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(nodes, lists[i].Nodes) {
+			t.Errorf("expected %+v, got %+v", lists[i].Nodes, nodes)
+		}
+	}
+	if s.Requests("2024-01") != 1 {
+		t.Errorf("expected a request, got %d", s.Requests("2024-01"))
+	}
+}
+
+func TestServerConditional(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Set("2024-01", Month{Lists: []List{{Downloaded: first}}})
+	u := fmt.Sprintf(s.URLTemplate(), "2024-01")
+
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") != first.Format(http.TimeFormat) {
+		t.Fatalf("expected validators, got %v", resp.Header)
+	}
+
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected not modified, got %v, %v", resp, err)
+	}
+
+	req, _ = http.NewRequest("GET", u, nil)
+	req.Header.Set("Range", "bytes=10-")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected partial content, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// A new version of the month, a new ETag.
+	s.Set("2024-01", Month{Lists: []List{{Downloaded: second}}})
+	req, _ = http.NewRequest("GET", u, nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the new archive, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	lists := []List{{Downloaded: first, Nodes: []exitnode.ExitNode{Node("AAAA", "1.2.3.4", first)}}}
+	s.Set("2024-02", Month{Lists: lists, Status: http.StatusServiceUnavailable})
+	s.Set("2024-03", Month{Lists: lists, Corrupt: true})
+	s.Set("2024-04", Month{Lists: lists, Truncate: true})
+	s.Set("2024-05", Month{Lists: lists, Delay: time.Hour})
+	s.Set("2024-06", Month{Lists: lists, Stall: true})
+
+	fetch := func(month string, timeout time.Duration) error {
+		d := download.Downloader{Timeout: timeout}
+		dir := t.TempDir()
+		archive, err := d.Download(context.Background(), dir, fmt.Sprintf(s.URLTemplate(), month))
+		if err != nil {
+			return err
+		}
+		return xz.ExtractTo(context.Background(), archive, dir)
+	}
+
+	tests := []struct {
+		month    string
+		expected error
+	}{
+		{"2024-01", download.ErrNotFound},
+		{"2024-02", download.ErrUnavailable},
+		{"2024-03", xz.ErrCorrupt},
+		{"2024-04", xz.ErrCorrupt},
+		{"2024-05", context.DeadlineExceeded},
+		{"2024-06", context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		if err := fetch(tt.month, 100*time.Millisecond); !errors.Is(err, tt.expected) {
+			t.Errorf("expected %v for %s, got: %v", tt.expected, tt.month, err)
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Errorf("expected %s to give up with the client", tt.month)
+		}
+	}
+}
+
+func TestHandlerErrorOnOtherPaths(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Set("2024-01", Month{})
+	for _, p := range []string{"/", "/exit-list-2024-01.tar.xz", "/archive/exit-lists/exit-list-2024-01.tar"} {
+		resp, err := http.Get(s.URL + p)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestLists(t *testing.T) {
+	lists, err := Lists("2024-02", 2, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 29 days in February 2024, two lists each.
+	if len(lists) != 58 {
+		t.Fatalf("expected 58 lists, got %d", len(lists))
+	}
+	if !lists[1].Downloaded.Equal(time.Date(2024, time.February, 1, 12, 2, 0, 0, time.UTC)) || !lists[57].Downloaded.Equal(time.Date(2024, time.February, 29, 12, 2, 0, 0, time.UTC)) {
+		t.Errorf("unexpected times %v, %v", lists[1].Downloaded, lists[57].Downloaded)
+	}
+	n := lists[0].Nodes[5]
+	if len(lists[0].Nodes) != 10 || n.ExitNode != Fingerprint(5) || len(Fingerprint(5)) != 40 || n.ExitAddresses[0].ExitAddress != Address(5) || len(n.ExitAddresses) != 2 {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if _, err := Lists("2024", 1, 1); err == nil {
+		t.Errorf("expected error, got: nil")
+	}
+}
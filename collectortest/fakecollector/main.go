@@ -0,0 +1,61 @@
+// Command fakecollector serves made up exit lists the way CollecTor does,
+// a local mirror to try his-tor-y without hitting the real one:
+//
+//	go run ./collectortest/fakecollector -start 2024-01 -end 2024-03 -ip 185.241.208.232
+//
+// Each month has a list a day with a few nodes, one of them on -ip.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "The address to listen on")
+	start := flag.String("start", "2024-01", "The first month served")
+	end := flag.String("end", "2024-03", "The last month served")
+	ip := flag.String("ip", "185.241.208.232", "The address of one of the nodes")
+	flag.Parse()
+
+	from, err := time.Parse("2006-01", *start)
+	if err != nil {
+		log.Fatalf("bad -start: %v", err)
+	}
+	to, err := time.Parse("2006-01", *end)
+	if err != nil {
+		log.Fatalf("bad -end: %v", err)
+	}
+
+	h := collectortest.NewHandler()
+	for m := from; !m.After(to); m = m.AddDate(0, 1, 0) {
+		var lists []collectortest.List
+		for d := m; d.Month() == m.Month(); d = d.AddDate(0, 0, 1) {
+			at := d.Add(2 * time.Minute)
+			lists = append(lists, collectortest.List{Downloaded: at, Nodes: []exitnode.ExitNode{
+				collectortest.Node(fingerprint(0, m), *ip, at),
+				collectortest.Node(fingerprint(1, m), fmt.Sprintf("192.0.2.%d", d.Day()), at),
+				collectortest.Node(fingerprint(2, m), "198.51.100.7", at),
+			}})
+		}
+		if err := h.Set(m.Format("2006-01"), collectortest.Month{Lists: lists}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	template := "http://" + *addr + collectortest.ArchivePath
+	fmt.Printf("serving %s to %s, try:\n\nHISTORY_DOWNLOAD_URL_TEMPLATE=%s go run . history -start %s -end %s -ip %s\n\n", *start, *end, template, *start, *end, *ip)
+	log.Fatal(http.ListenAndServe(*addr, h))
+}
+
+// fingerprint makes up the fingerprint of the i-th node, a new one each
+// month like relays coming and going.
+func fingerprint(i int, month time.Time) string {
+	return fmt.Sprintf("%04X%036X", i, month.Year()*100+int(month.Month()))
+}
@@ -0,0 +1,54 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/robizz/his-tor-y/arghandler"
+	"github.com/robizz/his-tor-y/conf"
+)
+
+// Config is the command to inspect the configuration.
+type Config struct {
+	Settings arghandler.Settings
+}
+
+func NewConfig() *Config {
+	return &Config{}
+}
+
+func (c *Config) Name() string {
+	return "config"
+}
+
+func (c *Config) Summary() string {
+	return "Show the effective configuration with 'config show'"
+}
+
+func (c *Config) Flags(*flag.FlagSet) {}
+
+func (c *Config) Parse(s arghandler.Settings) error {
+	c.Settings = s
+	if len(s.Args) != 1 || s.Args[0] != "show" {
+		return errors.New("usage: config show")
+	}
+	return nil
+}
+
+// Execute prints every setting with its value after merging defaults, config
+// file, environment and flags, and where that value comes from.
+func (c *Config) Execute(ctx context.Context, stdout io.Writer) error {
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Key\tValue\tSource")
+	for _, k := range conf.Keys {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", k, c.Settings.Config.Get(k), c.Settings.Origins[k])
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("execute error: %w", err)
+	}
+	return nil
+}
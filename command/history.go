@@ -2,46 +2,56 @@ package command
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"strings"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/robizz/his-tor-y/arghandler"
 	"github.com/robizz/his-tor-y/conf"
 	"github.com/robizz/his-tor-y/core"
-	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/progress"
 )
 
+// ErrNoMatch is returned by History.Execute when the IP was not an exit
+// address in the range. The output is written all the same, empty, so that
+// scripts can branch on the exit code like with grep.
+var ErrNoMatch = errors.New("no match")
+
 // Command struct
 type History struct {
-	StartDate string
-	EndDate   string
-	IP        string
-	Conf      conf.Config
-	Output    string
-	// here the command should also support an output writer, that
-	// I'm going to need to test commands output and formatting and stuff
+	StartDate  string
+	EndDate    string
+	IP         string
+	BestEffort bool
+	Settings   arghandler.Settings
 }
 
 func NewHistory() *History {
 	return &History{}
 }
 
-func (n *History) Parse(conf conf.Config, args []string) error {
-	n.Conf = conf
+func (n *History) Name() string {
+	return "history"
+}
+
+func (n *History) Summary() string {
+	return "Search an IP in the TOR exit nodes history of a range of months"
+}
 
-	set := flag.NewFlagSet("history", flag.ContinueOnError)
+func (n *History) Flags(set *flag.FlagSet) {
 	set.StringVar(&n.StartDate, "start", "2024-01", "The start month in a range search")
 	set.StringVar(&n.EndDate, "end", "2024-03", "The end month in a range search")
 	set.StringVar(&n.IP, "ip", "192.168.1.1", "The IP to search in the TOR nodes history")
-	set.StringVar(&n.Output, "output", "text", "The output format")
-
-	if err := set.Parse(args[2:]); err != nil {
-		return err
-	}
+	set.BoolVar(&n.BestEffort, "best-effort", false, "Show the results of the months that could be pulled when others fail, with the status of each month")
+}
 
+func (n *History) Parse(s arghandler.Settings) error {
+	n.Settings = s
 	return nil
 }
 
@@ -51,46 +61,81 @@ func (n *History) Execute(ctx context.Context, stdout io.Writer) error {
 	// An interface would require me to abstract the flags you send to core to make them general
 	// or to do even more complicated stuff like "functional options pattern".. just for the sake of testing..
 	// An alternative would be to pass a fake download url as did in core tests
-	nodes, err := core.History(ctx, n.Conf.ExitNode.DownloadURLTemplate, n.StartDate, n.EndDate, n.IP)
+	c := n.Settings.Config
+	reporter, done := newProgress(n.Settings)
+	d := newDownloader(c)
+	d.Progress = reporter
+	d.Logger = n.Settings.Logger
+	result, err := core.History(ctx, core.Options{
+		DownloadURLTemplates: c.ExitNode.URLTemplates(),
+		CacheDir:             c.CacheDir,
+		Concurrency:          c.Concurrency,
+		Downloader:           d,
+		Limits:               c.Limits(),
+		Progress:             reporter,
+		Logger:               n.Settings.Logger,
+		BestEffort:           n.BestEffort,
+	}, n.StartDate, n.EndDate, n.IP)
+	// Clear the progress line before anything else is printed.
+	done()
 
-	if err != nil {
+	// In best effort mode a partial result comes with the error of the
+	// months that failed: print it, then fail with the error.
+	if result == nil {
 		return fmt.Errorf("execute error: %w", err)
 	}
-	var out string
-	switch n.Output {
-	case arghandler.Json.String():
-		b, err := json.Marshal(&nodes)
-		if err != nil {
-			return err
-		}
-		out = string(b)
+	partial := err
 
-	case arghandler.Text.String():
-		out = table(nodes)
-
-	default:
-		out = table(nodes)
+	months := make([]arghandler.Month, len(result.Months))
+	for i, m := range result.Months {
+		months[i] = arghandler.Month{Date: m.Date, Source: m.Source, Status: string(m.Status)}
+		if m.Err != nil {
+			months[i].Error = m.Err.Error()
+		}
 	}
 
-	_, err = fmt.Fprint(stdout, out)
+	err = n.Settings.Formatter.Format(stdout, arghandler.Report{
+		Nodes: result.Nodes,
+		Query: []arghandler.Param{
+			{Name: "ip", Value: n.IP},
+			{Name: "start", Value: n.StartDate},
+			{Name: "end", Value: n.EndDate},
+		},
+		Months:     months,
+		BestEffort: n.BestEffort,
+		Options:    n.Settings.FormatOptions,
+	})
 	if err != nil {
 		return fmt.Errorf("execute error: %w", err)
 	}
+	if partial != nil {
+		return fmt.Errorf("execute error: %w", partial)
+	}
+	if len(result.Nodes) == 0 {
+		return ErrNoMatch
+	}
 	return nil
 }
 
-func (n *History) Help() string {
-	return "help?"
+// newDownloader builds the downloader out of the configuration.
+func newDownloader(c conf.Config) *download.Downloader {
+	d := download.New(&http.Client{})
+	d.Timeout = time.Duration(c.Timeout)
+	d.Retries = c.Retries
+	// A single limiter for all the months: the cap is for the whole run.
+	d.Limiter = download.NewLimiter(int64(c.RateLimit))
+	return d
 }
 
-func table(nodes []exitnode.ExitNode) string {
-	// nice, but now use a https://pkg.go.dev/text/tabwriter and write a test for it with coverage.
-	var sb strings.Builder
-	sb.WriteString("ExitNode\tPublished\tLastStatus\tExitAddress\tUpdatedAt\n")
-	for _, n := range nodes {
-		for _, a := range n.ExitAddresses {
-			sb.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", n.ExitNode, n.Published, n.LastStatus, a.ExitAddress, a.UpdatedAt))
-		}
+// newProgress returns where to report the progress and the function to call
+// once done. The progress line is only drawn when stderr is a terminal and
+// -quiet is not set: pipes, files and cron jobs get nothing. With -verbose
+// the log tells the progress, a line rewritten in between would garble it.
+func newProgress(s arghandler.Settings) (progress.Reporter, func()) {
+	f, ok := s.Stderr.(*os.File)
+	if s.Quiet || s.Verbose || !ok || !progress.IsTerminal(f) {
+		return progress.Discard, func() {}
 	}
-	return sb.String()
+	line := progress.NewLine(f)
+	return line, func() { line.Close() }
 }
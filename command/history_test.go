@@ -3,62 +3,109 @@ package command
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"net/http"
-	"net/http/httptest"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/robizz/his-tor-y/arghandler"
+	"github.com/robizz/his-tor-y/collectortest"
 	"github.com/robizz/his-tor-y/conf"
+	"github.com/robizz/his-tor-y/core"
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/progress"
 )
 
+// execute runs args through a router the same way main does.
+func execute(c conf.Config, args []string, stdout io.Writer) error {
+	r := arghandler.NewRouter()
+	r.Stderr = io.Discard
+	// Keep the real environment and config file out of the tests.
+	r.Getenv = func(name string) string {
+		if name == "XDG_CONFIG_HOME" {
+			return "testdata/no-config"
+		}
+		return ""
+	}
+	r.Register(NewHistory())
+	r.Register(NewConfig())
+	return r.Execute(context.Background(), c, args, stdout)
+}
+
 func TestParse(t *testing.T) {
 	n := NewHistory()
-	err := n.Parse(conf.Config{}, []string{"test", "now", "2024-01", "2024-02"})
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	n.Flags(set)
+	err := set.Parse([]string{"-start", "2024-01", "-end", "2024-02"})
 	if err != nil {
 		t.Fatalf("Error expected to be nil")
 	}
+	err = n.Parse(arghandler.Settings{Args: set.Args()})
+	if err != nil {
+		t.Fatalf("Error expected to be nil")
+	}
+	if n.StartDate != "2024-01" || n.EndDate != "2024-02" || n.IP != "192.168.1.1" {
+		t.Fatalf("unexpected flags %s %s %s", n.StartDate, n.EndDate, n.IP)
+	}
 }
 
 func TestParseErrorOnParsing(t *testing.T) {
-	n := NewHistory()
-	err := n.Parse(conf.Config{}, []string{"test", "now", "2024-01", "true", "ttt"})
-	if err != nil {
-		t.Fatalf("Error expected to be nil")
+	err := execute(conf.Config{}, []string{"test", "history", "-start"}, io.Discard)
+	if err == nil {
+		t.Fatalf("Expected error, got: nil")
 	}
 }
 
-func TestExecuteNowCoreCall(t *testing.T) {
-	var happyxz = "/Td6WFoAAATm1rRGBMC+AoAYIQEWAAAAAAAAAObJVkbgC/8BNl0AMp4JVwAUv4o0Se2uOQoAeCa9bRsjuAxO7ensztcweQ4vqTehTm70VrFwC56JobMMJA9pN0hxEJrISH3UM2Gco3oCpSgxdhJqF4pvwovzXIU3pVsHrxclP+Mwf+18s6Jqit760tO+pq174ynpfWaFG5jpx22bLjgraUd2kQonthTYPlmYGIQygxzX30Jkv2u5/+8hC3d2+JZvh05FofIrrMEVzwY7ygIAKCp5mGCXWYlhudHpfs95Ijtz+zNg4NIqT6Up/lInYzTxguDrVU0KzwM+qhx/gvaJRdIL1Z5MlAF99NqLEBfKUGVjZVmLHhrKjzhiR+atxa5akoqzW6gvDtFup3sNk2UrY86eKzw4qU5oNg/zu20bPjPjYJUkAc/vpn+1pVLxOH9w/SD36JVqjPpA7QRZAAAAAPbVQkNRMK+bAAHaAoAYAAAH/Fz1scRn+wIAAAAABFla"
-	dec, err := base64.StdEncoding.DecodeString(happyxz)
+// newTestServer serves the archive of 2024-01, with a node having
+// 185.241.208.232 in it, and a 404 for other months.
+func newTestServer(t *testing.T) *collectortest.Server {
+	t.Helper()
+	s := collectortest.NewServer()
+	t.Cleanup(s.Close)
+	at := func(v string) time.Time {
+		u, _ := time.Parse(time.DateTime, v)
+		return u
+	}
+	err := s.Set("2024-01", collectortest.Month{Lists: []collectortest.List{{
+		Downloaded: at("2024-01-01 00:02:00"),
+		Nodes: []exitnode.ExitNode{{
+			ExitNode:   "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75",
+			Published:  at("2023-12-31 11:29:15"),
+			LastStatus: at("2023-12-31 23:00:00"),
+			ExitAddresses: []exitnode.ExitAddress{
+				{ExitAddress: "185.241.208.232", UpdatedAt: at("2023-12-31 23:17:34")},
+				{ExitAddress: "171.25.193.25", UpdatedAt: at("2023-12-31 23:05:55")},
+			},
+		}},
+	}}})
 	if err != nil {
-		t.Errorf("error setup server:  %v", err)
+		t.Fatalf("error setup server: %v", err)
 	}
+	return s
+}
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write(dec)
-	}))
-	defer ts.Close()
+func TestExecuteNowCoreCall(t *testing.T) {
+	ts := newTestServer(t)
 
-	fakeURLTemplate := ts.URL + "/%s"
 	c := conf.Config{
 		ExitNode: conf.ExitNode{
-			DownloadURLTemplate: fakeURLTemplate,
+			DownloadURLTemplate: ts.URLTemplate(),
 		},
 	}
 
 	// Test default text output
-	gold := `ExitNode	Published	LastStatus	ExitAddress	UpdatedAt
-FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-31 23:00:00 +0000 UTC	185.241.208.232	2023-12-31 23:17:34 +0000 UTC
-FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-31 23:00:00 +0000 UTC	171.25.193.25	2023-12-31 23:05:55 +0000 UTC
+	gold := `ExitNode                                  Published             LastStatus            ExitAddress      UpdatedAt
+FE39F07EBE7870DCE124AB30DF3ABD0700A43F75  2023-12-31T11:29:15Z  2023-12-31T23:00:00Z  185.241.208.232  2023-12-31T23:17:34Z
+FE39F07EBE7870DCE124AB30DF3ABD0700A43F75  2023-12-31T11:29:15Z  2023-12-31T23:00:00Z  171.25.193.25    2023-12-31T23:05:55Z
 `
-	n := NewHistory()
-	err = n.Parse(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232"})
-	if err != nil {
-		t.Fatalf("Error expected to be nil")
-	}
 	var buf bytes.Buffer
-	err = n.Execute(context.Background(), &buf)
+	err := execute(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232"}, &buf)
 	if err != nil {
 		t.Fatalf("Expected nil, got: %v", err)
 	}
@@ -67,17 +114,25 @@ FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-3
 	}
 
 	// Test text output
-	gold = `ExitNode	Published	LastStatus	ExitAddress	UpdatedAt
-FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-31 23:00:00 +0000 UTC	185.241.208.232	2023-12-31 23:17:34 +0000 UTC
-FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-31 23:00:00 +0000 UTC	171.25.193.25	2023-12-31 23:05:55 +0000 UTC
+	gold = `ExitNode                                  Published             LastStatus            ExitAddress      UpdatedAt
+FE39F07EBE7870DCE124AB30DF3ABD0700A43F75  2023-12-31T11:29:15Z  2023-12-31T23:00:00Z  185.241.208.232  2023-12-31T23:17:34Z
+FE39F07EBE7870DCE124AB30DF3ABD0700A43F75  2023-12-31T11:29:15Z  2023-12-31T23:00:00Z  171.25.193.25    2023-12-31T23:05:55Z
 `
-	n = NewHistory()
-	err = n.Parse(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232", "-output", "text"})
+	buf.Reset()
+	err = execute(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232", "-output", "text"}, &buf)
 	if err != nil {
-		t.Fatalf("Error expected to be nil")
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if buf.String() != gold {
+		t.Fatalf("Expected %s, got: %s", gold, buf.String())
 	}
+
+	// Test text output with selected columns, no header and short times
+	gold = `185.241.208.232  2023-12-31 23:17
+171.25.193.25    2023-12-31 23:05
+`
 	buf.Reset()
-	err = n.Execute(context.Background(), &buf)
+	err = execute(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232", "-columns", "address,updated_at", "-no-header", "-time-format", "short"}, &buf)
 	if err != nil {
 		t.Fatalf("Expected nil, got: %v", err)
 	}
@@ -87,13 +142,8 @@ FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-3
 
 	// Test json output
 	gold = `[{"ExitNode":"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75","Published":"2023-12-31T11:29:15Z","LastStatus":"2023-12-31T23:00:00Z","ExitAddresses":[{"ExitAddress":"185.241.208.232","UpdatedAt":"2023-12-31T23:17:34Z"},{"ExitAddress":"171.25.193.25","UpdatedAt":"2023-12-31T23:05:55Z"}]}]`
-	n = NewHistory()
-	err = n.Parse(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232", "-output", "json"})
-	if err != nil {
-		t.Fatalf("Error expected to be nil")
-	}
 	buf.Reset()
-	err = n.Execute(context.Background(), &buf)
+	err = execute(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232", "-output", "json"}, &buf)
 	if err != nil {
 		t.Fatalf("Expected nil, got: %v", err)
 	}
@@ -102,32 +152,196 @@ FE39F07EBE7870DCE124AB30DF3ABD0700A43F75	2023-12-31 11:29:15 +0000 UTC	2023-12-3
 	}
 }
 
-func TestExecuteErrorOnNowCoreCall(t *testing.T) {
-	var xz = "dGVzdAo="
-	dec, err := base64.StdEncoding.DecodeString(xz)
-	if err != nil {
-		t.Errorf("error setup server:  %v", err)
+func TestExecuteErrorOnNoMatch(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := conf.Config{ExitNode: conf.ExitNode{DownloadURLTemplate: ts.URLTemplate()}}
+	var buf bytes.Buffer
+	err := execute(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "10.0.0.1", "-output", "json"}, &buf)
+	if !errors.Is(err, ErrNoMatch) {
+		t.Fatalf("Expected no match, got: %v", err)
+	}
+	// The output is there all the same.
+	if buf.String() != "[]" {
+		t.Errorf("Expected [], got: %s", buf.String())
+	}
+}
+
+func TestExecuteBestEffort(t *testing.T) {
+	// 2024-02 is missing.
+	ts := newTestServer(t)
+
+	c := conf.Config{ExitNode: conf.ExitNode{DownloadURLTemplate: ts.URLTemplate()}}
+	args := []string{"test", "history", "-start", "2024-01", "-end", "2024-02", "-ip", "185.241.208.232"}
+	var buf bytes.Buffer
+	err := execute(c, append(args, "-best-effort", "-columns", "address"), &buf)
+	if !errors.Is(err, core.ErrPartial) || !errors.Is(err, download.ErrNotFound) {
+		t.Fatalf("Expected partial results, got: %v", err)
+	}
+	gold := `ExitAddress
+185.241.208.232
+171.25.193.25
+
+Month    Status   Detail
+2024-01  ok       ` + fmt.Sprintf(ts.URLTemplate(), "2024-01") + `
+2024-02  missing  month 2024-02: ` + fmt.Sprintf(ts.URLTemplate(), "2024-02") + `: download error, server returned 404
+`
+	if buf.String() != gold {
+		t.Errorf("Expected \n%s, got: \n%s", gold, buf.String())
+	}
+
+	buf.Reset()
+	err = execute(c, append(args, "-best-effort", "-output", "json"), &buf)
+	if !errors.Is(err, core.ErrPartial) {
+		t.Fatalf("Expected partial results, got: %v", err)
+	}
+	for _, expected := range []string{`"nodes":[{"ExitNode":"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75"`, `{"month":"2024-02","status":"missing","error":"month 2024-02: `} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected output to contain %s, got: %s", expected, buf.String())
+		}
 	}
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write(dec)
-	}))
+	// Without -best-effort nothing is printed.
+	buf.Reset()
+	err = execute(c, args, &buf)
+	if err == nil || errors.Is(err, core.ErrPartial) || buf.Len() != 0 {
+		t.Errorf("Expected the query to fail with no output, got %v and %q", err, buf.String())
+	}
+}
+
+func TestExecuteVerboseLogs(t *testing.T) {
+	// The download URL has no month, the mirror has 2024-01.
+	ts := collectortest.NewServer()
 	defer ts.Close()
+	backup := newTestServer(t)
 
-	fakeURLTemplate := ts.URL + "/%s"
 	c := conf.Config{
 		ExitNode: conf.ExitNode{
-			DownloadURLTemplate: fakeURLTemplate,
+			DownloadURLTemplate: ts.URLTemplate(),
+			// A mirror as a base URL.
+			Mirrors: []string{backup.URL + path.Dir(collectortest.ArchivePath)},
 		},
 	}
+	source := fmt.Sprintf(backup.URLTemplate(), "2024-01")
 
-	n := NewHistory()
-	err = n.Parse(c, []string{"test", "now", "2024-01", "2024-01"})
+	var stderr bytes.Buffer
+	r := arghandler.NewRouter()
+	r.Stderr = &stderr
+	r.Getenv = func(string) string { return "" }
+	r.Register(NewHistory())
+	err := r.Execute(context.Background(), c, []string{"test", "-verbose", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232"}, io.Discard)
 	if err != nil {
-		t.Fatalf("Error expected to be nil")
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	for _, expected := range []string{
+		`level=WARN msg="mirror failed" month=2024-01 url=` + fmt.Sprintf(ts.URLTemplate(), "2024-01"),
+		`level=INFO msg="month pulled" month=2024-01 source=` + source + "\n",
+		`level=INFO msg=downloaded url=` + source + " status=200",
+		`level=INFO msg=scanned files=`,
+	} {
+		if !strings.Contains(stderr.String(), expected) {
+			t.Errorf("expected stderr to contain %q, got: %s", expected, stderr.String())
+		}
+	}
+
+	// Only warnings without -verbose, as JSON when asked.
+	stderr.Reset()
+	err = r.Execute(context.Background(), c, []string{"test", "-log-format", "json", "history", "-start", "2024-01", "-end", "2024-01", "-ip", "185.241.208.232"}, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], `{"time":`) || !strings.Contains(lines[0], `"level":"WARN","msg":"mirror failed","month":"2024-01"`) {
+		t.Errorf("expected a single JSON warning, got: %s", stderr.String())
 	}
-	err = n.Execute(context.Background(), os.Stdout)
+}
+
+func TestExecuteErrorOnNowCoreCall(t *testing.T) {
+	ts := collectortest.NewServer()
+	defer ts.Close()
+	ts.Set("2024-01", collectortest.Month{Corrupt: true})
+
+	c := conf.Config{
+		ExitNode: conf.ExitNode{
+			DownloadURLTemplate: ts.URLTemplate(),
+		},
+	}
+
+	err := execute(c, []string{"test", "history", "-start", "2024-01", "-end", "2024-01"}, os.Stdout)
 	if err == nil {
 		t.Fatalf("Expected error, got: nil")
 	}
 }
+
+func TestNewProgressSilent(t *testing.T) {
+	f, err := os.Create(t.TempDir() + "/stderr")
+	if err != nil {
+		t.Fatalf("error setup file: %v", err)
+	}
+	defer f.Close()
+
+	// Not a terminal, quiet or not an *os.File: no progress line.
+	for _, s := range []arghandler.Settings{
+		{Stderr: f},
+		{Stderr: os.Stderr, Quiet: true},
+		{Stderr: &bytes.Buffer{}},
+	} {
+		r, done := newProgress(s)
+		if r != progress.Discard {
+			t.Errorf("expected no progress for %+v", s)
+		}
+		done()
+	}
+}
+
+func TestParseErrorOnUnknownOutput(t *testing.T) {
+	err := execute(conf.Config{}, []string{"test", "history", "-output", "yaml"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "valid outputs are") {
+		t.Fatalf("Expected unknown output error, got: %v", err)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	var buf bytes.Buffer
+	if err := execute(conf.Config{}, []string{"test", "help", "history"}, &buf); err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	help := buf.String()
+	for _, expected := range []string{"Search an IP", "-start", `(default "2024-01")`, "-output"} {
+		if !strings.Contains(help, expected) {
+			t.Errorf("expected help to contain %q, got: \n%s", expected, help)
+		}
+	}
+}
+
+func TestConfigShow(t *testing.T) {
+	c := conf.Default()
+	var buf bytes.Buffer
+	err := execute(c, []string{"test", "-cache-dir", "/tmp/cache", "-max-extracted-bytes", "1GiB", "config", "show"}, &buf)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	gold := `Key                              Value                                                                    Source
+exit_node.download_url_template  https://collector.torproject.org/archive/exit-lists/exit-list-%s.tar.xz  default
+exit_node.mirrors                                                                                         default
+cache_dir                        /tmp/cache                                                               flag -cache-dir
+concurrency                      4                                                                        default
+rate_limit                       0                                                                        default
+timeout                          5m0s                                                                     default
+retries                          3                                                                        default
+max_files                        10000                                                                    default
+max_file_bytes                   256MiB                                                                   default
+max_extracted_bytes              1GiB                                                                     flag -max-extracted-bytes
+output                           text                                                                     default
+`
+	if buf.String() != gold {
+		t.Errorf("Expected \n%s, got: \n%s", gold, buf.String())
+	}
+}
+
+func TestConfigErrorOnMissingShow(t *testing.T) {
+	err := execute(conf.Default(), []string{"test", "config"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "usage: config show") {
+		t.Fatalf("Expected usage error, got: %v", err)
+	}
+}
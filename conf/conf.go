@@ -1,13 +1,430 @@
+// Package conf holds the configuration and loads it in layers: built-in
+// defaults, then a JSON config file, then HISTORY_* environment variables.
+// Flags come last and are applied by the arghandler router.
 package conf
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robizz/his-tor-y/xz"
+)
+
 // Config structs
 type ExitNode struct {
 	// DownloadURLTemplate contains the template for the exit node compressed files URL.
 	// The string is supposed to be:
 	// https://collector.torproject.org/archive/exit-lists/exit-list-2024-01.tar.xz
-	DownloadURLTemplate string
+	DownloadURLTemplate string `json:"download_url_template,omitempty"`
+	// Mirrors are tried in order when DownloadURLTemplate fails for a month.
+	// Each one is either a URL template like DownloadURLTemplate or a base
+	// URL like https://mirror.internal/exit-lists/ where the archive file name
+	// is appended.
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// archiveName is the name of the monthly archives on CollecTor, used to
+// turn a mirror base URL into a template.
+const archiveName = "exit-list-%s.tar.xz"
+
+// URLTemplates returns DownloadURLTemplate followed by the mirrors, all of
+// them as URL templates.
+func (e ExitNode) URLTemplates() []string {
+	var templates []string
+	for _, t := range append([]string{e.DownloadURLTemplate}, e.Mirrors...) {
+		t = strings.TrimSpace(t)
+		switch {
+		case t == "":
+			continue
+		case !strings.Contains(t, "%s"):
+			t = strings.TrimSuffix(t, "/") + "/" + archiveName
+		}
+		templates = append(templates, t)
+	}
+	return templates
 }
 
 type Config struct {
-	ExitNode ExitNode
+	ExitNode ExitNode `json:"exit_node"`
+	// CacheDir keeps the downloaded archives between runs. When empty the
+	// archives are downloaded in a temporary directory and thrown away.
+	CacheDir string `json:"cache_dir,omitempty"`
+	// Concurrency is the maximum number of months downloaded and extracted
+	// at the same time, 0 means no limit.
+	Concurrency int `json:"concurrency,omitempty"`
+	// RateLimit caps the bytes per second of all the downloads together,
+	// 0 means no limit.
+	RateLimit ByteSize `json:"rate_limit,omitempty"`
+	// Timeout bounds each HTTP request, 0 means no timeout.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Retries is the number of attempts after the first one for downloads
+	// failing on network or server errors.
+	Retries int `json:"retries,omitempty"`
+	// MaxFiles, MaxFileBytes and MaxExtractedBytes cap what each archive
+	// can extract: the number of entries, the size of each file and of all
+	// of them together. An archive going over is corrupt, 0 means no limit.
+	MaxFiles          int      `json:"max_files,omitempty"`
+	MaxFileBytes      ByteSize `json:"max_file_bytes,omitempty"`
+	MaxExtractedBytes ByteSize `json:"max_extracted_bytes,omitempty"`
+	// Output is the output format used when -output is not given.
+	Output string `json:"output,omitempty"`
+}
+
+// Limits returns the extraction limits as xz wants them.
+func (c Config) Limits() xz.Limits {
+	// For xz zero is the default and negative no limit.
+	unlimited := func(v int64) int64 {
+		if v == 0 {
+			return -1
+		}
+		return v
+	}
+	return xz.Limits{
+		MaxEntries:   int(unlimited(int64(c.MaxFiles))),
+		MaxFileSize:  unlimited(int64(c.MaxFileBytes)),
+		MaxTotalSize: unlimited(int64(c.MaxExtractedBytes)),
+	}
+}
+
+// Duration is a time.Duration written as "30s" or "2m" in the config file.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ByteSize is a number of bytes written as "500KB" or "2MiB" in the config
+// file: KB, MB and GB are powers of 1000, KiB, MiB and GiB of 1024.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	// Longest suffixes first, "B" would match them all.
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"B", 1},
+}
+
+// ParseByteSize parses a number of bytes with an optional unit.
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	original := s
+	size := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, size = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if v > math.MaxInt64/size {
+		return 0, fmt.Errorf("size %q is too large", original)
+	}
+	return ByteSize(v * size), nil
+}
+
+// String writes b with the largest unit dividing it.
+func (b ByteSize) String() string {
+	for _, suffix := range []string{"GB", "MB", "KB", "GiB", "MiB", "KiB"} {
+		for _, u := range byteUnits {
+			if u.suffix == suffix && b != 0 && int64(b)%u.size == 0 {
+				return strconv.FormatInt(int64(b)/u.size, 10) + u.suffix
+			}
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+// UnmarshalJSON accepts a plain number of bytes too.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 {
+			return fmt.Errorf("invalid size %d", n)
+		}
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a number or a string like \"500KB\": %w", err)
+	}
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// Default returns the built-in configuration.
+func Default() Config {
+	return Config{
+		ExitNode: ExitNode{DownloadURLTemplate: "https://collector.torproject.org/archive/exit-lists/exit-list-%s.tar.xz"},
+		// Be nice to collector, a long range should not open a download
+		// per month at once.
+		Concurrency: 4,
+		Timeout:     Duration(5 * time.Minute),
+		Retries:     3,
+		// The limits of xz, shown by config show.
+		MaxFiles:          xz.DefaultMaxEntries,
+		MaxFileBytes:      xz.DefaultMaxFileSize,
+		MaxExtractedBytes: xz.DefaultMaxTotalSize,
+		Output:            "text",
+	}
+}
+
+// Key names a setting, the same way in the config file (dots are nesting),
+// in `config show` and, upper cased with a HISTORY_ prefix, in the
+// environment.
+type Key string
+
+const (
+	KeyDownloadURLTemplate Key = "exit_node.download_url_template"
+	KeyMirrors             Key = "exit_node.mirrors"
+	KeyCacheDir            Key = "cache_dir"
+	KeyConcurrency         Key = "concurrency"
+	KeyRateLimit           Key = "rate_limit"
+	KeyTimeout             Key = "timeout"
+	KeyRetries             Key = "retries"
+	KeyMaxFiles            Key = "max_files"
+	KeyMaxFileBytes        Key = "max_file_bytes"
+	KeyMaxExtractedBytes   Key = "max_extracted_bytes"
+	KeyOutput              Key = "output"
+)
+
+// Keys lists all the settings in display order.
+var Keys = []Key{KeyDownloadURLTemplate, KeyMirrors, KeyCacheDir, KeyConcurrency, KeyRateLimit, KeyTimeout, KeyRetries, KeyMaxFiles, KeyMaxFileBytes, KeyMaxExtractedBytes, KeyOutput}
+
+// Env returns the environment variable overriding k.
+func (k Key) Env() string {
+	name := string(k)
+	// The exit_node section is implied, HISTORY_DOWNLOAD_URL_TEMPLATE reads
+	// better than HISTORY_EXIT_NODE_DOWNLOAD_URL_TEMPLATE.
+	name = strings.TrimPrefix(name, "exit_node.")
+	return "HISTORY_" + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+}
+
+// Get returns the value of k as text.
+func (c Config) Get(k Key) string {
+	switch k {
+	case KeyDownloadURLTemplate:
+		return c.ExitNode.DownloadURLTemplate
+	case KeyMirrors:
+		return strings.Join(c.ExitNode.Mirrors, ",")
+	case KeyCacheDir:
+		return c.CacheDir
+	case KeyConcurrency:
+		return strconv.Itoa(c.Concurrency)
+	case KeyRateLimit:
+		return c.RateLimit.String()
+	case KeyTimeout:
+		return c.Timeout.String()
+	case KeyRetries:
+		return strconv.Itoa(c.Retries)
+	case KeyMaxFiles:
+		return strconv.Itoa(c.MaxFiles)
+	case KeyMaxFileBytes:
+		return c.MaxFileBytes.String()
+	case KeyMaxExtractedBytes:
+		return c.MaxExtractedBytes.String()
+	case KeyOutput:
+		return c.Output
+	}
+	return ""
+}
+
+// Set parses value and assigns it to k.
+func (c *Config) Set(k Key, value string) error {
+	switch k {
+	case KeyDownloadURLTemplate:
+		c.ExitNode.DownloadURLTemplate = value
+	case KeyMirrors:
+		// Comma separated, as in HISTORY_MIRRORS.
+		c.ExitNode.Mirrors = nil
+		for _, m := range strings.Split(value, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				c.ExitNode.Mirrors = append(c.ExitNode.Mirrors, m)
+			}
+		}
+	case KeyCacheDir:
+		c.CacheDir = value
+	case KeyConcurrency:
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s must be a positive number, got %q", k, value)
+		}
+		c.Concurrency = v
+	case KeyRateLimit:
+		v, err := ParseByteSize(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a size like 500KB, got %q", k, value)
+		}
+		c.RateLimit = v
+	case KeyTimeout:
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s, got %q", k, value)
+		}
+		c.Timeout = Duration(v)
+	case KeyRetries:
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s must be a positive number, got %q", k, value)
+		}
+		c.Retries = v
+	case KeyMaxFiles:
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s must be a positive number, got %q", k, value)
+		}
+		c.MaxFiles = v
+	case KeyMaxFileBytes, KeyMaxExtractedBytes:
+		v, err := ParseByteSize(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a size like 256MiB, got %q", k, value)
+		}
+		if k == KeyMaxFileBytes {
+			c.MaxFileBytes = v
+		} else {
+			c.MaxExtractedBytes = v
+		}
+	case KeyOutput:
+		c.Output = value
+	default:
+		return fmt.Errorf("unknown setting %q", k)
+	}
+	return nil
+}
+
+// Origins tells where the value of each setting comes from: "default",
+// "file <path>", "env <NAME>" or "flag -<name>".
+type Origins map[Key]string
+
+// Load layers the config file and the environment on top of c. path is the
+// config file given by the user, it must exist. When empty HISTORY_CONFIG is
+// used and, failing that, the file in the default location is read if there.
+func Load(c Config, path string, getenv func(string) string) (Config, Origins, error) {
+	origins := Origins{}
+	for _, k := range Keys {
+		origins[k] = "default"
+	}
+
+	required := true
+	if path == "" {
+		path = getenv("HISTORY_CONFIG")
+	}
+	if path == "" {
+		path, required = DefaultPath(getenv), false
+	}
+
+	if path != "" {
+		err := readFile(path, &c, origins)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !required:
+		case err != nil:
+			return c, nil, err
+		}
+	}
+
+	for _, k := range Keys {
+		if v := getenv(k.Env()); v != "" {
+			if err := c.Set(k, v); err != nil {
+				return c, nil, fmt.Errorf("env %s error: %w", k.Env(), err)
+			}
+			origins[k] = "env " + k.Env()
+		}
+	}
+
+	return c, origins, nil
+}
+
+// DefaultPath is $XDG_CONFIG_HOME/his-tor-y/config.json, or the same under
+// the user config dir of the platform.
+func DefaultPath(getenv func(string) string) string {
+	dir := getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		var err error
+		dir, err = os.UserConfigDir()
+		if err != nil {
+			return ""
+		}
+	}
+	return filepath.Join(dir, "his-tor-y", "config.json")
+}
+
+// ReadFile reads the JSON config file at path on top of c: values missing
+// from the file are left untouched.
+func ReadFile(path string, c *Config) error {
+	return readFile(path, c, Origins{})
+}
+
+func readFile(path string, c *Config, origins Origins) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file error: %w", err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	// A typo in a key should not go unnoticed.
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return fmt.Errorf("config file %s error: %w", path, err)
+	}
+
+	// Decode again in a generic map to know which keys are in the file.
+	var present map[string]any
+	if err := json.Unmarshal(b, &present); err != nil {
+		return fmt.Errorf("config file %s error: %w", path, err)
+	}
+	for _, k := range Keys {
+		if has(present, strings.Split(string(k), ".")) {
+			origins[k] = "file " + path
+		}
+	}
+	return nil
+}
+
+func has(m map[string]any, path []string) bool {
+	v, ok := m[path[0]]
+	if !ok || len(path) == 1 {
+		return ok
+	}
+	sub, ok := v.(map[string]any)
+	return ok && has(sub, path[1:])
 }
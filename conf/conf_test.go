@@ -0,0 +1,270 @@
+package conf
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/xz"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("error setup config dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("error setup config file: %v", err)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, origins, err := Load(Default(), "", env(map[string]string{"XDG_CONFIG_HOME": t.TempDir()}))
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("expected defaults, got %+v", c)
+	}
+	for _, k := range Keys {
+		if origins[k] != "default" {
+			t.Errorf("expected %s from default, got %s", k, origins[k])
+		}
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	xdg := t.TempDir()
+	path := filepath.Join(xdg, "his-tor-y", "config.json")
+	writeConfig(t, path, `{
+		"exit_node": {
+			"download_url_template": "https://mirror.internal/exit-list-%s.tar.xz",
+			"mirrors": ["https://collector.torproject.org/archive/exit-lists/"]
+		},
+		"cache_dir": "/from/file",
+		"rate_limit": "2MB",
+		"timeout": "1m",
+		"max_files": 50
+	}`)
+
+	c, origins, err := Load(Default(), "", env(map[string]string{
+		"XDG_CONFIG_HOME":             xdg,
+		"HISTORY_CACHE_DIR":           "/from/env",
+		"HISTORY_OUTPUT":              "json",
+		"HISTORY_MAX_EXTRACTED_BYTES": "0",
+	}))
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+
+	expected := Config{
+		ExitNode: ExitNode{
+			DownloadURLTemplate: "https://mirror.internal/exit-list-%s.tar.xz",
+			Mirrors:             []string{"https://collector.torproject.org/archive/exit-lists/"},
+		},
+		CacheDir:     "/from/env",
+		Concurrency:  4,
+		RateLimit:    2e6,
+		Timeout:      Duration(time.Minute),
+		Retries:      3,
+		MaxFiles:     50,
+		MaxFileBytes: 256 << 20,
+		Output:       "json",
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %+v, got %+v", expected, c)
+	}
+
+	expectedOrigins := Origins{
+		KeyDownloadURLTemplate: "file " + path,
+		KeyMirrors:             "file " + path,
+		KeyCacheDir:            "env HISTORY_CACHE_DIR",
+		KeyConcurrency:         "default",
+		KeyRateLimit:           "file " + path,
+		KeyRetries:             "default",
+		KeyTimeout:             "file " + path,
+		KeyMaxFiles:            "file " + path,
+		KeyMaxFileBytes:        "default",
+		KeyMaxExtractedBytes:   "env HISTORY_MAX_EXTRACTED_BYTES",
+		KeyOutput:              "env HISTORY_OUTPUT",
+	}
+	for k, v := range expectedOrigins {
+		if origins[k] != v {
+			t.Errorf("expected %s from %s, got %s", k, v, origins[k])
+		}
+	}
+}
+
+func TestLoadExplicitPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "custom.json")
+	writeConfig(t, path, `{"concurrency": 3}`)
+
+	for _, tt := range []struct {
+		name string
+		path string
+		env  map[string]string
+	}{
+		{"flag", path, map[string]string{}},
+		{"env", "", map[string]string{"HISTORY_CONFIG": path}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, origins, err := Load(Default(), tt.path, env(tt.env))
+			if err != nil {
+				t.Fatalf("Expected nil, got: %v", err)
+			}
+			if c.Concurrency != 3 || origins[KeyConcurrency] != "file "+path {
+				t.Errorf("unexpected %d from %s", c.Concurrency, origins[KeyConcurrency])
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.json")
+	writeConfig(t, unknown, `{"cache_dri": "/typo"}`)
+	badTimeout := filepath.Join(dir, "timeout.json")
+	writeConfig(t, badTimeout, `{"timeout": 30}`)
+
+	tests := []struct {
+		name                  string
+		path                  string
+		env                   map[string]string
+		expectedErrorContains string
+	}{
+		{"missing explicit file", filepath.Join(dir, "nope.json"), nil, "config file error"},
+		{"unknown key", unknown, nil, "unknown field"},
+		{"bad timeout in file", badTimeout, nil, "duration must be a string"},
+		{"bad concurrency in env", "", map[string]string{"HISTORY_CONCURRENCY": "many"}, "env HISTORY_CONCURRENCY error"},
+		{"bad timeout in env", "", map[string]string{"HISTORY_TIMEOUT": "soon"}, "env HISTORY_TIMEOUT error"},
+		{"bad rate limit in env", "", map[string]string{"HISTORY_RATE_LIMIT": "fast"}, "env HISTORY_RATE_LIMIT error"},
+		{"bad retries in env", "", map[string]string{"HISTORY_RETRIES": "-1"}, "env HISTORY_RETRIES error"},
+		{"bad max files in env", "", map[string]string{"HISTORY_MAX_FILES": "-1"}, "env HISTORY_MAX_FILES error"},
+		{"bad max file bytes in env", "", map[string]string{"HISTORY_MAX_FILE_BYTES": "big"}, "env HISTORY_MAX_FILE_BYTES error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := map[string]string{"XDG_CONFIG_HOME": dir}
+			for k, v := range tt.env {
+				vars[k] = v
+			}
+			_, _, err := Load(Default(), tt.path, env(vars))
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErrorContains) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expectedErrorContains, err)
+			}
+		})
+	}
+}
+
+func TestKeyEnv(t *testing.T) {
+	if KeyDownloadURLTemplate.Env() != "HISTORY_DOWNLOAD_URL_TEMPLATE" {
+		t.Errorf("unexpected %s", KeyDownloadURLTemplate.Env())
+	}
+	if KeyCacheDir.Env() != "HISTORY_CACHE_DIR" {
+		t.Errorf("unexpected %s", KeyCacheDir.Env())
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	var c Config
+	for _, k := range Keys {
+		value := map[Key]string{
+			KeyDownloadURLTemplate: "http://x/%s",
+			KeyMirrors:             "http://y/%s,http://z/",
+			KeyCacheDir:            "/cache",
+			KeyConcurrency:         "2",
+			KeyRateLimit:           "512KiB",
+			KeyTimeout:             "1m30s",
+			KeyRetries:             "5",
+			KeyMaxFiles:            "100",
+			KeyMaxFileBytes:        "64MiB",
+			KeyMaxExtractedBytes:   "1GB",
+			KeyOutput:              "json",
+		}[k]
+		if err := c.Set(k, value); err != nil {
+			t.Fatalf("Expected nil, got: %v", err)
+		}
+		if c.Get(k) != value {
+			t.Errorf("expected %s for %s, got %s", value, k, c.Get(k))
+		}
+	}
+	if err := c.Set("nope", "x"); err == nil {
+		t.Errorf("Expected error, got: nil")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	expected := xz.Limits{MaxEntries: xz.DefaultMaxEntries, MaxFileSize: xz.DefaultMaxFileSize, MaxTotalSize: xz.DefaultMaxTotalSize}
+	if l := Default().Limits(); l != expected {
+		t.Errorf("expected %+v, got %+v", expected, l)
+	}
+	// 0 is no limit, not the default of xz.
+	c := Config{MaxFiles: 20}
+	expected = xz.Limits{MaxEntries: 20, MaxFileSize: -1, MaxTotalSize: -1}
+	if l := c.Limits(); l != expected {
+		t.Errorf("expected %+v, got %+v", expected, l)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected ByteSize
+		out      string
+	}{
+		{"0", 0, "0"},
+		{"500", 500, "500"},
+		{"500B", 500, "500"},
+		{"1024", 1024, "1KiB"},
+		{"100KB", 100e3, "100KB"},
+		{"1 MiB", 1 << 20, "1MiB"},
+		{"3GB", 3e9, "3GB"},
+	}
+	for _, tt := range tests {
+		b, err := ParseByteSize(tt.in)
+		if err != nil {
+			t.Fatalf("Expected nil for %s, got: %v", tt.in, err)
+		}
+		if b != tt.expected || b.String() != tt.out {
+			t.Errorf("expected %s to be %d written %s, got %d written %s", tt.in, tt.expected, tt.out, b, b)
+		}
+	}
+	for _, in := range []string{"", "MB", "-1KB", "1TB", "9000000000GiB", "9223372036854775808"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("Expected error for %q, got: nil", in)
+		}
+	}
+
+	// Plain numbers are fine in the config file.
+	var c Config
+	if err := json.Unmarshal([]byte(`{"rate_limit": 2048}`), &c); err != nil || c.RateLimit != 2048 {
+		t.Errorf("expected 2048, got %d (%v)", c.RateLimit, err)
+	}
+	if err := json.Unmarshal([]byte(`{"max_file_bytes": -5}`), &c); err == nil {
+		t.Errorf("Expected error for a negative size, got: nil")
+	}
+}
+
+func TestURLTemplates(t *testing.T) {
+	e := ExitNode{
+		DownloadURLTemplate: "https://mirror.internal/exit-lists/exit-list-%s.tar.xz",
+		Mirrors:             []string{"https://collector.torproject.org/archive/exit-lists/", " ", "http://backup/lists"},
+	}
+	expected := []string{
+		"https://mirror.internal/exit-lists/exit-list-%s.tar.xz",
+		"https://collector.torproject.org/archive/exit-lists/exit-list-%s.tar.xz",
+		"http://backup/lists/exit-list-%s.tar.xz",
+	}
+	if got := e.URLTemplates(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
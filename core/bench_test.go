@@ -0,0 +1,50 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/progress"
+)
+
+// year is a synthetic year of exit lists in memory, a list a day of 1500
+// nodes: a 24th of what CollecTor publishes.
+var year = sync.OnceValues(func() ([]Document, error) {
+	var docs []Document
+	for m := 1; m <= 12; m++ {
+		month, err := collectortest.Lists(fmt.Sprintf("2024-%02d", m), 1, 1500)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range month {
+			b := exitnode.Marshal(l.Downloaded, l.Nodes)
+			docs = append(docs, Document{Name: l.Downloaded.String(), Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(b)), nil
+			}})
+		}
+	}
+	return docs, nil
+})
+
+func BenchmarkFind(b *testing.B) {
+	docs, err := year()
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		nodes, err := find(context.Background(), MatchIP(collectortest.Address(42)), docs, progress.Discard, nil)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		if len(nodes) != len(docs) {
+			b.Fatalf("expected a node per list, got %d", len(nodes))
+		}
+	}
+}
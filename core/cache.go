@@ -0,0 +1,53 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/xz"
+)
+
+// fromCache extracts the archive of date in target when it is in the
+// cache. A corrupt archive is thrown away, to be downloaded again, and ok
+// is false like for one that is not there; err is only set when ctx is
+// done.
+func (s *HTTPSource) fromCache(ctx context.Context, date, target string, logger *slog.Logger) (ok bool, err error) {
+	archive, ok := s.cached(date)
+	if !ok {
+		return false, nil
+	}
+	x := xz.Extractor{Progress: s.Progress, Logger: s.Logger, Limits: s.Limits}
+	err = x.ExtractTo(ctx, archive, target)
+	if err == nil {
+		return true, nil
+	}
+	os.RemoveAll(target)
+	if ctx.Err() != nil {
+		return false, err
+	}
+	logger.Warn("corrupt archive in cache, downloading it again", "archive", archive, "error", err)
+	download.Remove(archive)
+	return false, nil
+}
+
+// cached returns the archive of date in the cache dir, if there. The archive
+// of the current month is still growing so it is never taken from the cache
+// as is: pullFrom asks the mirror whether it changed.
+func (s *HTTPSource) cached(date string) (string, bool) {
+	if date >= time.Now().UTC().Format(yearDashMonth) {
+		return "", false
+	}
+	for _, t := range s.URLTemplates {
+		archive := filepath.Join(s.CacheDir, path.Base(fmt.Sprintf(t, date)))
+		if _, err := os.Stat(archive); err == nil {
+			return archive, true
+		}
+	}
+	return "", false
+}
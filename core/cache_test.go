@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/collectortest"
+)
+
+// TestHistoryCacheDir checks that archives of past months are downloaded once
+// and then served from the cache dir.
+func TestHistoryCacheDir(t *testing.T) {
+	s := newServer(t, "2024-01")
+
+	opts := Options{
+		DownloadURLTemplates: []string{s.URLTemplate()},
+		CacheDir:             filepath.Join(t.TempDir(), "cache"),
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := History(context.Background(), opts, "2024-01", "2024-01", "194.26.192.64")
+		if err != nil {
+			t.Fatalf("Unxpected error: %v", err)
+		}
+		if len(result.Nodes) == 0 {
+			t.Fatalf("expected nodes from run %d", i)
+		}
+		source := fmt.Sprintf(s.URLTemplate(), "2024-01")
+		if i > 0 {
+			source = SourceCache
+		}
+		if result.Months[0].Source != source {
+			t.Errorf("expected 2024-01 from %s, got %s", source, result.Months[0].Source)
+		}
+	}
+
+	if n := s.Requests("2024-01"); n != 1 {
+		t.Errorf("expected 1 download, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(opts.CacheDir, "exit-list-2024-01.tar.xz")); err != nil {
+		t.Errorf("expected archive in cache: %v", err)
+	}
+}
+
+// TestHistoryCacheDirCurrentMonth checks that the archive of the current
+// month is only downloaded again when it changed.
+func TestHistoryCacheDirCurrentMonth(t *testing.T) {
+	month := time.Now().UTC().Format(yearDashMonth)
+	s := newServer(t, month)
+
+	opts := Options{
+		DownloadURLTemplates: []string{s.URLTemplate()},
+		CacheDir:             filepath.Join(t.TempDir(), "cache"),
+	}
+
+	// The second run asks the server, which answers 304.
+	for i, source := range []string{fmt.Sprintf(s.URLTemplate(), month), SourceCache} {
+		result, err := History(context.Background(), opts, month, month, "194.26.192.64")
+		if err != nil {
+			t.Fatalf("Unxpected error: %v", err)
+		}
+		if len(result.Nodes) == 0 {
+			t.Fatalf("expected nodes from run %d", i)
+		}
+		if result.Months[0].Source != source {
+			t.Errorf("expected %s from %s, got %s", month, source, result.Months[0].Source)
+		}
+	}
+
+	if n := s.Requests(month); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+}
+
+// TestHistoryCacheDirErrorOnDownload checks that a failed download does not
+// leave anything that looks cached.
+func TestHistoryCacheDirErrorOnDownload(t *testing.T) {
+	s := newServer(t)
+	s.Set("2024-01", collectortest.Month{Status: http.StatusInternalServerError})
+
+	opts := Options{
+		DownloadURLTemplates: []string{s.URLTemplate()},
+		CacheDir:             t.TempDir(),
+	}
+	_, err := History(context.Background(), opts, "2024-01", "2024-01", "194.26.192.64")
+	if err == nil {
+		t.Fatalf("Expected error, but got nil")
+	}
+	entries, _ := os.ReadDir(opts.CacheDir)
+	if len(entries) != 0 {
+		t.Errorf("expected empty cache, got %v", entries)
+	}
+}
@@ -1,101 +1,346 @@
 package core
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/robizz/his-tor-y/ctxio"
 	"github.com/robizz/his-tor-y/download"
 	"github.com/robizz/his-tor-y/exitnode"
-	"github.com/robizz/his-tor-y/files"
+	"github.com/robizz/his-tor-y/logging"
+	"github.com/robizz/his-tor-y/progress"
 	"github.com/robizz/his-tor-y/xz"
 	"golang.org/x/sync/errgroup"
 )
 
+// Options tunes where History gets the exit lists from.
+type Options struct {
+	// DownloadURLTemplates are the URLs of the monthly archives, with a %s in
+	// place of the year-month. They are mirrors tried in order for each month
+	// until one serves a good archive.
+	DownloadURLTemplates []string
+	// CacheDir keeps the downloaded archives between runs. When empty the
+	// archives are downloaded in a temporary directory and thrown away.
+	CacheDir string
+	// TempDir is where the temporary directory of each query goes, the
+	// default of os.MkdirTemp when empty.
+	TempDir string
+	// Concurrency is the maximum number of months pulled at the same time,
+	// 0 means no limit.
+	Concurrency int
+	// Downloader fetches the archives, a single attempt with the default
+	// HTTP client when nil. It reports its own progress.
+	Downloader *download.Downloader
+	// Progress receives the files extracted and scanned.
+	Progress progress.Reporter
+	// Limits caps what each archive can extract, see xz.Limits.
+	Limits xz.Limits
+	// Source provides the exit lists. When nil they come from an
+	// HTTPSource made of DownloadURLTemplates, CacheDir, Downloader, Limits,
+	// Progress and Logger.
+	Source Source
+	// BestEffort scans the months that could be pulled when others fail,
+	// instead of failing the whole query, see History.
+	BestEffort bool
+	// Logger gets a record per month and for the scan, silent when nil. The
+	// Downloader has its own.
+	Logger *slog.Logger
+}
+
+// Errors returned by History, to be checked with errors.Is. The errors of
+// the months also wrap the ones of the download and xz packages, like
+// download.ErrNotFound for a month missing from every mirror.
+var (
+	// ErrInvalidInput is a query that makes no sense, like a start date
+	// after the end date.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrCancelled is a query stopped by its context.
+	ErrCancelled = errors.New("cancelled")
+	// ErrPartial is a BestEffort query where some months failed, it comes
+	// with the Result of the others.
+	ErrPartial = errors.New("partial results")
+)
+
+// SourceCache is the Month.Source of archives found in the cache dir.
+const SourceCache = "cache"
+
+// Result is what History found, along with how each month was pulled.
+type Result struct {
+	Nodes  []exitnode.ExitNode
+	Months []Month
+}
+
+// Month tells where the exit lists of a month came from.
+type Month struct {
+	Date string
+	// Source is the URL the archive was downloaded from, or SourceCache.
+	Source string
+	Status Status
+	// Err is why the month could not be pulled, nil when Status is StatusOK.
+	Err error
+}
+
+// Status tells how pulling a Month went.
+type Status string
+
+const (
+	StatusOK Status = "ok"
+	// StatusMissing is a month no mirror has, like one not published yet.
+	StatusMissing Status = "missing"
+	// StatusCorrupt is a month whose archive cannot be extracted or parsed.
+	StatusCorrupt Status = "corrupt"
+	// StatusUnavailable is a month no mirror could serve, after the retries.
+	StatusUnavailable Status = "unavailable"
+	// StatusCancelled is a month not pulled because the query was cancelled.
+	StatusCancelled Status = "cancelled"
+	// StatusFailed is any other error, like a full disk.
+	StatusFailed Status = "failed"
+)
+
+// status tells the Status of a month pulled with err. When mirrors failed
+// in different ways the same order as the exit codes applies: an
+// unreachable mirror may well have had the month.
+func status(ctx context.Context, err error) Status {
+	switch {
+	case err == nil:
+		return StatusOK
+	case ctx.Err() != nil:
+		return StatusCancelled
+	case errors.Is(err, download.ErrUnavailable):
+		return StatusUnavailable
+	case errors.Is(err, download.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return StatusMissing
+	case errors.Is(err, xz.ErrCorrupt), errors.As(err, new(*exitnode.ParseError)):
+		return StatusCorrupt
+	}
+	return StatusFailed
+}
+
 // History is going to look for an IP in the specified time range and will
 // return all the nodes that had the IP as an an address.
-func History(ctx context.Context, DownloadURLTemplate, StartDate, EndDate, IP string) ([]exitnode.ExitNode, error) {
-	// create main temporary directory
-	dir, err := os.MkdirTemp("", "his-tor-y-")
+//
+// With opts.BestEffort a month that fails does not stop the others: the
+// Result holds the nodes of the months pulled and the Status of each month,
+// along with an ErrPartial joining the errors of the failed ones. A month
+// with a list that cannot be parsed is StatusCorrupt and none of its nodes
+// are in the Result. A cancelled query still scans the months pulled so far.
+func History(ctx context.Context, opts Options, StartDate, EndDate, IP string) (*Result, error) {
+	if _, err := netip.ParseAddr(IP); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInput, err)
+	}
+	return Search(ctx, opts, StartDate, EndDate, MatchIP(IP))
+}
+
+// Matcher tells if a node is one of those a query is after.
+type Matcher func(exitnode.ExitNode) bool
+
+// MatchIP matches the nodes having IP as an exit address. The addresses are
+// compared parsed, an IP that does not parse as written.
+func MatchIP(IP string) Matcher {
+	ip, err := netip.ParseAddr(IP)
 	if err != nil {
-		return nil, err
+		return func(n exitnode.ExitNode) bool {
+			for _, a := range n.ExitAddresses {
+				if a.ExitAddress == IP {
+					return true
+				}
+			}
+			return false
+		}
 	}
-	// reenable line below once that the code works :)
-	defer os.RemoveAll(dir)
+	return func(n exitnode.ExitNode) bool {
+		for _, a := range n.ExitAddresses {
+			if a.Addr == ip {
+				return true
+			}
+		}
+		return false
+	}
+}
 
+// Search is History for any kind of query: it returns the nodes of the
+// months from StartDate to EndDate for which match is true, see History.
+func Search(ctx context.Context, opts Options, StartDate, EndDate string, match Matcher) (*Result, error) {
+	if match == nil {
+		return nil, fmt.Errorf("%w: nothing to search", ErrInvalidInput)
+	}
 	dates, err := generateYearDashMonthInterval(StartDate, EndDate)
 	if err != nil {
 		return nil, err
 	}
+	source := opts.Source
+	if source == nil {
+		if len(opts.DownloadURLTemplates) == 0 {
+			return nil, fmt.Errorf("%w: no download URL configured", ErrInvalidInput)
+		}
+		source = &HTTPSource{
+			URLTemplates: opts.DownloadURLTemplates,
+			CacheDir:     opts.CacheDir,
+			Downloader:   opts.Downloader,
+			Limits:       opts.Limits,
+			Progress:     opts.Progress,
+			Logger:       opts.Logger,
+		}
+	}
+
+	// create main temporary directory
+	dir, err := os.MkdirTemp(opts.TempDir, "his-tor-y-")
+	if err != nil {
+		return nil, err
+	}
+	// reenable line below once that the code works :)
+	defer os.RemoveAll(dir)
 
 	var g errgroup.Group
+	if opts.Concurrency > 0 {
+		g.SetLimit(opts.Concurrency)
+	}
 
-	// fmt.Println(dates)
+	// Each goroutine writes its own elements, no need to synchronize.
+	months := make([]Month, len(dates))
+	lists := make([]*Lists, len(dates))
 	// open files for download
-	for _, d := range dates {
-		d := d // new var per iteration
+	for i, d := range dates {
+		i, d := i, d // new var per iteration
 		g.Go(func() error {
-			return pull(ctx, DownloadURLTemplate, d, dir)
+			l, err := month(ctx, source, d, filepath.Join(dir, d))
+			months[i] = Month{Date: d, Status: status(ctx, err), Err: err}
+			if err == nil {
+				lists[i] = l
+				months[i].Source = l.Source
+			}
+			if opts.BestEffort {
+				if err != nil {
+					logging.Or(opts.Logger).Warn("month failed, skipping it", "month", d, "status", months[i].Status, "error", err)
+				}
+				return nil
+			}
+			return err
 		})
 	}
 
 	if err := g.Wait(); err != nil {
-		return nil, err
+		return nil, cancelled(ctx, err)
 	}
 
-	nodeFiles, err := files.NewReader(dir)
-	if err != nil {
-		return nil, err
-
+	// The months are in order, so are their lists. of tells the month of
+	// each document.
+	var docs []Document
+	var of []int
+	for i, l := range lists {
+		if l != nil {
+			docs = append(docs, l.Documents...)
+			for range l.Documents {
+				of = append(of, i)
+			}
+		}
 	}
 
-	defer nodeFiles.Close()
-
 	// find is going to look for an IP in all the readers and will
 	// return all the nodes that had the IP as an an address.
-	nodes, err := find(IP, nodeFiles.Readers)
+	logger := logging.Or(opts.Logger)
+	start := time.Now()
+	scanCtx := ctx
+	if opts.BestEffort {
+		// The scan of what is on disk is quick, better some nodes than none.
+		scanCtx = context.WithoutCancel(ctx)
+	}
+	found, failed, err := scan(scanCtx, match, docs, opts.BestEffort, progress.Or(opts.Progress), logger)
 	if err != nil {
-		return nil, err
+		return nil, cancelled(ctx, err)
+	}
+	// A list that cannot be read fails its month: the nodes of the month are
+	// dropped, they may well miss the ones of the list.
+	for j, err := range failed {
+		if err == nil {
+			continue
+		}
+		m := &months[of[j]]
+		if m.Err == nil {
+			m.Err = fmt.Errorf("month %s: %w", m.Date, err)
+			m.Status = status(ctx, err)
+			logger.Warn("month failed, skipping it", "month", m.Date, "status", m.Status, "error", m.Err)
+		}
 	}
+	for j := range found {
+		if months[of[j]].Err != nil {
+			found[j] = nil
+		}
+	}
+	nodes := flatten(found)
+	logger.Info("scanned", "files", len(docs), "nodes", len(nodes), "duration", time.Since(start))
 
 	// Final print do not comment.
-	return nodes, nil
+	result := &Result{Nodes: nodes, Months: months}
+	var errs []error
+	for _, m := range months {
+		if m.Err != nil {
+			errs = append(errs, m.Err)
+		}
+	}
+	if len(errs) > 0 {
+		err := fmt.Errorf("%w: %d of %d months failed: %w", ErrPartial, len(errs), len(months), errors.Join(errs...))
+		return result, cancelled(ctx, err)
+	}
+	return result, nil
 }
 
-func pull(ctx context.Context, DownloadURLTemplate string, date string, dir string) error {
-	u := fmt.Sprintf(DownloadURLTemplate, date)
-
-	// fmt.Println(u)
-
-	f, err := download.DownloadFile(ctx, dir, u)
-	if err != nil {
-		return err
-
+// month asks source for the lists of date, with dir to work in.
+func month(ctx context.Context, source Source, date, dir string) (*Lists, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("month %s: %w", date, err)
 	}
-	// fmt.Println(f)
-	err = xz.Extract(ctx, f)
-	// fmt.Printf("done: %s\n", f)
-	if err != nil {
-		return err
+	return source.Month(ctx, date, dir)
+}
+
+// cancelled marks err as ErrCancelled when ctx is done: whatever went wrong,
+// it is because of the cancellation.
+func cancelled(ctx context.Context, err error) error {
+	if ctx.Err() != nil && !errors.Is(err, ErrCancelled) {
+		return fmt.Errorf("%w: %w", ErrCancelled, err)
 	}
-	return nil
+	return err
 }
 
 // find read all the files, unmarshals them into a list of entries,
 // iterate through the entries putting them in a map using the node as a key.
 // This generates a map with the most updated entry for each node leveraging 2 side effects:
-// files and entries inside files are ordered from older to newer (thanks to buildFileList() )
-func find(IP string, readers []*bufio.Reader) ([]exitnode.ExitNode, error) {
-	updated := []exitnode.ExitNode{}
+// documents and entries inside documents are ordered from older to newer (thanks to the Source)
+// Only the entries for which match is true are kept.
+// Each file scanned is reported to r, odd files are logged. The scan stops
+// when ctx is done.
+func find(ctx context.Context, match Matcher, docs []Document, r progress.Reporter, logger *slog.Logger) ([]exitnode.ExitNode, error) {
+	found, _, err := scan(ctx, match, docs, false, r, logger)
+	if err != nil {
+		return nil, err
+	}
+	return flatten(found), nil
+}
+
+// scan is find without the flattening: found holds the matches of each
+// document. With bestEffort a document that cannot be read does not stop the
+// scan, its error goes in failed at its index instead.
+func scan(ctx context.Context, match Matcher, docs []Document, bestEffort bool, r progress.Reporter, logger *slog.Logger) (found [][]exitnode.ExitNode, failed []error, err error) {
 	// preallocate a slice for the results with make and assign each goroutine an index into that slice.
 	// You shouldn’t need to synchronize writes since each element is essentially its own variable
-	found := make([][]exitnode.ExitNode, len(readers))
+	found = make([][]exitnode.ExitNode, len(docs))
+	failed = make([]error, len(docs))
 	// you will need to make sure they are all done before you attempt to iterate the slice
-	var g errgroup.Group
+	// The first error stops the other goroutines too.
+	g, ctx := errgroup.WithContext(ctx)
+	// Parsing is all CPU, and each goroutine keeps a file open.
+	g.SetLimit(runtime.GOMAXPROCS(0))
 
 	// define how you want to coordinate the goroutines,
 	// define how many you spin up at once,
@@ -106,59 +351,93 @@ func find(IP string, readers []*bufio.Reader) ([]exitnode.ExitNode, error) {
 
 	// If you want to bail early, you’re probably fine with just logging and exiting, unless you are doing more than reading, in which case a signal channel for cleanup or a context is probably called for.
 
-	for i, reader := range readers {
+	// A parser per goroutine, sharing the fingerprints and addresses of the
+	// lists it parsed along the search.
+	parsers := sync.Pool{New: func() any { return new(exitnode.Parser) }}
+
+	var scanned atomic.Int64
+	total := int64(len(docs))
+	r.Report(progress.Event{Stage: progress.Scan, Total: total, Done: total == 0})
+
+	for i, doc := range docs {
 		i := i
-		reader := reader
+		doc := doc
 		g.Go(func() error {
-			exitNodes, err := exitnode.Unmarshal(reader)
+			p := parsers.Get().(*exitnode.Parser)
+			exitNodes, err := unmarshal(ctx, p, doc)
+			parsers.Put(p)
+			if err != nil && ctx.Err() != nil {
+				return fmt.Errorf("scan cancelled: %w", ctx.Err())
+			}
 			if err != nil {
-				return fmt.Errorf("unmarshall error for file reader: %w", err)
+				err = fmt.Errorf("unmarshall error for file reader %s: %w", doc.Name, err)
+				if !bestEffort {
+					return err
+				}
+				failed[i] = err
+			}
+			if err == nil && len(exitNodes) == 0 {
+				logger.Warn("exit list without exit nodes", "file", doc.Name)
 			}
 			for _, n := range exitNodes {
-				for _, a := range n.ExitAddresses {
-					if a.ExitAddress == IP {
-						found[i] = append(found[i], n)
-						break
-					}
+				if match(n) {
+					// The addresses of all the nodes of the list share an
+					// array, keep only the ones of the match.
+					n.ExitAddresses = slices.Clone(n.ExitAddresses)
+					found[i] = append(found[i], n)
 				}
 			}
+			n := scanned.Add(1)
+			r.Report(progress.Event{Stage: progress.Scan, N: n, Total: total, Done: n == total})
 			return nil
 		})
 	}
 
 	if err := g.Wait(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return found, failed, nil
+}
 
-	// flatten the list
+// flatten puts the matches of all the documents in a single list.
+func flatten(found [][]exitnode.ExitNode) []exitnode.ExitNode {
+	updated := []exitnode.ExitNode{}
 	for _, nodes := range found {
 		updated = append(updated, nodes...)
 	}
 
 	// Reverse the list, we want the most recent to be printed first.
 	slices.Reverse(updated)
-	return updated, nil
+	return updated
 }
 
-func generateYearDashMonthInterval(start, end string) ([]string, error) {
+// unmarshal reads the exit nodes of doc with p, until ctx is done.
+func unmarshal(ctx context.Context, p *exitnode.Parser, doc Document) ([]exitnode.ExitNode, error) {
+	rc, err := doc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return p.Parse(ctxio.Reader(ctx, rc))
+}
 
-	// Define the date format.
-	const yearDashMonth = "2006-01"
+// Define the date format.
+const yearDashMonth = "2006-01"
+
+func generateYearDashMonthInterval(start, end string) ([]string, error) {
 
 	startDate, err := time.Parse(yearDashMonth, start)
 	if err != nil {
-		return nil, fmt.Errorf("start date parse error: %w", err)
+		return nil, fmt.Errorf("%w: start date parse error: %w", ErrInvalidInput, err)
 	}
 
 	endDate, err := time.Parse(yearDashMonth, end)
 	if err != nil {
-		return nil, fmt.Errorf("end date parse error: %w", err)
+		return nil, fmt.Errorf("%w: end date parse error: %w", ErrInvalidInput, err)
 	}
 
 	if startDate.After(endDate) {
-		// This should be implemented using
-		// constant errors: https://dave.cheney.net/2016/04/07/constant-errors.
-		return nil, errors.New("start date is after end date")
+		return nil, fmt.Errorf("%w: start date is after end date", ErrInvalidInput)
 	}
 
 	var dates []string
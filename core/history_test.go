@@ -1,49 +1,315 @@
 package core
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/logging"
+	"github.com/robizz/his-tor-y/progress"
+	"github.com/robizz/his-tor-y/xz"
 )
 
+// documents returns an in memory Document per exit list.
+func documents(lists ...string) []Document {
+	docs := make([]Document, len(lists))
+	for i, l := range lists {
+		l := l
+		docs[i] = Document{Name: strconv.Itoa(i), Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(l)), nil
+		}}
+	}
+	return docs
+}
+
+// happy is the exit list of the tests, with 194.26.192.64 in it.
+var happy = func() []collectortest.List {
+	at := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	return []collectortest.List{{Downloaded: at, Nodes: []exitnode.ExitNode{
+		collectortest.Node("FE39F07EBE7870DCE124AB30DF3ABD0700A43F75", "185.241.208.232", at),
+		collectortest.Node("23B49521BDC4588C7CCF3C38E552504118326B66", "194.26.192.64", at),
+		collectortest.Node("64D74AAA74F30DC2CFB36343CE5D4451B9A4DBA8", "171.25.193.25", at),
+	}}}
+}()
+
+// newServer returns a fake CollecTor serving happy for each of months.
+func newServer(t *testing.T, months ...string) *collectortest.Server {
+	t.Helper()
+	s := collectortest.NewServer()
+	t.Cleanup(s.Close)
+	for _, m := range months {
+		if err := s.Set(m, collectortest.Month{Lists: happy}); err != nil {
+			t.Fatalf("error setup server: %v", err)
+		}
+	}
+	return s
+}
+
 // TestMainReturnWithCode is the integration test for the happy path.
 func TestMainReturnWithCode(t *testing.T) {
+	s := newServer(t, "2024-01")
 
-	var happyxz = "/Td6WFoAAATm1rRGBMCcA4AcIQEWAAAAAAAAAJTfEwfgDf8BlF0AMp4JVwAUv4o0Se2uOQoAeCa9bRsjuAxO7ensztcweQ4vqTehTm70VrFwC56JobMMJA9pN0hxEJrISH3UM2Gco3oCpSgxdhJqF4pvwovzXIU3pVsHrxclP+Mwf+18s6Jqit760tO+pq174ynpfWaFG5jpwmeBn2l0owK0B27vhSBWjUzOEq/pJwAtPnTiOXeY0Fh0rpnuo8PRgVnIfktlbeS9jaXfy/QS81SgRNZu8CGQZeW4CQRT3N8Iam+AdW1Ri7XgnHymeRVkH822u1QxDCLWdcnRJVn/oKmQRmo5MVhNUkuNPAwmGO+wdQQ/zL++cQEISzcRzs3gwD4RT8psHR7iOsewrw++o/tBU3IhgB5ZxmSukVJgv3FvaHgSVbBzGd6+91DdB+ZgsQpokMUKOV6rr+1AmhBEKPOXee28CteivwAJ+9xPMWuHYpzAOtNrkBBg6Gjx48Ceqtd+dyT7q5fPgxgvWg3PbF7TI75xSacmsDcccNPSaaL7QskmNQU0Gv+30g7rCdvmkExu4CTZVGbqsgAAeiBdKNN5JMYAAbgDgBwAADrTCYqxxGf7AgAAAAAEWVo="
-	dec, err := base64.StdEncoding.DecodeString(happyxz)
+	_, err := History(context.Background(), Options{DownloadURLTemplates: []string{s.URLTemplate()}}, "2024-01", "2024-01", "194.26.192.64")
 	if err != nil {
-		t.Errorf("error setup server:  %v", err)
+		t.Errorf("Unxpected error: %v", err)
+	}
+}
+
+// TestHistoryProgress checks that every step reports where it is at.
+func TestHistoryProgress(t *testing.T) {
+	s := newServer(t, "2024-01", "2024-02")
+
+	var mu sync.Mutex
+	last := map[progress.Stage]map[string]progress.Event{}
+	reporter := progress.ReporterFunc(func(e progress.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if last[e.Stage] == nil {
+			last[e.Stage] = map[string]progress.Event{}
+		}
+		last[e.Stage][e.Name] = e
+	})
+	d := download.New(nil)
+	d.Progress = reporter
+	opts := Options{
+		DownloadURLTemplates: []string{s.URLTemplate()},
+		Downloader:           d,
+		Progress:             reporter,
+	}
+	if _, err := History(context.Background(), opts, "2024-01", "2024-02", "194.26.192.64"); err != nil {
+		t.Fatalf("Unxpected error: %v", err)
+	}
+
+	if len(last[progress.Download]) != 2 || len(last[progress.Extract]) != 2 {
+		t.Fatalf("expected 2 downloads and extractions, got %v", last)
 	}
+	for _, e := range last[progress.Download] {
+		if !e.Done || e.N == 0 || e.N != e.Total {
+			t.Errorf("expected the whole archive downloaded, got %+v", e)
+		}
+	}
+	var files int64
+	for _, e := range last[progress.Extract] {
+		if !e.Done || e.N == 0 {
+			t.Errorf("expected files extracted, got %+v", e)
+		}
+		files += e.N
+	}
+	scan := last[progress.Scan][""]
+	if !scan.Done || scan.Total != files || scan.N != files {
+		t.Errorf("expected %d files scanned, got %+v", files, scan)
+	}
+}
+
+// TestHistoryCancelledMidTransfer checks that a cancelled query stops in the
+// middle of a download, leaving the cache with complete archives only.
+func TestHistoryCancelledMidTransfer(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	lists := []collectortest.List{{Downloaded: at, Nodes: []exitnode.ExitNode{collectortest.Node("AAAA", "194.26.192.64", at)}}}
+	s := collectortest.NewServer()
+	defer s.Close()
+	s.Set("2024-01", collectortest.Month{Lists: lists})
+	s.Set("2024-02", collectortest.Month{Lists: lists, Stall: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := download.New(nil)
+	d.Progress = progress.ReporterFunc(func(e progress.Event) {
+		if strings.Contains(e.Name, "2024-02") && e.N > 0 {
+			cancel()
+		}
+	})
+	opts := Options{
+		DownloadURLTemplates: []string{s.URLTemplate()},
+		CacheDir:             t.TempDir(),
+		Concurrency:          1,
+		Downloader:           d,
+	}
+	start := time.Now()
+	_, err := History(ctx, opts, "2024-01", "2024-02", "194.26.192.64")
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("expected cancellation to stop the download")
+	}
+	var names []string
+	entries, _ := os.ReadDir(opts.CacheDir)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// The complete archive and its validators only.
+	if strings.Join(names, ",") != "exit-list-2024-01.tar.xz,exit-list-2024-01.tar.xz.meta" {
+		t.Errorf("expected the complete archive only in the cache, got %v", names)
+	}
+}
 
+// TestHistoryConcurrency checks that no more than Concurrency months are
+// downloaded at once.
+func TestHistoryConcurrency(t *testing.T) {
+	h := collectortest.NewHandler()
+	for m := 1; m <= 8; m++ {
+		h.Set(fmt.Sprintf("2023-%02d", m), collectortest.Month{Lists: happy})
+	}
+
+	var inFlight, maxInFlight atomic.Int32
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write(dec)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// Long enough for the other months to pile up.
+		time.Sleep(20 * time.Millisecond)
+		h.ServeHTTP(w, r)
 	}))
 	defer ts.Close()
 
-	fakeURLTemplate := ts.URL + "/%s"
+	opts := Options{
+		DownloadURLTemplates: []string{ts.URL + collectortest.ArchivePath},
+		Concurrency:          2,
+	}
+	result, err := History(context.Background(), opts, "2023-01", "2023-08", "194.26.192.64")
+	if err != nil {
+		t.Fatalf("Unxpected error: %v", err)
+	}
+	if len(result.Months) != 8 {
+		t.Errorf("expected 8 months, got %d", len(result.Months))
+	}
+	if maxInFlight.Load() > 2 {
+		t.Errorf("expected at most 2 downloads at once, got %d", maxInFlight.Load())
+	}
+}
+
+// TestHistoryMirrors checks that each month falls back to the next mirror
+// when one is down, misses the month or serves a corrupt archive, and that
+// the mirror serving each month is reported.
+func TestHistoryMirrors(t *testing.T) {
+	// The primary mirror is missing 2024-01 and serves garbage for 2024-02.
+	primary := newServer(t, "2024-03")
+	primary.Set("2024-02", collectortest.Month{Lists: happy, Corrupt: true})
+
+	// This one is down.
+	down := collectortest.NewServer()
+	down.Close()
+
+	backup := newServer(t, "2024-01", "2024-02", "2024-03")
 
-	_, err = History(context.Background(), fakeURLTemplate, "2024-01", "2024-01", "194.26.192.64")
+	opts := Options{DownloadURLTemplates: []string{
+		primary.URLTemplate(),
+		down.URLTemplate(),
+		backup.URLTemplate(),
+	}}
+
+	for _, cacheDir := range []string{"", t.TempDir()} {
+		opts.CacheDir = cacheDir
+		result, err := History(context.Background(), opts, "2024-01", "2024-03", "194.26.192.64")
+		if err != nil {
+			t.Fatalf("Unxpected error: %v", err)
+		}
+
+		expected := []Month{
+			{Date: "2024-01", Source: fmt.Sprintf(backup.URLTemplate(), "2024-01"), Status: StatusOK},
+			{Date: "2024-02", Source: fmt.Sprintf(backup.URLTemplate(), "2024-02"), Status: StatusOK},
+			{Date: "2024-03", Source: fmt.Sprintf(primary.URLTemplate(), "2024-03"), Status: StatusOK},
+		}
+		if !reflect.DeepEqual(result.Months, expected) {
+			t.Errorf("expected %v, got %v", expected, result.Months)
+		}
+		// The same node is found once per month.
+		if len(result.Nodes) != 3 {
+			t.Errorf("expected 3 nodes, got %d", len(result.Nodes))
+		}
+	}
+}
+
+// TestHistoryMirrorsChecksum checks that an archive not matching the digest
+// of its mirror is thrown away for the one of the next mirror.
+func TestHistoryMirrorsChecksum(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	lists := []collectortest.List{{Downloaded: at, Nodes: []exitnode.ExitNode{collectortest.Node("AAAA", "194.26.192.64", at)}}}
+	primary := collectortest.NewServer()
+	defer primary.Close()
+	primary.Set("2024-01", collectortest.Month{Lists: lists, Corrupt: true, Digest: true})
+	backup := collectortest.NewServer()
+	defer backup.Close()
+	backup.Set("2024-01", collectortest.Month{Lists: lists, Digest: true})
+
+	opts := Options{
+		DownloadURLTemplates: []string{primary.URLTemplate(), backup.URLTemplate()},
+		CacheDir:             t.TempDir(),
+		Downloader:           &download.Downloader{Retries: 2, Backoff: time.Millisecond},
+	}
+	result, err := History(context.Background(), opts, "2024-01", "2024-01", "194.26.192.64")
 	if err != nil {
-		t.Errorf("Unxpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source := fmt.Sprintf(backup.URLTemplate(), "2024-01"); result.Months[0].Source != source {
+		t.Errorf("expected %s, got %s", source, result.Months[0].Source)
+	}
+	if len(result.Nodes) != 1 {
+		t.Errorf("expected 1 node, got %v", result.Nodes)
+	}
+	// A mismatch is not retried, the same mirror would send the same bytes.
+	if n := primary.Requests("2024-01"); n != 1 {
+		t.Errorf("expected a single request to the primary mirror, got %d", n)
+	}
+
+	// With no other mirror the month is corrupt.
+	opts = Options{DownloadURLTemplates: []string{primary.URLTemplate()}, BestEffort: true}
+	result, err = History(context.Background(), opts, "2024-01", "2024-01", "194.26.192.64")
+	if !errors.Is(err, ErrPartial) || !errors.Is(err, download.ErrChecksum) || !errors.Is(err, xz.ErrCorrupt) {
+		t.Errorf("expected checksum mismatch, got: %v", err)
+	}
+	if result == nil || result.Months[0].Status != StatusCorrupt {
+		t.Errorf("expected corrupt month, got %v", result)
 	}
 }
 
-// TestMainReturnWithCodeErrorOnDownload is the integration test for download error.
-func TestMainReturnWithCodeErrorOnDownload(t *testing.T) {
+// TestHistoryMirrorsAllFailing checks the error lists every mirror.
+func TestHistoryMirrorsAllFailing(t *testing.T) {
+	a, b := newServer(t), newServer(t)
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusInternalServerError)
-	}))
-	defer ts.Close()
+	opts := Options{DownloadURLTemplates: []string{a.URLTemplate(), b.URLTemplate()}}
+	_, err := History(context.Background(), opts, "2024-01", "2024-01", "194.26.192.64")
+	if err == nil {
+		t.Fatalf("Expected error, but got nil")
+	}
+	for _, expected := range []string{"month 2024-01", fmt.Sprintf(a.URLTemplate(), "2024-01"), fmt.Sprintf(b.URLTemplate(), "2024-01"), "404"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got: %v", expected, err)
+		}
+	}
 
-	fakeURLTemplate := ts.URL + "/%s"
+	_, err = History(context.Background(), Options{}, "2024-01", "2024-01", "194.26.192.64")
+	if err == nil || !strings.Contains(err.Error(), "no download URL") {
+		t.Errorf("Expected no download URL error, got: %v", err)
+	}
+}
 
-	_, err := History(context.Background(), fakeURLTemplate, "2024-01", "2024-01", "194.26.192.64")
+// TestMainReturnWithCodeErrorOnDownload is the integration test for download error.
+func TestMainReturnWithCodeErrorOnDownload(t *testing.T) {
+	s := newServer(t)
+	s.Set("2024-01", collectortest.Month{Status: http.StatusInternalServerError})
+
+	_, err := History(context.Background(), Options{DownloadURLTemplates: []string{s.URLTemplate()}}, "2024-01", "2024-01", "194.26.192.64")
 	if err == nil {
 		t.Error("Expected error, but got nil")
 	}
@@ -51,31 +317,48 @@ func TestMainReturnWithCodeErrorOnDownload(t *testing.T) {
 
 // TestMainReturnWithCodeErrorMalformedXZ is the integration test for extraction error.
 func TestMainReturnWithCodeErrorMalformedXZ(t *testing.T) {
+	s := newServer(t)
+	s.Set("2024-01", collectortest.Month{Lists: happy, Corrupt: true})
 
-	var xz = "dGVzdAo="
-	dec, err := base64.StdEncoding.DecodeString(xz)
-	if err != nil {
-		t.Errorf("error setup server:  %v", err)
+	_, err := History(context.Background(), Options{DownloadURLTemplates: []string{s.URLTemplate()}}, "2024-01", "2024-01", "194.26.192.64")
+	if !errors.Is(err, xz.ErrCorrupt) {
+		t.Errorf("Expected corrupt archive error, got: %v", err)
 	}
+}
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Write(dec)
-	}))
-	defer ts.Close()
-
-	fakeURLTemplate := ts.URL + "/%s"
-
-	_, err = History(context.Background(), fakeURLTemplate, "2024-01", "2024-01", "194.26.192.64")
-	if err == nil {
-		t.Errorf("Expected error, but got nil")
+// TestMatchIP checks that matching the parsed addresses finds what comparing
+// the strings did.
+func TestMatchIP(t *testing.T) {
+	list := "ExitNode AAAA\n" +
+		"ExitAddress 185.241.208.232 2024-01-30 10:21:54\n" +
+		"ExitAddress 01.2.3.4 2024-01-30 10:21:54\n"
+	var p exitnode.Parser
+	nodes, err := p.Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"185.241.208.232", true},
+		{"185.241.208.23", false},
+		{"::ffff:185.241.208.232", false},
+		// Not an IP, compared as written.
+		{"01.2.3.4", true},
+		{"1.2.3.4", false},
+	}
+	for _, tt := range tests {
+		if got := MatchIP(tt.ip)(nodes[0]); got != tt.expected {
+			t.Errorf("expected %v for %s, got %v", tt.expected, tt.ip, got)
+		}
 	}
 }
 
 // TestFind tests that are going to return all the nodes that had
 // the IP as an ExitAddress
 func TestFind(t *testing.T) {
-	var readers []*bufio.Reader
-	// create 2 readers for 2 files and test the update.
+	// create 2 documents for 2 files and test the update.
 	var first = `
 @type tordnsel 1.0
 Downloaded 2024-01-30 13:02:00
@@ -94,13 +377,20 @@ LastStatus 2024-01-31 10:00:00
 ExitAddress 185.241.208.231 2024-01-31 10:21:54
 ExitAddress 185.241.208.232 2024-01-31 10:21:55`
 
-	r1 := strings.NewReader(first)
-	r2 := strings.NewReader(second)
-	readers = append(readers, bufio.NewReader(r1), bufio.NewReader(r2))
-	nodes, err := find("185.241.208.232", readers)
+	docs := documents(first, second)
+	var scanned []progress.Event
+	var mu sync.Mutex
+	nodes, err := find(context.Background(), MatchIP("185.241.208.232"), docs, progress.ReporterFunc(func(e progress.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		scanned = append(scanned, e)
+	}), logging.Discard)
 	if err != nil {
 		t.Errorf("unexpected mapToMostRecentEntries error")
 	}
+	if len(scanned) != 3 || scanned[0].N != 0 || !scanned[2].Done || scanned[2].N != 2 || scanned[2].Total != 2 {
+		t.Errorf("unexpected scan events %+v", scanned)
+	}
 
 	if nodes[0].ExitNode != "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB" {
 		t.Errorf("expected BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB, got: %s", nodes[0].ExitNode)
@@ -118,7 +408,6 @@ ExitAddress 185.241.208.232 2024-01-31 10:21:55`
 }
 
 func TestMapToMostRecentEntriesErrorOnUnmarshall(t *testing.T) {
-	var readers []*bufio.Reader
 	// create 2 reders for 2 files and test the update.
 	var first = `
 @type tordnsel 1.0
@@ -138,15 +427,31 @@ LastStatus 2024-01-31 10:00:00
 ExitAddress 185.241.208.231 2024-01-31 10:21:54
 ExitAddress 185.241.208.232 2024-01-31 10:21:55`
 
-	r1 := strings.NewReader(first)
-	r2 := strings.NewReader(second)
-	readers = append(readers, bufio.NewReader(r1), bufio.NewReader(r2))
-	_, err := find("194.26.192.64", readers)
+	docs := documents(first, second)
+	_, err := find(context.Background(), MatchIP("194.26.192.64"), docs, progress.Discard, logging.Discard)
 	if err == nil || !strings.Contains(err.Error(), "unmarshall error for file reader") {
 		t.Errorf("error expected")
 	}
 }
 
+func TestFindCancelled(t *testing.T) {
+	list := `
+@type tordnsel 1.0
+Downloaded 2024-01-30 13:02:00
+ExitNode FE39F07EBE7870DCE124AB30DF3ABD0700A43F75
+Published 2024-01-30 00:10:50
+LastStatus 2024-01-30 10:00:00
+ExitAddress 194.26.192.64 2024-01-30 10:21:54`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	docs := documents(list)
+	_, err := find(ctx, MatchIP("194.26.192.64"), docs, progress.Discard, logging.Discard)
+	if !errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "unmarshall error") {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+}
+
 func TestGenerateExitListsURLs(t *testing.T) {
 	tests := []struct {
 		start, end string
@@ -185,12 +490,135 @@ func TestGenerateExitListsURLs(t *testing.T) {
 	for _, tt := range errTests {
 		t.Run(tt.start+" to "+tt.end, func(t *testing.T) {
 			nilResult, err := generateYearDashMonthInterval(tt.start, tt.end)
-			// Here the strings.Contains() check is a very weak check, this should be implemented using
-			// constant errors: https://dave.cheney.net/2016/04/07/constant-errors.
-			if nilResult != nil || !strings.Contains(err.Error(), tt.expectedErrorMessage) {
+			if nilResult != nil || !errors.Is(err, ErrInvalidInput) || !strings.Contains(err.Error(), tt.expectedErrorMessage) {
 				t.Errorf("generateExitListsURLs(%s, %s) = %v; error expected %v", tt.start, tt.end, err.Error(), tt.expectedErrorMessage)
 			}
 		})
 	}
 
 }
+
+func TestHistoryErrors(t *testing.T) {
+	notFound := newServer(t)
+	garbage := newServer(t)
+	garbage.Set("2024-01", collectortest.Month{Lists: happy, Corrupt: true})
+	garbage.Set("2024-02", collectortest.Month{Lists: happy, Corrupt: true})
+	down := collectortest.NewServer()
+	down.Close()
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		templates []string
+		start, ip string
+		expected  error
+	}{
+		{"bad ip", context.Background(), []string{notFound.URLTemplate()}, "2024-01", "not-an-ip", ErrInvalidInput},
+		{"bad range", context.Background(), []string{notFound.URLTemplate()}, "2024-03", "194.26.192.64", ErrInvalidInput},
+		{"no url", context.Background(), nil, "2024-01", "194.26.192.64", ErrInvalidInput},
+		{"missing month", context.Background(), []string{notFound.URLTemplate()}, "2024-01", "194.26.192.64", download.ErrNotFound},
+		{"corrupt archive", context.Background(), []string{garbage.URLTemplate()}, "2024-01", "194.26.192.64", xz.ErrCorrupt},
+		{"source down", context.Background(), []string{down.URLTemplate()}, "2024-01", "194.26.192.64", download.ErrUnavailable},
+		{"cancelled", cancelledCtx, []string{notFound.URLTemplate()}, "2024-01", "194.26.192.64", ErrCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := History(tt.ctx, Options{DownloadURLTemplates: tt.templates}, tt.start, "2024-02", tt.ip)
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("expected %v, got: %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestHistoryBestEffort(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	lists := []collectortest.List{{Downloaded: at, Nodes: []exitnode.ExitNode{collectortest.Node("AAAA", "194.26.192.64", at)}}}
+	s := collectortest.NewServer()
+	defer s.Close()
+	s.Set("2024-01", collectortest.Month{Lists: lists})
+	// 2024-02 is missing.
+	s.Set("2024-03", collectortest.Month{Lists: lists, Corrupt: true})
+	s.Set("2024-04", collectortest.Month{Lists: lists, Status: http.StatusServiceUnavailable})
+
+	opts := Options{DownloadURLTemplates: []string{s.URLTemplate()}}
+	// Without best effort a failing month fails the query.
+	result, err := History(context.Background(), opts, "2024-01", "2024-04", "194.26.192.64")
+	if result != nil || err == nil || errors.Is(err, ErrPartial) {
+		t.Fatalf("expected the query to fail, got %v, %v", result, err)
+	}
+
+	opts.BestEffort = true
+	result, err = History(context.Background(), opts, "2024-01", "2024-04", "194.26.192.64")
+	if !errors.Is(err, ErrPartial) || !errors.Is(err, download.ErrNotFound) || !errors.Is(err, xz.ErrCorrupt) || !errors.Is(err, download.ErrUnavailable) {
+		t.Errorf("expected partial results error, got: %v", err)
+	}
+	if result == nil || len(result.Nodes) != 1 {
+		t.Fatalf("expected the node of 2024-01, got %v", result)
+	}
+	expected := []Status{StatusOK, StatusMissing, StatusCorrupt, StatusUnavailable}
+	for i, m := range result.Months {
+		if m.Status != expected[i] || (m.Status == StatusOK) != (m.Err == nil) {
+			t.Errorf("expected %s for %s, got %s (%v)", expected[i], m.Date, m.Status, m.Err)
+		}
+	}
+	if result.Months[0].Source != fmt.Sprintf(s.URLTemplate(), "2024-01") {
+		t.Errorf("unexpected source %s", result.Months[0].Source)
+	}
+
+	// All good, no error.
+	result, err = History(context.Background(), opts, "2024-01", "2024-01", "194.26.192.64")
+	if err != nil || result.Months[0].Status != StatusOK {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestHistoryBestEffortCancelled(t *testing.T) {
+	s := newServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := Options{DownloadURLTemplates: []string{s.URLTemplate()}, BestEffort: true}
+	result, err := History(ctx, opts, "2024-01", "2024-02", "194.26.192.64")
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, ErrPartial) {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+	if result == nil {
+		t.Fatalf("expected a result")
+	}
+	for _, m := range result.Months {
+		if m.Status != StatusCancelled {
+			t.Errorf("expected %s cancelled, got %s", m.Date, m.Status)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	notFound := &download.StatusError{StatusCode: http.StatusNotFound}
+	unavailable := &download.StatusError{StatusCode: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		ctx      context.Context
+		err      error
+		expected Status
+	}{
+		{context.Background(), nil, StatusOK},
+		{context.Background(), notFound, StatusMissing},
+		{context.Background(), unavailable, StatusUnavailable},
+		// A mirror down may have had the month.
+		{context.Background(), errors.Join(notFound, unavailable), StatusUnavailable},
+		{context.Background(), xz.ErrCorrupt, StatusCorrupt},
+		{context.Background(), os.ErrPermission, StatusFailed},
+		{cancelledCtx, notFound, StatusCancelled},
+	}
+	for _, tt := range tests {
+		if got := status(tt.ctx, tt.err); got != tt.expected {
+			t.Errorf("status(%v) = %s, expected %s", tt.err, got, tt.expected)
+		}
+	}
+}
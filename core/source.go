@@ -0,0 +1,213 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/logging"
+	"github.com/robizz/his-tor-y/progress"
+	"github.com/robizz/his-tor-y/xz"
+)
+
+// Source provides the exit lists a query scans, a month at a time: History
+// asks for the months of the range, at the same time up to
+// Options.Concurrency, and scans the lists of all the months in
+// chronological order. A Source must be safe for concurrent use.
+type Source interface {
+	// Month returns the exit lists of date, a year-month like 2024-01. dir
+	// is an empty directory for the Source to work in, private to the
+	// month and removed at the end of the query. The error of a month that
+	// is not there should wrap download.ErrNotFound or fs.ErrNotExist, the
+	// one of a month that cannot be read xz.ErrCorrupt.
+	Month(ctx context.Context, date, dir string) (*Lists, error)
+}
+
+// Lists are the exit lists of a month.
+type Lists struct {
+	// Source tells where they came from, like the URL of an archive or
+	// SourceCache. It ends up in Month.Source.
+	Source string
+	// Documents are the exit lists, the oldest first.
+	Documents []Document
+}
+
+// Document is an exit list.
+type Document struct {
+	// Name tells the document apart in the logs, like its path.
+	Name string
+	// Open returns the content of the exit list, closed once scanned. It
+	// is called during the scan, not before, so that a month with many
+	// lists does not keep them all open.
+	Open func() (io.ReadCloser, error)
+}
+
+// FileDocument returns the Document of the exit list at path.
+func FileDocument(path string) Document {
+	return Document{Name: path, Open: func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}}
+}
+
+// DirDocuments returns the files in dir and below as Documents, in lexical
+// order: the exit lists of CollecTor are named after the time they were
+// published, so that is chronological order.
+func DirDocuments(dir string) ([]Document, error) {
+	var docs []Document
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			docs = append(docs, FileDocument(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// DirSource reads exit lists already on disk: Dir holds a folder per month
+// the way the archives of CollecTor extract, like exit-list-2024-01.
+type DirSource struct {
+	Dir string
+}
+
+// Month returns the exit lists in the folder of date, a month without a
+// folder is an fs.ErrNotExist.
+func (s *DirSource) Month(ctx context.Context, date, dir string) (*Lists, error) {
+	month := filepath.Join(s.Dir, "exit-list-"+date)
+	if _, err := os.Stat(month); err != nil {
+		return nil, fmt.Errorf("month %s: %w", date, err)
+	}
+	docs, err := DirDocuments(month)
+	if err != nil {
+		return nil, fmt.Errorf("month %s: %w", date, err)
+	}
+	return &Lists{Source: month, Documents: docs}, nil
+}
+
+// HTTPSource downloads the monthly tar.xz archives published by CollecTor,
+// or by a mirror, and extracts them. It is the Source of History unless
+// told otherwise.
+type HTTPSource struct {
+	// URLTemplates are the URLs of the monthly archives, with a %s in place
+	// of the year-month. They are mirrors tried in order for each month
+	// until one serves a good archive.
+	URLTemplates []string
+	// CacheDir keeps the downloaded archives between queries. When empty
+	// the archives are thrown away once extracted.
+	CacheDir string
+	// Downloader fetches the archives, a single attempt with the default
+	// HTTP client when nil. It reports its own progress.
+	Downloader *download.Downloader
+	// Limits caps what each archive can extract.
+	Limits xz.Limits
+	// Progress receives the files extracted.
+	Progress progress.Reporter
+	// Logger gets a record per month, silent when nil.
+	Logger *slog.Logger
+}
+
+// Month downloads the archive of date, or takes it from the cache, and
+// extracts it in dir.
+func (s *HTTPSource) Month(ctx context.Context, date, dir string) (*Lists, error) {
+	// Archives and exit lists live in separate folders: a failed attempt
+	// leaves nothing behind that could be mistaken for an exit list.
+	archives := filepath.Join(dir, "archives")
+	if s.CacheDir != "" {
+		archives = s.CacheDir
+	}
+	target := filepath.Join(dir, "lists")
+	source, err := s.pull(ctx, date, archives, target)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := DirDocuments(target)
+	if err != nil {
+		return nil, fmt.Errorf("month %s: %w", date, err)
+	}
+	return &Lists{Source: source, Documents: docs}, nil
+}
+
+// pull extracts the exit lists of date in target, downloading the archive
+// in archives unless there is a CacheDir. The cache is tried first, then
+// the mirrors in order: connection errors, missing months, corrupt archives
+// and checksum mismatches move on to the next one. It returns where the
+// archive came from.
+func (s *HTTPSource) pull(ctx context.Context, date, archives, target string) (string, error) {
+	keep := s.CacheDir != ""
+	logger := logging.Or(s.Logger).With("month", date)
+
+	if keep {
+		ok, err := s.fromCache(ctx, date, target, logger)
+		if err != nil {
+			return "", fmt.Errorf("month %s: %w", date, err)
+		}
+		if ok {
+			logger.Info("month pulled", "source", SourceCache)
+			return SourceCache, nil
+		}
+	}
+
+	var errs []error
+	for _, t := range s.URLTemplates {
+		u := fmt.Sprintf(t, date)
+		modified, err := s.pullFrom(ctx, u, archives, target, keep)
+		if err == nil {
+			source := u
+			if !modified {
+				source = SourceCache
+			}
+			logger.Info("month pulled", "source", source)
+			return source, nil
+		}
+		os.RemoveAll(target)
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("month %s: %w", date, err)
+		}
+		logger.Warn("mirror failed", "url", u, "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", u, err))
+	}
+	return "", fmt.Errorf("month %s: %w", date, errors.Join(errs...))
+}
+
+// pullFrom downloads the archive at u in archives and extracts it in target.
+// An archive already in archives is only downloaded again if it changed on
+// the server, modified tells which. The archive is removed afterwards unless
+// keep is set, a corrupt one is always removed.
+func (s *HTTPSource) pullFrom(ctx context.Context, u, archives, target string, keep bool) (modified bool, err error) {
+	d := s.Downloader
+	if d == nil {
+		d = &download.Downloader{}
+	}
+	if err := os.MkdirAll(archives, 0755); err != nil {
+		return false, fmt.Errorf("archive dir error: %w", err)
+	}
+	// The downloader only gives the archive its final name once complete:
+	// a failed download never looks cached.
+	archive, modified, err := d.Fetch(ctx, archives, u)
+	if errors.Is(err, download.ErrChecksum) {
+		// A damaged download is a corrupt archive, one the next mirror may
+		// have intact.
+		return false, fmt.Errorf("%w: %w", xz.ErrCorrupt, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	x := xz.Extractor{Progress: s.Progress, Logger: s.Logger, Limits: s.Limits}
+	err = x.ExtractTo(ctx, archive, target)
+	// A cancelled extraction says nothing of the archive, keep it.
+	if (err != nil && ctx.Err() == nil) || !keep {
+		download.Remove(archive)
+	}
+	return modified, err
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+// fakeSource serves exit lists from memory, a month it has not is missing.
+type fakeSource struct {
+	months map[string][]string
+
+	mu   sync.Mutex
+	dirs []string
+}
+
+func (s *fakeSource) Month(ctx context.Context, date, dir string) (*Lists, error) {
+	s.mu.Lock()
+	s.dirs = append(s.dirs, dir)
+	s.mu.Unlock()
+	lists, ok := s.months[date]
+	if !ok {
+		return nil, fmt.Errorf("month %s: %w", date, fs.ErrNotExist)
+	}
+	return &Lists{Source: "fake " + date, Documents: documents(lists...)}, nil
+}
+
+// exitList is an exit list with node on address, published on day.
+func exitList(node, address, day string) string {
+	return fmt.Sprintf(`@type tordnsel 1.0
+Downloaded %[3]s 13:02:00
+ExitNode %[1]s
+Published %[3]s 00:10:50
+LastStatus %[3]s 10:00:00
+ExitAddress %[2]s %[3]s 10:21:54
+`, node, address, day)
+}
+
+func TestSearchSource(t *testing.T) {
+	source := &fakeSource{months: map[string][]string{
+		"2024-01": {exitList("AAAA", "1.2.3.4", "2024-01-01"), exitList("BBBB", "1.2.3.4", "2024-01-02")},
+		"2024-03": {exitList("CCCC", "1.2.3.4", "2024-03-01"), exitList("DDDD", "5.6.7.8", "2024-03-02")},
+	}}
+	opts := Options{Source: source, BestEffort: true, Concurrency: 2}
+
+	result, err := History(context.Background(), opts, "2024-01", "2024-03", "1.2.3.4")
+	if !errors.Is(err, ErrPartial) {
+		t.Errorf("expected partial results, got: %v", err)
+	}
+	var nodes []string
+	for _, n := range result.Nodes {
+		nodes = append(nodes, n.ExitNode)
+	}
+	// The most recent first, whatever month was pulled first.
+	if strings.Join(nodes, ",") != "CCCC,BBBB,AAAA" {
+		t.Errorf("expected CCCC,BBBB,AAAA, got %v", nodes)
+	}
+	expected := []Month{
+		{Date: "2024-01", Source: "fake 2024-01", Status: StatusOK},
+		{Date: "2024-02", Status: StatusMissing},
+		{Date: "2024-03", Source: "fake 2024-03", Status: StatusOK},
+	}
+	for i, m := range result.Months {
+		if m.Date != expected[i].Date || m.Source != expected[i].Source || m.Status != expected[i].Status {
+			t.Errorf("expected %+v, got %+v", expected[i], m)
+		}
+	}
+
+	// Each month got its own dir, gone once the query is over.
+	if len(source.dirs) != 3 {
+		t.Fatalf("expected 3 dirs, got %v", source.dirs)
+	}
+	for _, dir := range source.dirs {
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s removed, got: %v", dir, err)
+		}
+	}
+	if source.dirs[0] == source.dirs[1] {
+		t.Errorf("expected a dir per month, got %v", source.dirs)
+	}
+}
+
+func TestSearchErrorOnSourceError(t *testing.T) {
+	source := &fakeSource{months: map[string][]string{}}
+	_, err := History(context.Background(), Options{Source: source}, "2024-01", "2024-01", "1.2.3.4")
+	if !errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrPartial) {
+		t.Errorf("expected the error of the source, got: %v", err)
+	}
+}
+
+func TestDirSource(t *testing.T) {
+	dir := t.TempDir()
+	// The layout of an extracted archive, named so that lexical order is
+	// not the order of creation.
+	for _, f := range []struct{ path, list string }{
+		{"exit-list-2024-01/02/2024-01-02-00-02-00", exitList("BBBB", "1.2.3.4", "2024-01-02")},
+		{"exit-list-2024-01/01/2024-01-01-00-02-00", exitList("AAAA", "1.2.3.4", "2024-01-01")},
+		{"exit-list-2024-02/01/2024-02-01-00-02-00", exitList("CCCC", "1.2.3.4", "2024-02-01")},
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("error setting up %s: %v", path, err)
+		}
+		if err := os.WriteFile(path, []byte(f.list), 0644); err != nil {
+			t.Fatalf("error setting up %s: %v", path, err)
+		}
+	}
+
+	opts := Options{Source: &DirSource{Dir: dir}, BestEffort: true}
+	result, err := History(context.Background(), opts, "2024-01", "2024-03", "1.2.3.4")
+	if !errors.Is(err, ErrPartial) {
+		t.Errorf("expected partial results, got: %v", err)
+	}
+	var nodes []string
+	for _, n := range result.Nodes {
+		nodes = append(nodes, n.ExitNode)
+	}
+	if strings.Join(nodes, ",") != "CCCC,BBBB,AAAA" {
+		t.Errorf("expected CCCC,BBBB,AAAA, got %v", nodes)
+	}
+	if result.Months[0].Source != filepath.Join(dir, "exit-list-2024-01") || result.Months[2].Status != StatusMissing {
+		t.Errorf("unexpected months %+v", result.Months)
+	}
+}
+
+// TestDirSourceMalformedList checks that in best effort mode a list that
+// cannot be parsed fails its month only, not the query.
+func TestDirSourceMalformedList(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []struct{ path, list string }{
+		{"exit-list-2024-01/01/2024-01-01-00-02-00", exitList("AAAA", "1.2.3.4", "2024-01-01")},
+		{"exit-list-2024-02/01/2024-02-01-00-02-00", exitList("BBBB", "1.2.3.4", "2024-02-01")},
+		{"exit-list-2024-02/02/2024-02-02-00-02-00", "ExitNode CCCC\nPublished 2024-02-01 bad\n"},
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("error setting up %s: %v", path, err)
+		}
+		if err := os.WriteFile(path, []byte(f.list), 0644); err != nil {
+			t.Fatalf("error setting up %s: %v", path, err)
+		}
+	}
+
+	// Without best effort the query fails.
+	opts := Options{Source: &DirSource{Dir: dir}}
+	result, err := History(context.Background(), opts, "2024-01", "2024-02", "1.2.3.4")
+	var parse *exitnode.ParseError
+	if result != nil || !errors.As(err, &parse) {
+		t.Fatalf("expected a parse error, got %v, %v", result, err)
+	}
+
+	opts.BestEffort = true
+	result, err = History(context.Background(), opts, "2024-01", "2024-02", "1.2.3.4")
+	if !errors.Is(err, ErrPartial) || !errors.As(err, &parse) || !strings.Contains(err.Error(), "1 of 2 months failed") {
+		t.Fatalf("expected partial results with a parse error, got: %v", err)
+	}
+	// The good list of 2024-02 is dropped along with the bad one.
+	if len(result.Nodes) != 1 || result.Nodes[0].ExitNode != "AAAA" {
+		t.Errorf("expected the node of 2024-01 only, got %v", result.Nodes)
+	}
+	if m := result.Months[0]; m.Status != StatusOK || m.Err != nil {
+		t.Errorf("expected 2024-01 ok, got %+v", m)
+	}
+	if m := result.Months[1]; m.Status != StatusCorrupt || !errors.As(m.Err, &parse) || !strings.Contains(m.Err.Error(), "month 2024-02") {
+		t.Errorf("expected 2024-02 corrupt, got %+v", m)
+	}
+}
+
+func TestDirDocumentsErrorOnMissingDir(t *testing.T) {
+	_, err := DirDocuments(filepath.Join(t.TempDir(), "missing"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error, got: %v", err)
+	}
+}
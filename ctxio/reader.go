@@ -0,0 +1,28 @@
+// Package ctxio makes the io loops of a query, copying a download,
+// decompressing an archive and parsing the exit lists, stop when the context
+// of the query is done, instead of running to the end of the data.
+package ctxio
+
+import (
+	"context"
+	"io"
+)
+
+// Reader returns a reader reading from r until ctx is done, then failing
+// with ctx.Err(). A Read already blocked in r is not interrupted, it is
+// for r to watch ctx, like the body of a request made with it does.
+func Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &reader{ctx: ctx, r: r}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,29 @@
+package ctxio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := Reader(ctx, strings.NewReader("exit list"))
+	p := make([]byte, 4)
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "exit" {
+		t.Fatalf("expected to read exit, got %q, %v", p[:n], err)
+	}
+
+	cancel()
+	if n, err := r.Read(p); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled after the cancellation, got %d, %v", n, err)
+	}
+	// io.Copy gives up at once too.
+	if n, err := io.Copy(io.Discard, r); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected copy to stop, got %d, %v", n, err)
+	}
+}
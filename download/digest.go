@@ -0,0 +1,70 @@
+package download
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digest returns the SHA-256 of the file the server says it sends, nil when
+// it does not say. Repr-Digest (RFC 9530) is read first, like
+// sha-256=:base64:, then the older Digest (RFC 3230), like SHA-256=base64.
+// Other algorithms are ignored.
+func digest(h http.Header) []byte {
+	for _, v := range h.Values("Repr-Digest") {
+		for _, member := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok || key != "sha-256" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			// A byte sequence of structured fields is between colons.
+			if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				continue
+			}
+			if sum := decodeSHA256(value[1 : len(value)-1]); sum != nil {
+				return sum
+			}
+		}
+	}
+	for _, v := range h.Values("Digest") {
+		for _, member := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok || !strings.EqualFold(key, "sha-256") {
+				continue
+			}
+			if sum := decodeSHA256(strings.TrimSpace(value)); sum != nil {
+				return sum
+			}
+		}
+	}
+	return nil
+}
+
+// decodeSHA256 decodes a base64 SHA-256, nil when it is not one.
+func decodeSHA256(s string) []byte {
+	sum, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(sum) != sha256.Size {
+		return nil
+	}
+	return sum
+}
+
+// verify checks that the SHA-256 of f is want.
+func verify(f io.ReadSeeker, want []byte) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("download error: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("download error: %w", err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("download error: %w: sha-256 is %x, the server announced %x", ErrChecksum, got, want)
+	}
+	return nil
+}
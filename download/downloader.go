@@ -2,48 +2,504 @@ package download
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robizz/his-tor-y/ctxio"
+	"github.com/robizz/his-tor-y/logging"
+	"github.com/robizz/his-tor-y/progress"
+)
+
+// Defaults used by New.
+const (
+	DefaultRetries    = 3
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// partSuffix marks a download in progress, the file gets its final name only
+// once complete.
+const partSuffix = ".part"
+
+// MetaSuffix names the file next to each download keeping the ETag and
+// Last-Modified the server sent with it, see Fetch.
+const MetaSuffix = ".meta"
+
+// Errors telling why a download failed, to be checked with errors.Is.
+var (
+	// ErrNotFound is a file that is not on the server, like a month that is
+	// not published yet.
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable is a server that cannot be reached or is failing, after
+	// the retries.
+	ErrUnavailable = errors.New("source unavailable")
+	// ErrChecksum is a file that does not match the digest the server sent
+	// along with it: the copy on this server is damaged, another one may not
+	// be.
+	ErrChecksum = errors.New("checksum mismatch")
 )
 
+// StatusError is returned when the server answers with a status that is not
+// a success, like 404 for a month that is not published.
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("download error, server returned %d", e.StatusCode)
+}
+
+// Is makes 404 and 410 an ErrNotFound, server errors and throttling an
+// ErrUnavailable.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case ErrUnavailable:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+	}
+	return false
+}
+
+// Downloader fetches files over HTTP. Failed attempts on network errors and
+// 5xx answers are retried with exponential backoff and jitter, resuming the
+// partial transfer with a Range request when the server supports it.
+// The zero value makes a single attempt with http.DefaultClient.
+type Downloader struct {
+	// Client is the HTTP client to use, http.DefaultClient when nil.
+	Client *http.Client
+	// Timeout bounds each request, body included. 0 means no timeout.
+	Timeout time.Duration
+	// Retries is the number of attempts after the first one.
+	Retries int
+	// Backoff is the wait before the first retry, it doubles at every retry
+	// up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Limiter caps the bandwidth, shared with the other Downloaders using
+	// it. No limit when nil.
+	Limiter *Limiter
+	// Progress receives the bytes downloaded, named after the URL.
+	Progress progress.Reporter
+	// Logger gets a record per request, silent when nil.
+	Logger *slog.Logger
+}
+
+// New returns a Downloader with the default retry policy.
+func New(client *http.Client) *Downloader {
+	return &Downloader{
+		Client:     client,
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
 // Matt Holt uses a "file approach" meaning you pass path to functions that do the magic
 // https://github.com/mholt/archiver/blob/cdc68dd1f170b8dfc1a0d2231b5bb0967ed67006/tarxz.go#L53-L66
+//
+// DownloadFile downloads uri in dir with a single attempt, see Downloader
+// for retries.
 func DownloadFile(ctx context.Context, dir, uri string) (string, error) {
+	var d Downloader
+	return d.Download(ctx, dir, uri)
+}
 
-	fileURI := filepath.Join(dir, path.Base(uri))
-	// fmt.Println(fileURI)
+// Download downloads uri in dir and returns the path of the file, see Fetch.
+func (d *Downloader) Download(ctx context.Context, dir, uri string) (string, error) {
+	fileURI, _, err := d.Fetch(ctx, dir, uri)
+	return fileURI, err
+}
 
-	fileHandle, err := os.OpenFile(fileURI, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+// Fetch downloads uri in dir and returns the path of the file. The data goes
+// in a .part file that is renamed only once complete, so a failed download
+// never leaves a truncated file under the final name.
+// When dir already holds the file from a previous Fetch, the request carries
+// If-None-Match and If-Modified-Since: a 304 leaves the file untouched and
+// modified is false.
+// When the server sends the SHA-256 of the file in a Repr-Digest or Digest
+// header, the download is checked against it and a mismatch is an
+// ErrChecksum, not retried: the next attempt would likely get the same bytes.
+func (d *Downloader) Fetch(ctx context.Context, dir, uri string) (fileURI string, modified bool, err error) {
+	fileURI = filepath.Join(dir, path.Base(uri))
+
+	// Every call gets a .part of its own: two Fetches of the same file in
+	// the same dir do not write over each other, and the rename makes the
+	// complete file appear at once. A .part left over by a crash comes from
+	// who knows which version of the file, resuming is only safe within the
+	// same call.
+	fileHandle, err := os.CreateTemp(dir, path.Base(uri)+".*"+partSuffix)
 	if err != nil {
-		return "", fmt.Errorf("download error: %w", err)
+		return "", false, fmt.Errorf("download error: %w", err)
 	}
 	defer fileHandle.Close()
+	part := fileHandle.Name()
+
+	logger := logging.Or(d.Logger).With("url", uri)
+	t := transfer{cached: readValidators(fileURI)}
+	// Whatever happens, the download is over on return.
+	defer func() {
+		progress.Or(d.Progress).Report(progress.Event{Stage: progress.Download, Name: uri, N: t.written, Total: t.total, Done: true})
+	}()
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err = d.attempt(ctx, uri, fileHandle, &t)
+		if err == nil {
+			logger.Info("downloaded", "status", t.status, "bytes", t.written, "duration", time.Since(start))
+			break
+		}
+		if errors.Is(err, errNotModified) {
+			logger.Info("not modified", "status", t.status, "duration", time.Since(start))
+			fileHandle.Close()
+			os.Remove(part)
+			return fileURI, false, nil
+		}
+		if attempt >= d.Retries || !retryable(ctx, err) {
+			logger.Debug("download failed", "status", t.status, "attempts", attempt+1, "error", err)
+			os.Remove(part)
+			return "", false, err
+		}
+		delay := d.backoff(attempt, err)
+		logger.Warn("download failed, retrying", "status", t.status, "attempt", attempt+1, "bytes", t.written, "retry_in", delay, "error", err)
+		if err := wait(ctx, delay); err != nil {
+			os.Remove(part)
+			return "", false, fmt.Errorf("download cancelled: %w", err)
+		}
+	}
+
+	if t.digest != nil {
+		if err := verify(fileHandle, t.digest); err != nil {
+			logger.Debug("download failed", "status", t.status, "error", err)
+			fileHandle.Close()
+			os.Remove(part)
+			return "", false, err
+		}
+	}
+	if err := fileHandle.Close(); err != nil {
+		return "", false, fmt.Errorf("download error: %w", err)
+	}
+	if err := os.Rename(part, fileURI); err != nil {
+		return "", false, fmt.Errorf("download error: %w", err)
+	}
+	if err := writeValidators(fileURI, t.fresh); err != nil {
+		return "", false, fmt.Errorf("download error: %w", err)
+	}
+	return fileURI, true, nil
+}
+
+// Remove deletes a file got from Fetch along with its validators.
+func Remove(fileURI string) error {
+	os.Remove(fileURI + MetaSuffix)
+	return os.Remove(fileURI)
+}
+
+// validators identify a version of a file on the server.
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// readValidators returns the validators of fileURI, none when the file or
+// its validators are missing: without the file a 304 would be of no use.
+func readValidators(fileURI string) validators {
+	var v validators
+	if _, err := os.Stat(fileURI); err != nil {
+		return v
+	}
+	data, err := os.ReadFile(fileURI + MetaSuffix)
+	if err != nil {
+		return v
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return validators{}
+	}
+	return v
+}
+
+// writeValidators stores v next to fileURI, or removes stale ones when the
+// server sent none.
+func writeValidators(fileURI string, v validators) error {
+	if v == (validators{}) {
+		if err := os.Remove(fileURI + MetaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileURI+MetaSuffix, data, 0644)
+}
+
+// errNotModified is how attempt tells Fetch that the file it has is current.
+var errNotModified = errors.New("not modified")
+
+// transfer keeps what is known of the file across attempts.
+type transfer struct {
+	// written is the number of bytes in the .part file.
+	written int64
+	// validator is the ETag, or failing that the Last-Modified, of the first
+	// answer. Resuming with If-Range makes sure the rest belongs to the same
+	// version of the file.
+	validator string
+	// cached are the validators of the file already in dir, fresh the ones
+	// of the file being downloaded.
+	cached, fresh validators
+	// digest is the SHA-256 the server sent with the file, nil when none.
+	digest []byte
+	// total is the size of the file when the server tells it.
+	total int64
+	// status is the HTTP status of the last answer, 0 when there was none.
+	status int
+}
+
+// attempt makes a single request, resuming after t.written bytes if any.
+func (d *Downloader) attempt(ctx context.Context, uri string, f *os.File, t *transfer) error {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
-		return "", fmt.Errorf("download error: %w", err)
+		return fmt.Errorf("download error: %w", err)
+	}
+	if t.written > 0 && t.validator != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", t.written))
+		req.Header.Set("If-Range", t.validator)
+	} else {
+		if t.cached.ETag != "" {
+			req.Header.Set("If-None-Match", t.cached.ETag)
+		}
+		if t.cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", t.cached.LastModified)
+		}
 	}
 
-	client := http.DefaultClient
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	t.status = 0
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("download error: %w", err)
+		if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// Cannot connect, or the request timed out: not our doing.
+			return fmt.Errorf("download error: %w: %w", ErrUnavailable, err)
+		}
+		return fmt.Errorf("download cancelled: %w", ctx.Err())
 	}
+	t.status = resp.StatusCode
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("download error, server returned %d", resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Either a first attempt or the server ignored the Range: start over.
+		if err := restart(f, t); err != nil {
+			return err
+		}
+		// The file already in dir is stale, no more conditional requests.
+		t.cached = validators{}
+		t.fresh = validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		t.digest = digest(resp.Header)
+		t.validator = t.fresh.ETag
+		if t.validator == "" {
+			t.validator = t.fresh.LastModified
+		}
+	case http.StatusPartialContent:
+		// Appending a range that does not start where the .part file ends
+		// would garble the archive: drop what we have and ask again.
+		contentRange := resp.Header.Get("Content-Range")
+		if start, ok := contentRangeStart(contentRange); !ok || start != t.written {
+			asked := t.written
+			if err := restart(f, t); err != nil {
+				return err
+			}
+			return fmt.Errorf("download error: %w: asked for bytes from %d, got Content-Range %q",
+				ErrUnavailable, asked, contentRange)
+		}
+	case http.StatusNotModified:
+		if t.cached != (validators{}) {
+			return errNotModified
+		}
+		return &StatusError{URL: uri, StatusCode: resp.StatusCode}
+	default:
+		return &retryAfterError{
+			StatusError: &StatusError{URL: uri, StatusCode: resp.StatusCode},
+			after:       retryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
-	_, err = io.Copy(fileHandle, resp.Body)
+	t.total = 0
+	if resp.ContentLength >= 0 {
+		t.total = t.written + resp.ContentLength
+	}
+	w := &progressWriter{
+		w: f,
+		r: progress.Or(d.Progress),
+		e: progress.Event{Stage: progress.Download, Name: uri, N: t.written, Total: t.total},
+	}
+	// The body of the request watches ctx already, a Client with a custom
+	// Transport may not.
+	n, err := io.Copy(w, d.Limiter.Reader(ctx, ctxio.Reader(ctx, resp.Body)))
+	t.written += n
+	if w.err != nil {
+		// The disk is full or the like, not something a retry fixes.
+		return fmt.Errorf("download error: %w", w.err)
+	}
 	if err != nil {
-		return "", fmt.Errorf("download error: %w", err)
+		if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// The connection dropped in the middle of the transfer.
+			return fmt.Errorf("download error: %w: %w", ErrUnavailable, err)
+		}
+		// Whatever the transport said, it is because of the cancellation.
+		return fmt.Errorf("download cancelled: %w", ctx.Err())
 	}
+	return nil
+}
+
+// progressWriter reports the bytes written to w, and keeps the error of w
+// apart from the ones of the body.
+type progressWriter struct {
+	w   io.Writer
+	r   progress.Reporter
+	e   progress.Event
+	err error
+}
 
-	return fileURI, nil
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.e.N += int64(n)
+	p.r.Report(p.e)
+	if err != nil {
+		p.err = err
+	}
+	return n, err
+}
+
+func restart(f *os.File, t *transfer) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("download error: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("download error: %w", err)
+	}
+	t.written = 0
+	return nil
+}
+
+// retryAfterError is a StatusError carrying the Retry-After the server asked
+// for, if any.
+type retryAfterError struct {
+	*StatusError
+	after time.Duration
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.StatusError
+}
+
+// contentRangeStart returns the first byte of a Content-Range like
+// "bytes 100-199/200", false when v is not one.
+func contentRangeStart(v string) (int64, bool) {
+	v, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	first, _, ok := strings.Cut(v, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, false
+	}
+	return start, true
+}
+
+func retryAfter(v string) time.Duration {
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// retryable tells if err is worth another attempt: network errors, timeouts
+// of a single request and server errors are. Client errors like 404, local
+// errors like a full disk and the cancellation of ctx are not.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var s *StatusError
+	if errors.As(err, &s) {
+		return errors.Is(s, ErrUnavailable)
+	}
+	// A syscall.Errno is a net.Error too, the file it comes from tells it
+	// is local.
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrUnavailable) || errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// wait sleeps for delay, or until ctx is done.
+func wait(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoff doubles Backoff at every attempt up to MaxBackoff, then picks a
+// random duration in its upper half so that many clients failing together
+// do not retry together. A Retry-After from the server wins if longer.
+func (d *Downloader) backoff(attempt int, err error) time.Duration {
+	b := d.Backoff
+	for i := 0; i < attempt && (d.MaxBackoff <= 0 || b < d.MaxBackoff); i++ {
+		b *= 2
+	}
+	if d.MaxBackoff > 0 && b > d.MaxBackoff {
+		b = d.MaxBackoff
+	}
+	if b > 0 {
+		b = b/2 + time.Duration(rand.Int63n(int64(b/2)+1))
+	}
+
+	var r *retryAfterError
+	if errors.As(err, &r) && r.after > b {
+		b = r.after
+		if d.MaxBackoff > 0 && b > d.MaxBackoff {
+			b = d.MaxBackoff
+		}
+	}
+	return b
 }
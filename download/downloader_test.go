@@ -1,13 +1,31 @@
 package download
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/progress"
 )
 
 func TestDownloadFile(t *testing.T) {
@@ -46,6 +64,8 @@ func TestDownloadFileErrorOnDownloadConnection(t *testing.T) {
 	// We set the default timeout for http to be 1ms, but the mock server is going to
 	// answer after 10 ms. This makes the downloadFile function to err.
 	http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout = 1 * time.Millisecond
+	// Do not leak the setting into the other tests.
+	defer func() { http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout = 0 }()
 
 	// Setup a mock server
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -113,3 +133,714 @@ func TestDownloadFileErrorOnMakeTmpFile(t *testing.T) {
 		t.Errorf("error expected")
 	}
 }
+
+// newTestDownloader retries fast, tests should not wait for real backoffs.
+func newTestDownloader(retries int) *Downloader {
+	d := New(&http.Client{})
+	d.Retries = retries
+	d.Backoff = time.Millisecond
+	d.MaxBackoff = 5 * time.Millisecond
+	return d
+}
+
+func TestDownloadRetriesOnServerErrors(t *testing.T) {
+	var expected = "Hello, client"
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, expected)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	f, err := newTestDownloader(3).Download(context.Background(), dir, ts.URL+"/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(f)
+	if err != nil || string(content) != expected {
+		t.Errorf("expected %s, but got %s (%v)", expected, content, err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", requests.Load())
+	}
+	if parts := partsIn(t, dir); len(parts) != 0 {
+		t.Errorf("expected .part file to be renamed, got %v", parts)
+	}
+}
+
+func TestDownloadGivesUpAfterRetries(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	_, err := newTestDownloader(2).Download(context.Background(), dir, ts.URL+"/file")
+	var s *StatusError
+	if !errors.As(err, &s) || s.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status error, got: %v", err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("expected 3 requests, got %d", requests.Load())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected nothing left behind, got %v", entries)
+	}
+}
+
+func TestDownloadDoesNotRetryNotFound(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err := newTestDownloader(3).Download(context.Background(), t.TempDir(), ts.URL+"/file")
+	var s *StatusError
+	if !errors.As(err, &s) || s.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 status error, got: %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected 1 request, got %d", requests.Load())
+	}
+}
+
+func TestDownloadRetriesOnTimeout(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Hang until the client gives up on this request.
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	d := newTestDownloader(1)
+	d.Timeout = 50 * time.Millisecond
+	f, err := d.Download(context.Background(), t.TempDir(), ts.URL+"/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, _ := os.ReadFile(f)
+	if string(content) != "ok" || requests.Load() != 2 {
+		t.Errorf("expected ok after 2 requests, got %s after %d", content, requests.Load())
+	}
+}
+
+// TestDownloadResumes breaks the first transfer halfway and checks that the
+// retry asks for the rest only, and that the file is complete in the end.
+func TestDownloadResumes(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	half := len(content) / 2
+
+	var requests atomic.Int32
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if requests.Add(1) == 1 {
+			// Promise everything, send half, then drop the connection.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, content[:half])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	f, err := newTestDownloader(1).Download(context.Background(), t.TempDir(), ts.URL+"/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := os.ReadFile(f)
+	if string(got) != content {
+		t.Errorf("expected %d bytes of content, got %d", len(content), len(got))
+	}
+	expected := fmt.Sprintf(`bytes=%d- "v1"`, half)
+	if len(ranges) != 1 || ranges[0] != expected {
+		t.Errorf("expected resume with %s, got %v", expected, ranges)
+	}
+}
+
+// TestDownloadRestartsWhenRangeIgnored checks that a 200 to a Range request
+// replaces what was downloaded so far instead of appending to it.
+func TestDownloadRestartsWhenRangeIgnored(t *testing.T) {
+	content := strings.Repeat("abcdefghij", 1000)
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		if requests.Add(1) == 1 {
+			io.WriteString(w, content[:100])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		io.WriteString(w, content)
+	}))
+	defer ts.Close()
+
+	f, err := newTestDownloader(1).Download(context.Background(), t.TempDir(), ts.URL+"/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := os.ReadFile(f)
+	if string(got) != content {
+		t.Errorf("expected %d bytes of content, got %d", len(content), len(got))
+	}
+}
+
+// TestFetchChecksum checks the downloads against the digests the server
+// sends, in either header, and that a mismatch is not retried and leaves no
+// file behind.
+func TestFetchChecksum(t *testing.T) {
+	content := "Hello, client"
+	sum := sha256.Sum256([]byte(content))
+	good := base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("Goodbye, client"))
+	bad := base64.StdEncoding.EncodeToString(other[:])
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		mismatch bool
+	}{
+		{"no digest", "", "", false},
+		{"repr-digest", "Repr-Digest", "sha-256=:" + good + ":", false},
+		{"repr-digest mismatch", "Repr-Digest", "sha-512=:AAAA:, sha-256=:" + bad + ":", true},
+		{"digest", "Digest", "SHA-256=" + good, false},
+		{"digest mismatch", "Digest", "md5=AAAA, SHA-256=" + bad, true},
+		{"other algorithm", "Repr-Digest", "sha-512=:" + bad + ":", false},
+		{"not a digest", "Digest", "SHA-256=not base64", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if tt.header != "" {
+					w.Header().Set(tt.header, tt.value)
+				}
+				fmt.Fprint(w, content)
+			}))
+			defer ts.Close()
+
+			dir := t.TempDir()
+			f, _, err := newTestDownloader(2).Fetch(context.Background(), dir, ts.URL+"/file")
+			if !tt.mismatch {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got, _ := os.ReadFile(f); string(got) != content {
+					t.Errorf("expected %s, got %s", content, got)
+				}
+				return
+			}
+			if !errors.Is(err, ErrChecksum) {
+				t.Fatalf("expected ErrChecksum, got: %v", err)
+			}
+			if n := requests.Load(); n != 1 {
+				t.Errorf("expected a single request, got %d", n)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("expected nothing left in dir, got %v", entries)
+			}
+		})
+	}
+}
+
+// TestFetchChecksumResumed checks a resumed download against the digest of
+// the whole file.
+func TestFetchChecksumResumed(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	sum := sha256.Sum256([]byte(content))
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		if requests.Add(1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	if _, _, err := newTestDownloader(1).Fetch(context.Background(), t.TempDir(), ts.URL+"/file"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestFetchWrongRange(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	lists := []collectortest.List{{Downloaded: at, Nodes: []exitnode.ExitNode{collectortest.Node("AAAA", "194.26.192.64", at)}}}
+	archive, err := collectortest.Archive("2024-01", lists...)
+	if err != nil {
+		t.Fatalf("error setup archive: %v", err)
+	}
+	s := collectortest.NewServer()
+	defer s.Close()
+	// No digest: the Content-Range alone must keep the archive whole.
+	s.Set("2024-01", collectortest.Month{Lists: lists, WrongRange: true})
+
+	f, _, err := newTestDownloader(2).Fetch(context.Background(), t.TempDir(), fmt.Sprintf(s.URLTemplate(), "2024-01"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := os.ReadFile(f); !bytes.Equal(got, archive) {
+		t.Errorf("expected the archive, got %d bytes", len(got))
+	}
+	// Cut off, wrong range, then a fresh start.
+	if n := s.Requests("2024-01"); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestContentRangeStart(t *testing.T) {
+	for _, tc := range []struct {
+		v     string
+		start int64
+		ok    bool
+	}{
+		{"bytes 100-199/200", 100, true},
+		{"bytes 0-99/*", 0, true},
+		{"bytes */200", 0, false},
+		{"items 100-199/200", 0, false},
+		{"bytes -5-10/20", 0, false},
+		{"", 0, false},
+	} {
+		start, ok := contentRangeStart(tc.v)
+		if start != tc.start || ok != tc.ok {
+			t.Errorf("%q: expected %d %v, got %d %v", tc.v, tc.start, tc.ok, start, ok)
+		}
+	}
+}
+
+// partsIn returns the .part files in dir.
+func partsIn(t *testing.T, dir string) []string {
+	t.Helper()
+	parts, err := filepath.Glob(filepath.Join(dir, "*"+partSuffix))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return parts
+}
+
+func TestDownloadIgnoresStalePart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fresh")
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "file.123"+partSuffix)
+	if err := os.WriteFile(stale, []byte("stale and longer"), 0644); err != nil {
+		t.Fatalf("error setup part file: %v", err)
+	}
+	f, err := newTestDownloader(0).Download(context.Background(), dir, ts.URL+"/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := os.ReadFile(f)
+	if string(got) != "fresh" {
+		t.Errorf("expected fresh, got %s", got)
+	}
+	if parts := partsIn(t, dir); len(parts) != 1 || parts[0] != stale {
+		t.Errorf("expected only the stale .part, got %v", parts)
+	}
+}
+
+// TestFetchConcurrent checks that Fetches of the same file in the same dir
+// do not mix their bytes: each one writes its own .part.
+func TestFetchConcurrent(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		// Send it in pieces so that the writes interleave.
+		for i := 0; i < len(content); i += 1000 {
+			io.WriteString(w, content[i:i+1000])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = newTestDownloader(0).Fetch(context.Background(), dir, ts.URL+"/file")
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "file"))
+	if string(got) != content {
+		t.Errorf("expected %d bytes of content, got %d", len(content), len(got))
+	}
+	if parts := partsIn(t, dir); len(parts) != 0 {
+		t.Errorf("expected no .part file left behind, got %v", parts)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		expected bool
+	}{
+		{"unavailable", context.Background(), fmt.Errorf("download error: %w: %w", ErrUnavailable, io.EOF), true},
+		{"server error", context.Background(), &StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"not found", context.Background(), &StatusError{StatusCode: http.StatusNotFound}, false},
+		{"network", context.Background(), &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"unexpected EOF", context.Background(), fmt.Errorf("download error: %w", io.ErrUnexpectedEOF), true},
+		{"permission denied", context.Background(), fmt.Errorf("download error: %w", &fs.PathError{Op: "open", Path: "file.part", Err: fs.ErrPermission}), false},
+		{"disk full", context.Background(), fmt.Errorf("download error: %w", &fs.PathError{Op: "write", Path: "file.part", Err: syscall.ENOSPC}), false},
+		{"failed rename", context.Background(), fmt.Errorf("download error: %w", &os.LinkError{Op: "rename", Old: "file.part", New: "file", Err: syscall.EXDEV}), false},
+		{"other", context.Background(), errors.New("something else"), false},
+		{"checksum", context.Background(), fmt.Errorf("download error: %w", ErrChecksum), false},
+		{"cancelled", cancelled, fmt.Errorf("download error: %w: %w", ErrUnavailable, io.EOF), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.ctx, tt.err); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDownloadCancelledDuringBackoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	d := newTestDownloader(5)
+	d.Backoff, d.MaxBackoff = time.Hour, time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := d.Download(ctx, t.TempDir(), ts.URL+"/file")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("expected cancellation to stop the backoff")
+	}
+}
+
+func TestDownloadCancelledMidTransfer(t *testing.T) {
+	// The server sends the first bytes, then hangs until the client leaves.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000000")
+		fmt.Fprint(w, "first bytes")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newTestDownloader(3)
+	// Cancel as soon as some data made it to the disk.
+	d.Progress = progress.ReporterFunc(func(e progress.Event) {
+		if e.N > 0 {
+			cancel()
+		}
+	})
+
+	dir := t.TempDir()
+	start := time.Now()
+	_, err := d.Download(ctx, dir, ts.URL+"/file")
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("expected cancellation to stop the transfer")
+	}
+	// Neither the part nor the file are left behind.
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected an empty dir, got %v", entries)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Downloader{Backoff: time.Second, MaxBackoff: 4 * time.Second}
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 500 * time.Millisecond, time.Second},
+		{1, time.Second, 2 * time.Second},
+		{2, 2 * time.Second, 4 * time.Second},
+		{10, 2 * time.Second, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			b := d.backoff(tt.attempt, errors.New("network"))
+			if b < tt.min || b > tt.max {
+				t.Errorf("backoff(%d) = %s, expected in [%s, %s]", tt.attempt, b, tt.min, tt.max)
+			}
+		}
+	}
+
+	// Retry-After is honoured, within MaxBackoff.
+	err := &retryAfterError{StatusError: &StatusError{StatusCode: 429}, after: 3 * time.Second}
+	if b := d.backoff(0, err); b != 3*time.Second {
+		t.Errorf("expected Retry-After to win, got %s", b)
+	}
+	err.after = time.Minute
+	if b := d.backoff(0, err); b != 4*time.Second {
+		t.Errorf("expected MaxBackoff to cap Retry-After, got %s", b)
+	}
+}
+
+func TestFetchConditional(t *testing.T) {
+	content := "version 1"
+	var conditions []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditions = append(conditions, r.Header.Get("If-None-Match"))
+		etag := `"` + content + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	d := newTestDownloader(0)
+	fetch := func(expected string, expectedModified bool) {
+		t.Helper()
+		f, modified, err := d.Fetch(context.Background(), dir, ts.URL+"/file")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if modified != expectedModified {
+			t.Errorf("expected modified %v, got %v", expectedModified, modified)
+		}
+		got, _ := os.ReadFile(f)
+		if string(got) != expected {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+
+	fetch("version 1", true)
+	meta, err := os.ReadFile(filepath.Join(dir, "file"+MetaSuffix))
+	if err != nil || !strings.Contains(string(meta), `version 1`) {
+		t.Errorf("expected validators next to the file, got %s (%v)", meta, err)
+	}
+	fetch("version 1", false)
+	content = "version 2"
+	fetch("version 2", true)
+
+	expected := []string{"", `"version 1"`, `"version 1"`}
+	if fmt.Sprint(conditions) != fmt.Sprint(expected) {
+		t.Errorf("expected If-None-Match %v, got %v", expected, conditions)
+	}
+	if parts := partsIn(t, dir); len(parts) != 0 {
+		t.Errorf("expected no .part file left behind, got %v", parts)
+	}
+}
+
+func TestFetchIfModifiedSince(t *testing.T) {
+	modtime := time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// ServeContent answers 304 to a matching If-Modified-Since.
+		http.ServeContent(w, r, "file", modtime, strings.NewReader("content"))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	d := newTestDownloader(0)
+	for i, expected := range []bool{true, false} {
+		_, modified, err := d.Fetch(context.Background(), dir, ts.URL+"/file")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if modified != expected {
+			t.Errorf("fetch %d: expected modified %v, got %v", i, expected, modified)
+		}
+	}
+
+	// Without the file the validators are useless, the file is downloaded.
+	if err := os.Remove(filepath.Join(dir, "file")); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	f, modified, err := d.Fetch(context.Background(), dir, ts.URL+"/file")
+	if err != nil || !modified {
+		t.Fatalf("expected a download, got modified %v (%v)", modified, err)
+	}
+	if err := Remove(f); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected Remove to delete the validators too, got %v", entries)
+	}
+}
+
+func TestFetchErrorOnUnexpectedNotModified(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer ts.Close()
+
+	_, _, err := newTestDownloader(0).Fetch(context.Background(), t.TempDir(), ts.URL+"/file")
+	var s *StatusError
+	if !errors.As(err, &s) || s.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304 status error, got: %v", err)
+	}
+}
+
+func TestDownloadLogs(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	d := newTestDownloader(1)
+	d.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	if _, err := d.Download(context.Background(), t.TempDir(), ts.URL+"/file"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		`level=WARN msg="download failed, retrying" url=` + ts.URL + "/file status=502 attempt=1",
+		`level=INFO msg=downloaded url=` + ts.URL + "/file status=200 bytes=2 duration=",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected log to contain %q, got: %s", expected, buf.String())
+		}
+	}
+}
+
+func TestStatusErrorIs(t *testing.T) {
+	tests := []struct {
+		status      int
+		notFound    bool
+		unavailable bool
+	}{
+		{http.StatusNotFound, true, false},
+		{http.StatusGone, true, false},
+		{http.StatusForbidden, false, false},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusRequestTimeout, false, true},
+		{http.StatusBadGateway, false, true},
+	}
+	for _, tt := range tests {
+		err := fmt.Errorf("wrapped: %w", &StatusError{StatusCode: tt.status})
+		if errors.Is(err, ErrNotFound) != tt.notFound || errors.Is(err, ErrUnavailable) != tt.unavailable {
+			t.Errorf("unexpected Is for %d: not found %v, unavailable %v", tt.status, errors.Is(err, ErrNotFound), errors.Is(err, ErrUnavailable))
+		}
+	}
+}
+
+func TestDownloadErrorOnUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+
+	_, err := newTestDownloader(1).Download(context.Background(), t.TempDir(), ts.URL+"/file")
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected unavailable error, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newTestDownloader(1).Download(ctx, t.TempDir(), ts.URL+"/file")
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+}
+
+// TestFetchCollector fetches monthly archives the way core does, from a fake
+// CollecTor.
+func TestFetchCollector(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	lists := []collectortest.List{{Downloaded: at, Nodes: []exitnode.ExitNode{collectortest.Node("AAAA", "194.26.192.64", at)}}}
+	archive, err := collectortest.Archive("2024-01", lists...)
+	if err != nil {
+		t.Fatalf("error setup archive: %v", err)
+	}
+	s := collectortest.NewServer()
+	defer s.Close()
+	s.Set("2024-01", collectortest.Month{Lists: lists, Digest: true})
+	s.Set("2024-02", collectortest.Month{Lists: lists, Digest: true, Corrupt: true})
+	s.Set("2024-03", collectortest.Month{Status: http.StatusServiceUnavailable})
+
+	dir := t.TempDir()
+	d := newTestDownloader(2)
+	for i, expected := range []bool{true, false} {
+		f, modified, err := d.Fetch(context.Background(), dir, fmt.Sprintf(s.URLTemplate(), "2024-01"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if modified != expected {
+			t.Errorf("fetch %d: expected modified %v, got %v", i, expected, modified)
+		}
+		if got, _ := os.ReadFile(f); !bytes.Equal(got, archive) {
+			t.Errorf("fetch %d: expected the archive, got %d bytes", i, len(got))
+		}
+	}
+
+	_, _, err = d.Fetch(context.Background(), dir, fmt.Sprintf(s.URLTemplate(), "2024-02"))
+	if !errors.Is(err, ErrChecksum) || s.Requests("2024-02") != 1 {
+		t.Errorf("expected a single request and a checksum error, got %d and %v", s.Requests("2024-02"), err)
+	}
+	_, _, err = d.Fetch(context.Background(), dir, fmt.Sprintf(s.URLTemplate(), "2024-03"))
+	if !errors.Is(err, ErrUnavailable) || s.Requests("2024-03") != 3 {
+		t.Errorf("expected 3 requests and an unavailable error, got %d and %v", s.Requests("2024-03"), err)
+	}
+	_, _, err = d.Fetch(context.Background(), dir, fmt.Sprintf(s.URLTemplate(), "2024-04"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found error, got: %v", err)
+	}
+}
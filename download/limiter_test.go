@@ -0,0 +1,110 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewLimiterNoLimit(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		l := NewLimiter(rate)
+		if l != nil {
+			t.Fatalf("expected no limiter for %d", rate)
+		}
+		r := strings.NewReader("x")
+		if l.Reader(context.Background(), r) != r {
+			t.Errorf("expected a nil limiter to leave the reader as is")
+		}
+	}
+}
+
+func TestLimiterReader(t *testing.T) {
+	// The bucket starts full: a second worth of bytes goes through at once,
+	// the next second worth takes about a second.
+	const rate = 20000
+	l := NewLimiter(rate)
+	data := bytes.Repeat([]byte("x"), 2*rate)
+
+	start := time.Now()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, l.Reader(context.Background(), bytes.NewReader(data))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("expected the data to go through untouched")
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected about a second, got %s", elapsed)
+	}
+}
+
+func TestLimiterShared(t *testing.T) {
+	const rate = 20000
+	l := NewLimiter(rate)
+	// Drain the initial burst so only the rate counts.
+	l.wait(context.Background(), rate)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, l.Reader(context.Background(), bytes.NewReader(make([]byte, rate/4))))
+		}()
+	}
+	wg.Wait()
+	// Four readers of a quarter of the rate each take a second together.
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected about a second, got %s", elapsed)
+	}
+}
+
+func TestLimiterCancelled(t *testing.T) {
+	// 10 bytes go through at once, the rest would take 10 seconds.
+	l := NewLimiter(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := io.Copy(io.Discard, l.Reader(ctx, strings.NewReader(strings.Repeat("slow", 25))))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected cancellation to stop the wait")
+	}
+}
+
+func TestDownloadWithLimiter(t *testing.T) {
+	const rate = 20000
+	content := strings.Repeat("a", 2*rate)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	}))
+	defer ts.Close()
+
+	d := newTestDownloader(0)
+	d.Limiter = NewLimiter(rate)
+	start := time.Now()
+	f, err := d.Download(context.Background(), t.TempDir(), ts.URL+"/file")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("expected the download to be throttled, took %s", elapsed)
+	}
+	got, _ := os.ReadFile(f)
+	if string(got) != content {
+		t.Errorf("expected %d bytes, got %d", len(content), len(got))
+	}
+}
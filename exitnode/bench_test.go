@@ -0,0 +1,82 @@
+package exitnode_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+// year is a synthetic year of exit lists, a list a day of 1500 nodes: a
+// 24th of what CollecTor publishes, the cost of a real year is 24 times
+// the one of a year op.
+var year = sync.OnceValues(func() ([][]byte, error) {
+	var lists [][]byte
+	for m := 1; m <= 12; m++ {
+		month, err := collectortest.Lists(fmt.Sprintf("2024-%02d", m), 1, 1500)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range month {
+			lists = append(lists, exitnode.Marshal(l.Downloaded, l.Nodes))
+		}
+	}
+	return lists, nil
+})
+
+func BenchmarkUnmarshal(b *testing.B) {
+	lists, err := year()
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	bench := func(lists [][]byte) func(*testing.B) {
+		return func(b *testing.B) {
+			size := 0
+			for _, l := range lists {
+				size += len(l)
+			}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, l := range lists {
+					if _, err := exitnode.Unmarshal(bufio.NewReader(bytes.NewReader(l))); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+			}
+		}
+	}
+	b.Run("list", bench(lists[:1]))
+	b.Run("year", bench(lists))
+}
+
+func BenchmarkParser(b *testing.B) {
+	lists, err := year()
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	bench := func(lists [][]byte) func(*testing.B) {
+		return func(b *testing.B) {
+			size := 0
+			for _, l := range lists {
+				size += len(l)
+			}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			var p exitnode.Parser
+			for i := 0; i < b.N; i++ {
+				for _, l := range lists {
+					if _, err := p.Parse(bytes.NewReader(l)); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+			}
+		}
+	}
+	b.Run("list", bench(lists[:1]))
+	b.Run("year", bench(lists))
+}
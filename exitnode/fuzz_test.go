@@ -0,0 +1,90 @@
+package exitnode
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// samples returns the exit lists in testdata, as published by CollecTor.
+func samples(tb testing.TB) [][]byte {
+	tb.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "20*"))
+	if err != nil || len(paths) == 0 {
+		tb.Fatalf("expected samples in testdata, got: %v", err)
+	}
+	var lists [][]byte
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			tb.Fatalf("unexpected error: %v", err)
+		}
+		lists = append(lists, b)
+	}
+	return lists
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, b := range samples(f) {
+		f.Add(b)
+		f.Add(bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n")))
+		f.Add(bytes.ReplaceAll(b, []byte(" "), []byte("\t ")))
+		f.Add(b[:len(b)/2])
+	}
+	f.Add([]byte("Published\nExitAddress 1.2.3.4\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		nodes, err := Unmarshal(bufio.NewReader(bytes.NewReader(b)))
+
+		// Lines longer than the buffer are read the same, in pieces.
+		small, smallErr := Unmarshal(bufio.NewReaderSize(bytes.NewReader(b), 16))
+		if (err == nil) != (smallErr == nil) || !reflect.DeepEqual(nodes, small) {
+			t.Fatalf("a small buffer reads %v, %v instead of %v, %v", small, smallErr, nodes, err)
+		}
+		if err != nil {
+			return
+		}
+
+		// What was read writes back to a list reading the same.
+		list := Marshal(time.Time{}, nodes)
+		again, err := Unmarshal(bufio.NewReader(bytes.NewReader(list)))
+		if err != nil {
+			t.Fatalf("unexpected error reading back %q: %v", list, err)
+		}
+		if b := Marshal(time.Time{}, again); !bytes.Equal(b, list) {
+			t.Fatalf("expected %q, got %q", list, b)
+		}
+	})
+}
+
+func FuzzParseTime(f *testing.F) {
+	for _, b := range samples(f) {
+		for _, line := range strings.Split(string(b), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 3 {
+				f.Add(fields[len(fields)-2], fields[len(fields)-1])
+			}
+		}
+	}
+	f.Add("2024-02-30", "24:00:00")
+	f.Add("2024-01-30", "10:21:54.999999999")
+
+	f.Fuzz(func(t *testing.T, date, clock string) {
+		u, err := parseTime(date, clock)
+		if err != nil {
+			return
+		}
+		if u.Location() != time.UTC {
+			t.Fatalf("expected UTC, got %v", u.Location())
+		}
+		// Written back, the time reads the same, to the second.
+		again, err := parseTime(u.Format("2006-01-02"), u.Format("15:04:05"))
+		if err != nil || !again.Equal(u.Truncate(time.Second)) {
+			t.Fatalf("expected %v, got %v, %v", u.Truncate(time.Second), again, err)
+		}
+	})
+}
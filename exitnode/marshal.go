@@ -0,0 +1,73 @@
+package exitnode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// timeLayout is how exit lists write times, always in UTC.
+const timeLayout = "2006-01-02 15:04:05"
+
+// Writer writes exit lists in the format Unmarshal reads, the one CollecTor
+// publishes: a header with the time the list was downloaded, then the nodes.
+type Writer struct {
+	w          *bufio.Writer
+	downloaded time.Time
+	header     bool
+}
+
+// NewWriter returns a Writer of an exit list downloaded at downloaded.
+func NewWriter(w io.Writer, downloaded time.Time) *Writer {
+	return &Writer{w: bufio.NewWriter(w), downloaded: downloaded}
+}
+
+// Write writes n, after the header if it is the first node.
+func (w *Writer) Write(n ExitNode) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w.w, "ExitNode %s\nPublished %s\nLastStatus %s\n",
+		n.ExitNode, n.Published.UTC().Format(timeLayout), n.LastStatus.UTC().Format(timeLayout))
+	if err != nil {
+		return err
+	}
+	for _, a := range n.ExitAddresses {
+		if _, err := fmt.Fprintf(w.w, "ExitAddress %s %s\n", a.ExitAddress, a.UpdatedAt.UTC().Format(timeLayout)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes what is buffered, the header alone for a list without
+// nodes.
+func (w *Writer) Flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	_, err := fmt.Fprintf(w.w, "@type tordnsel 1.0\nDownloaded %s\n", w.downloaded.UTC().Format(timeLayout))
+	return err
+}
+
+// Marshal returns the exit list of nodes downloaded at downloaded.
+func Marshal(downloaded time.Time, nodes []ExitNode) []byte {
+	var b bytes.Buffer
+	w := NewWriter(&b, downloaded)
+	// Writing to memory does not fail.
+	for _, n := range nodes {
+		w.Write(n)
+	}
+	w.Flush()
+	return b.Bytes()
+}
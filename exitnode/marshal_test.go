@@ -0,0 +1,69 @@
+package exitnode
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshal(t *testing.T) {
+	at := func(s string) time.Time {
+		u, _ := time.Parse(time.RFC3339, s)
+		return u
+	}
+	nodes := []ExitNode{
+		{
+			ExitNode:   "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75",
+			Published:  at("2024-01-30T00:10:50Z"),
+			LastStatus: at("2024-01-30T10:00:00Z"),
+			ExitAddresses: []ExitAddress{
+				{ExitAddress: "185.241.208.231", UpdatedAt: at("2024-01-30T10:21:54Z"), Addr: netip.MustParseAddr("185.241.208.231")},
+				{ExitAddress: "185.241.208.232", UpdatedAt: at("2024-01-30T10:21:55Z"), Addr: netip.MustParseAddr("185.241.208.232")},
+			},
+		},
+		{
+			ExitNode:      "23B49521BDC4588C7CCF3C38E552504118326B66",
+			Published:     at("2024-01-30T05:44:30Z"),
+			LastStatus:    at("2024-01-30T11:00:00Z"),
+			ExitAddresses: []ExitAddress{{ExitAddress: "194.26.192.64", UpdatedAt: at("2024-01-30T11:30:06Z"), Addr: netip.MustParseAddr("194.26.192.64")}},
+		},
+	}
+
+	gold := `@type tordnsel 1.0
+Downloaded 2024-01-30 13:02:00
+ExitNode FE39F07EBE7870DCE124AB30DF3ABD0700A43F75
+Published 2024-01-30 00:10:50
+LastStatus 2024-01-30 10:00:00
+ExitAddress 185.241.208.231 2024-01-30 10:21:54
+ExitAddress 185.241.208.232 2024-01-30 10:21:55
+ExitNode 23B49521BDC4588C7CCF3C38E552504118326B66
+Published 2024-01-30 05:44:30
+LastStatus 2024-01-30 11:00:00
+ExitAddress 194.26.192.64 2024-01-30 11:30:06
+`
+	// Times in another zone are written in UTC all the same.
+	b := Marshal(at("2024-01-30T13:02:00Z").In(time.FixedZone("CET", 3600)), nodes)
+	if string(b) != gold {
+		t.Fatalf("Expected \n%s, got: \n%s", gold, b)
+	}
+
+	// What is written reads back the same.
+	got, err := Unmarshal(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, nodes) {
+		t.Errorf("expected %+v, got %+v", nodes, got)
+	}
+}
+
+func TestMarshalEmpty(t *testing.T) {
+	downloaded, _ := time.Parse(time.RFC3339, "2024-01-30T13:02:00Z")
+	b := Marshal(downloaded, nil)
+	if string(b) != "@type tordnsel 1.0\nDownloaded 2024-01-30 13:02:00\n" {
+		t.Errorf("expected the header alone, got: %s", b)
+	}
+}
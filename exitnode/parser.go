@@ -0,0 +1,326 @@
+package exitnode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Parser is Unmarshal for many lists: it returns the same nodes and errors
+// at a fraction of the allocations. Lines are parsed in place in the read
+// buffer, times with a fixed layout parser, and the fingerprints and
+// addresses are interned: a relay shows up in every list of a year, its
+// strings are allocated once.
+//
+// The zero value is ready to use. A Parser is not safe for concurrent use
+// and keeps the strings it has seen as long as it is alive, use one per
+// goroutine for a batch of lists.
+type Parser struct {
+	r *bufio.Reader
+	// long holds the lines longer than the buffer of r.
+	long []byte
+	// err is a read error that came along with the last line, returned by
+	// the next call to readLine.
+	err error
+	// fingerprints and others intern strings by value, addresses by the
+	// IPv4 address they spell.
+	fingerprints map[string]string
+	addresses    map[netip.Addr]string
+	others       map[string]string
+	// date is the last date parsed and day its start.
+	date [10]byte
+	day  time.Time
+}
+
+// Parse reads the exit list in r, see Unmarshal.
+func (p *Parser) Parse(r io.Reader) ([]ExitNode, error) {
+	if p.r == nil {
+		p.r = bufio.NewReader(r)
+		p.fingerprints = map[string]string{}
+		p.addresses = map[netip.Addr]string{}
+		p.others = map[string]string{}
+	} else {
+		p.r.Reset(r)
+	}
+	p.err = nil
+	// Drop the reader once done, not to keep it alive along with p.
+	defer p.r.Reset(nil)
+
+	exitNodes := []ExitNode{}
+	var exitNode ExitNode
+	// The addresses of all the nodes of the list go in a single array, each
+	// node gets its own part with no room to grow into the next one.
+	var addresses []ExitAddress
+	first := 0
+	flush := func() {
+		if exitNode.ExitNode != "" {
+			if len(addresses) > first {
+				exitNode.ExitAddresses = addresses[first:len(addresses):len(addresses)]
+			}
+			exitNodes = append(exitNodes, exitNode)
+		}
+		first = len(addresses)
+	}
+
+	var fields [4][]byte
+	lineNumber := 0
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			if err == io.EOF {
+				flush()
+				break
+			}
+			if err == errLineTooLong {
+				return nil, &ParseError{Line: lineNumber + 1, Err: err}
+			}
+			return nil, err
+		}
+		lineNumber++
+
+		n := split(line, &fields)
+		if n == 0 {
+			continue
+		}
+		key, values := fields[0], fields[1:n]
+		// The number of values is exact when there are not enough of them.
+		if want := arity(string(key)); len(values) < want {
+			return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field %s wants %d values, got %d", key, want, len(values))}
+		}
+
+		switch string(key) {
+		case "ExitNode":
+			flush()
+			exitNode = ExitNode{ExitNode: intern(p.fingerprints, values[0])}
+		case "Published":
+			u, err := p.parseTime(values[0], values[1])
+			if err != nil {
+				return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field Published date parse error: %w", err)}
+			}
+			exitNode.Published = u
+		case "LastStatus":
+			u, err := p.parseTime(values[0], values[1])
+			if err != nil {
+				return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field LastStatus date parse error: %w", err)}
+			}
+			exitNode.LastStatus = u
+		case "ExitAddress":
+			u, err := p.parseTime(values[1], values[2])
+			if err != nil {
+				return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field ExitAddress date parse error: %w", err)}
+			}
+			address, addr := p.address(values[0])
+			addresses = append(addresses, ExitAddress{ExitAddress: address, UpdatedAt: u, Addr: addr})
+		}
+	}
+	return exitNodes, nil
+}
+
+// readLine returns the next line the way readLine does for Unmarshal,
+// without a copy unless it is longer than the buffer. It is valid until the
+// next call.
+func (p *Parser) readLine() ([]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	line, err := p.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		p.long = append(p.long[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = p.r.ReadSlice('\n')
+			if len(line) == 0 && err != nil && err != io.EOF {
+				return nil, err
+			}
+			p.long = append(p.long, line...)
+			// Even without its line ending the line is too long.
+			if len(p.long) > MaxLineLength+2 {
+				return nil, errLineTooLong
+			}
+		}
+		line = p.long
+	}
+	if len(line) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	// The last line may have no line ending: EOF comes after it. Any other
+	// error is kept for the next call, the bufio.Reader forgets it once
+	// returned and would report EOF instead.
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	if line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+	}
+	if len(line) > MaxLineLength {
+		return nil, errLineTooLong
+	}
+	return line, nil
+}
+
+// split puts the first fields of line in fields and returns how many,
+// splitting on whitespace like strings.Fields.
+func split(line []byte, fields *[4][]byte) int {
+	for _, c := range line {
+		if c >= 0x80 {
+			// Unicode spaces, like a no-break space: leave them to
+			// strings.Fields, they are not in the lists of CollecTor.
+			n := 0
+			for _, f := range strings.Fields(string(line)) {
+				if n == len(fields) {
+					break
+				}
+				fields[n] = []byte(f)
+				n++
+			}
+			return n
+		}
+	}
+	n := 0
+	for i := 0; i < len(line) && n < len(fields); {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		start := i
+		for i < len(line) && !isSpace(line[i]) {
+			i++
+		}
+		if i > start {
+			fields[n] = line[start:i]
+			n++
+		}
+	}
+	return n
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+// intern returns b as a string, the same string every time.
+func intern(m map[string]string, b []byte) string {
+	if s, ok := m[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	m[s] = s
+	return s
+}
+
+// address interns an exit address and returns it parsed too. Exit lists
+// only have IPv4 addresses, written the usual way: they are interned by
+// netip.Addr, any other string by value and parsed by netip.ParseAddr.
+func (p *Parser) address(b []byte) (string, netip.Addr) {
+	addr, ok := parseIPv4(b)
+	if !ok {
+		s := intern(p.others, b)
+		addr, _ = netip.ParseAddr(s)
+		return s, addr
+	}
+	if s, ok := p.addresses[addr]; ok {
+		return s, addr
+	}
+	s := string(b)
+	p.addresses[addr] = s
+	return s, addr
+}
+
+// parseIPv4 parses a dotted decimal IPv4 address written the way
+// netip.Addr.String writes it back, with no leading zeros: anything else
+// must keep its own spelling.
+func parseIPv4(b []byte) (netip.Addr, bool) {
+	var ip [4]byte
+	octet := 0
+	digits := 0
+	value := 0
+	for i := 0; i <= len(b); i++ {
+		if i == len(b) || b[i] == '.' {
+			if digits == 0 || octet == 4 {
+				return netip.Addr{}, false
+			}
+			ip[octet] = byte(value)
+			octet++
+			digits, value = 0, 0
+			continue
+		}
+		c := b[i]
+		if c < '0' || c > '9' || (digits == 1 && value == 0) {
+			return netip.Addr{}, false
+		}
+		value = value*10 + int(c-'0')
+		digits++
+		if value > 255 {
+			return netip.Addr{}, false
+		}
+	}
+	if octet != 4 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFrom4(ip), true
+}
+
+// parseTime is parseTime for the fixed layout of the exit lists, like
+// 2024-01-30 and 10:21:54. Anything else, fractions of a second or a bad
+// date, goes through parseTime for the same result and the same error.
+func (p *Parser) parseTime(date, clock []byte) (time.Time, error) {
+	if len(clock) == 8 && clock[2] == ':' && clock[5] == ':' {
+		hour, ok1 := atoi(clock[0:2])
+		minute, ok2 := atoi(clock[3:5])
+		second, ok3 := atoi(clock[6:8])
+		if ok1 && ok2 && ok3 && hour < 24 && minute < 60 && second < 60 {
+			if midnight, ok := p.midnight(date); ok {
+				return midnight.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second), nil
+			}
+		}
+	}
+	return parseTime(string(date), string(clock))
+}
+
+// midnight returns the start of date, like 2024-01-30, in UTC. The lines of
+// a list are all of a day or two: the last one is kept.
+func (p *Parser) midnight(date []byte) (time.Time, bool) {
+	if string(date) == string(p.date[:]) && !p.day.IsZero() {
+		return p.day, true
+	}
+	if len(date) != 10 || date[4] != '-' || date[7] != '-' {
+		return time.Time{}, false
+	}
+	year, ok1 := atoi(date[0:4])
+	month, ok2 := atoi(date[5:7])
+	day, ok3 := atoi(date[8:10])
+	if !ok1 || !ok2 || !ok3 || month < 1 || month > 12 || day < 1 {
+		return time.Time{}, false
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	// Days past the end of the month are normalized by time.Date.
+	if t.Day() != day {
+		return time.Time{}, false
+	}
+	copy(p.date[:], date)
+	p.day = t
+	return t, true
+}
+
+// atoi parses the decimal digits of b.
+func atoi(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
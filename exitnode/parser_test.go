@@ -0,0 +1,172 @@
+package exitnode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unsafe"
+)
+
+// same fails t when Parser does not return what Unmarshal returns for list.
+func same(t *testing.T, p *Parser, list []byte) {
+	t.Helper()
+	expected, expectedErr := Unmarshal(bufio.NewReader(bytes.NewReader(list)))
+	got, err := p.Parse(bytes.NewReader(list))
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v for %q", expected, got, list)
+	}
+	if (err == nil) != (expectedErr == nil) || err != nil && err.Error() != expectedErr.Error() {
+		t.Fatalf("expected error %v, got %v for %q", expectedErr, err, list)
+	}
+	var parse, expectedParse *ParseError
+	if errors.As(err, &parse) != errors.As(expectedErr, &expectedParse) || parse != nil && parse.Line != expectedParse.Line {
+		t.Fatalf("expected %#v, got %#v for %q", expectedErr, err, list)
+	}
+}
+
+func TestParserSameAsUnmarshal(t *testing.T) {
+	header := "@type tordnsel 1.0\nDownloaded 2024-01-30 13:02:00\n"
+	node := "ExitNode FE39F07EBE7870DCE124AB30DF3ABD0700A43F75\nPublished 2024-01-30 00:10:50\nLastStatus 2024-01-30 10:00:00\n"
+	tests := []struct {
+		name string
+		list string
+	}{
+		{"empty", ""},
+		{"header only", header},
+		{"node", header + node + "ExitAddress 185.241.208.231 2024-01-30 10:21:54\n"},
+		{"node without address", header + node},
+		{"no line ending", header + node + "ExitAddress 185.241.208.231 2024-01-30 10:21:54"},
+		{"crlf", strings.ReplaceAll(header+node+"ExitAddress 185.241.208.231 2024-01-30 10:21:54\n", "\n", "\r\n")},
+		{"lone cr", header + node + "ExitAddress 185.241.208.231 2024-01-30 10:21:54\r"},
+		{"tabs and spaces", "\tExitNode  AAAA \v\nPublished\t2024-01-30 \f00:10:50\n\n  \nExitAddress 1.2.3.4 2024-01-30 10:21:54 extra\n"},
+		{"unicode spaces", "ExitNode\u00a0AAAA\u2003BBBB\nExitAddress 1.2.3.4\u00a02024-01-30 10:21:54\n"},
+		{"invalid utf-8", "ExitNode \xff\x85AAAA\n"},
+		{"fraction of a second", header + "ExitNode AAAA\nPublished 2024-01-30 00:10:50.999\n"},
+		{"leap day", header + "ExitNode AAAA\nPublished 2024-02-29 00:10:50\n"},
+		{"no leap day", header + "ExitNode AAAA\nPublished 2023-02-29 00:10:50\n"},
+		{"hour 24", header + "ExitNode AAAA\nLastStatus 2024-01-30 24:00:00\n"},
+		{"second 60", header + "ExitNode AAAA\nLastStatus 2024-01-30 23:59:60\n"},
+		{"month 13", header + "ExitNode AAAA\nExitAddress 1.2.3.4 2024-13-30 10:00:00\n"},
+		{"year 0", header + "ExitNode AAAA\nPublished 0000-01-01 00:00:00\n"},
+		{"signs", header + "ExitNode AAAA\nPublished +024-01-30 00:10:50\n"},
+		{"missing values", header + "ExitNode AAAA\nExitAddress 1.2.3.4 2024-01-30\n"},
+		{"missing fingerprint", header + "ExitNode\n"},
+		{"addresses before a node", header + "ExitAddress 1.2.3.4 2024-01-30 10:21:54\n" + node},
+		{"odd addresses", header + node + "ExitAddress 01.2.3.4 2024-01-30 10:21:54\nExitAddress 1.2.3.4.5 2024-01-30 10:21:54\nExitAddress 256.1.1.1 2024-01-30 10:21:54\nExitAddress 2001:db8::1 2024-01-30 10:21:54\nExitAddress 1.2.3. 2024-01-30 10:21:54\n"},
+		{"long line", header + "Contact " + strings.Repeat("x", 5000) + "\n" + node},
+		{"long node", header + "ExitNode " + strings.Repeat("F", 5000) + "\r\nExitAddress 1.2.3.4 2024-01-30 10:21:54"},
+		{"longest line", header + strings.Repeat("x", MaxLineLength) + "\n"},
+		{"longest line crlf", header + strings.Repeat("x", MaxLineLength) + "\r\n"},
+		{"too long", header + strings.Repeat("x", MaxLineLength+1) + "\n" + node},
+		{"too long crlf", header + strings.Repeat("x", MaxLineLength) + "\r\r\n"},
+		{"too long at the end", header + strings.Repeat("x", MaxLineLength+1)},
+	}
+	// One parser for all: what it interned must not leak in the next list.
+	var p Parser
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			same(t, &p, []byte(tt.list))
+		})
+	}
+}
+
+func TestParserSamples(t *testing.T) {
+	var p Parser
+	for _, b := range samples(t) {
+		same(t, &p, b)
+		same(t, &p, b)
+	}
+}
+
+// TestParserReadError checks that a read error coming along with a last line
+// without line ending is not mistaken for the end of the list.
+func TestParserReadError(t *testing.T) {
+	list := "ExitNode AAAA\nPublished 2024-01-01 00:00:00\nExitAddress 1.2.3.4 2024-01-01 00:00:00"
+	var p Parser
+	_, err := p.Parse(iotest.TimeoutReader(strings.NewReader(list)))
+	if !errors.Is(err, iotest.ErrTimeout) {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+	// The error does not stick to the Parser.
+	if _, err := p.Parse(strings.NewReader(list)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParserInterns(t *testing.T) {
+	list := []byte("ExitNode AAAA\nExitAddress 1.2.3.4 2024-01-30 10:21:54\nExitAddress 1.2.3.4 2024-01-30 11:21:54\n")
+	var p Parser
+	first, err := p.Parse(bytes.NewReader(list))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := p.Parse(bytes.NewReader(list))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a, b := first[0].ExitAddresses, second[0].ExitAddresses
+	if unsafe.StringData(first[0].ExitNode) != unsafe.StringData(second[0].ExitNode) ||
+		unsafe.StringData(a[0].ExitAddress) != unsafe.StringData(a[1].ExitAddress) ||
+		unsafe.StringData(a[0].ExitAddress) != unsafe.StringData(b[0].ExitAddress) {
+		t.Errorf("expected the strings to be shared")
+	}
+}
+
+func TestParserAllocs(t *testing.T) {
+	lists := samples(t)
+	var big bytes.Buffer
+	big.Write(lists[0])
+	for i := 0; i < 1000; i++ {
+		// The same node over and over, like a relay over a year.
+		big.Write(lists[0][bytes.Index(lists[0], []byte("ExitNode")):])
+	}
+	var p Parser
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, err := p.Parse(bytes.NewReader(big.Bytes())); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	// Only the slices of the nodes and of the addresses growing, a few
+	// dozens of times for a thousand nodes.
+	if allocs > 50 {
+		t.Errorf("expected at most 50 allocations, got %v", allocs)
+	}
+}
+
+func FuzzParser(f *testing.F) {
+	for _, b := range samples(f) {
+		f.Add(b)
+		f.Add(bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n")))
+		f.Add(bytes.ReplaceAll(b, []byte(" "), []byte("\u00a0")))
+	}
+	f.Add([]byte("ExitNode AAAA\nPublished 2024-02-30 00:00:00.5\nExitAddress 01.2.3.4 2024-01-30 10:21:54\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var p Parser
+		same(t, &p, b)
+		// Again with what the first parse interned.
+		same(t, &p, b)
+	})
+}
+
+func FuzzParserParseTime(f *testing.F) {
+	f.Add("2024-01-30", "10:21:54")
+	f.Add("2024-02-29", "23:59:59")
+	f.Add("2023-02-29", "24:00:60")
+	f.Add("2024-01-30", "10:21:54.999")
+	f.Add("+024-01-30", "1:21:540")
+
+	// One parser for all, with the last date it parsed.
+	var p Parser
+	f.Fuzz(func(t *testing.T, date, clock string) {
+		expected, expectedErr := parseTime(date, clock)
+		got, err := p.parseTime([]byte(date), []byte(clock))
+		if !reflect.DeepEqual(got, expected) || (err == nil) != (expectedErr == nil) || err != nil && err.Error() != expectedErr.Error() {
+			t.Fatalf("expected %v, %v, got %v, %v", expected, expectedErr, got, err)
+		}
+	})
+}
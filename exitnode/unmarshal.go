@@ -2,8 +2,11 @@ package exitnode
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"strings"
 	"time"
 )
@@ -18,14 +21,41 @@ type ExitNode struct {
 type ExitAddress struct {
 	ExitAddress string    `json:"ExitAddress"`
 	UpdatedAt   time.Time `json:"UpdatedAt"`
+	// Addr is ExitAddress parsed, the zero Addr when it is not an IP
+	// address. It is left out of the JSON, ExitAddress says it all.
+	Addr netip.Addr `json:"-"`
 }
 
+// ParseError is a line of an exit list that could not be parsed.
+type ParseError struct {
+	// Line is the line number, starting from 1.
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MaxLineLength is the longest line Unmarshal reads, well over anything an
+// exit list has: a longer one fails the parsing rather than filling the
+// memory.
+const MaxLineLength = 64 << 10
+
+// Unmarshal reads the exit list in r, the tordnsel format of CollecTor. The
+// fields of a line are separated by any run of spaces or tabs and CRLF line
+// endings are fine. Lines with an unknown keyword are skipped, a known one
+// with missing fields or a bad date fails with a ParseError.
 func Unmarshal(r *bufio.Reader) ([]ExitNode, error) {
 	exitNodes := []ExitNode{}
 	var exitNode ExitNode
+	lineNumber := 0
 	for {
-		// Reading a line, lines are short so we don't worry about getting truncated/prefixes.
-		line, _, err := r.ReadLine()
+		line, err := readLine(r)
 		if err != nil {
 			if err == io.EOF {
 				if exitNode.ExitNode != "" {
@@ -33,22 +63,24 @@ func Unmarshal(r *bufio.Reader) ([]ExitNode, error) {
 				}
 				break
 			}
+			if errors.Is(err, errLineTooLong) {
+				return nil, &ParseError{Line: lineNumber + 1, Err: err}
+			}
 			return nil, err
 		}
+		lineNumber++
 
-		// here starts marshaller logic
-		split := strings.Split(string(line), " ")
-		key := split[0]
-		// here I'm removing the key from the line to get a number of values (could be 1, 2, or 3 values depending on the entry).
-		value := strings.Replace(string(line), key+" ", "", 1)
-		// Here I'm splitting the value part, and I'm sure that at least every line type is going to have at least one value.
-		values := strings.Split(value, " ")
+		// The keyword, then the values: 1, 2 or 3 depending on the entry.
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		key, values := fields[0], fields[1:]
+		if want := arity(key); len(values) < want {
+			return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field %s wants %d values, got %d", key, want, len(values))}
+		}
 
 		switch key {
-		//headers, so we skip
-		case "@type":
-		case "Downloaded":
-			continue
 		case "ExitNode":
 			// If the current ExitNode is not empty, we append it in the list and we move on with a new one.
 			if exitNode.ExitNode != "" {
@@ -58,31 +90,81 @@ func Unmarshal(r *bufio.Reader) ([]ExitNode, error) {
 			exitNode = ExitNode{}
 			exitNode.ExitNode = values[0]
 		case "Published":
-			u, err := time.Parse(time.RFC3339, values[0]+"T"+values[1]+"Z")
+			u, err := parseTime(values[0], values[1])
 			if err != nil {
-				return nil, fmt.Errorf("field Published date parse error: %w", err)
+				return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field Published date parse error: %w", err)}
 			}
 			exitNode.Published = u
 		case "LastStatus":
-			u, err := time.Parse(time.RFC3339, values[0]+"T"+values[1]+"Z")
+			u, err := parseTime(values[0], values[1])
 			if err != nil {
-				return nil, fmt.Errorf("field LastStatus date parse error: %w", err)
+				return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field LastStatus date parse error: %w", err)}
 			}
 			exitNode.LastStatus = u
 		case "ExitAddress":
-			u, err := time.Parse(time.RFC3339, values[1]+"T"+values[2]+"Z")
+			u, err := parseTime(values[1], values[2])
 			if err != nil {
-				return nil, fmt.Errorf("field ExitAddress date parse error: %w", err)
+				return nil, &ParseError{Line: lineNumber, Err: fmt.Errorf("field ExitAddress date parse error: %w", err)}
 			}
+			// An odd address is kept as is, with no Addr.
+			addr, _ := netip.ParseAddr(values[0])
 			e := ExitAddress{
 				ExitAddress: values[0],
 				UpdatedAt:   u,
+				Addr:        addr,
 			}
 			exitNode.ExitAddresses = append(exitNode.ExitAddresses, e)
 		default:
-			// skip
-			// fmt.Println(key)
+			// The @type and Downloaded headers, and whatever a later version
+			// of the format adds.
 		}
 	}
 	return exitNodes, nil
 }
+
+// arity is how many values the entry key needs, 0 for the ones skipped.
+func arity(key string) int {
+	switch key {
+	case "ExitNode":
+		return 1
+	case "Published", "LastStatus":
+		return 2
+	case "ExitAddress":
+		return 3
+	}
+	return 0
+}
+
+// parseTime parses the date and the time of an exit list entry, like
+// 2024-01-30 and 10:21:54, always in UTC.
+func parseTime(date, clock string) (time.Time, error) {
+	return time.Parse(timeLayout, date+" "+clock)
+}
+
+var errLineTooLong = fmt.Errorf("line longer than %d bytes", MaxLineLength)
+
+// readLine returns the next line of r without its line ending. ReadLine
+// returns lines longer than the buffer of r in pieces: they are put back
+// together, up to MaxLineLength.
+func readLine(r *bufio.Reader) (string, error) {
+	line, isPrefix, err := r.ReadLine()
+	if err != nil || !isPrefix {
+		return string(line), err
+	}
+	long := bytes.Clone(line)
+	for isPrefix {
+		line, isPrefix, err = r.ReadLine()
+		// The last line may have no line ending: EOF comes after it.
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		long = append(long, line...)
+		if len(long) > MaxLineLength {
+			return "", errLineTooLong
+		}
+	}
+	return string(long), nil
+}
@@ -2,6 +2,9 @@ package exitnode
 
 import (
 	"bufio"
+	"errors"
+	"net/netip"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -98,7 +101,96 @@ ExitAddress 185.241.208.231 ERROR-01-30 10:21:54
 			if err == nil || !strings.Contains(err.Error(), tt.expectedErrorContains) {
 				t.Errorf("marshall expected error should contain %v", tt.expectedErrorContains)
 			}
+			// The bad line is the one with the ERROR date.
+			line := strings.Count(tt.torNodes[:strings.Index(tt.torNodes, "ERROR")], "\n") + 1
+			var parse *ParseError
+			if !errors.As(err, &parse) || parse.Line != line {
+				t.Errorf("expected a ParseError on line %d, got: %v", line, err)
+			}
+		})
+
+	}
+}
+
+func TestUnmarshalOddWhitespace(t *testing.T) {
+	list := "@type tordnsel 1.0\r\n" +
+		"Downloaded 2024-01-30 13:02:00\r\n" +
+		"\r\n" +
+		"ExitNode\tFE39F07EBE7870DCE124AB30DF3ABD0700A43F75  \r\n" +
+		"Published  2024-01-30\t00:10:50\r\n" +
+		" LastStatus 2024-01-30 10:00:00\r\n" +
+		"ExitAddress 185.241.208.231  2024-01-30 10:21:54"
+	exitNodes, err := Unmarshal(bufio.NewReader(strings.NewReader(list)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	at := func(s string) time.Time {
+		u, _ := time.Parse(time.RFC3339, s)
+		return u
+	}
+	expected := []ExitNode{{
+		ExitNode:      "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75",
+		Published:     at("2024-01-30T00:10:50Z"),
+		LastStatus:    at("2024-01-30T10:00:00Z"),
+		ExitAddresses: []ExitAddress{{ExitAddress: "185.241.208.231", UpdatedAt: at("2024-01-30T10:21:54Z"), Addr: netip.MustParseAddr("185.241.208.231")}},
+	}}
+	if !reflect.DeepEqual(exitNodes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, exitNodes)
+	}
+}
+
+func TestUnmarshalAddr(t *testing.T) {
+	list := "ExitNode AAAA\n" +
+		"ExitAddress 185.241.208.231 2024-01-30 10:21:54\n" +
+		"ExitAddress 2001:db8::1 2024-01-30 10:21:54\n" +
+		"ExitAddress 01.2.3.4 2024-01-30 10:21:54\n"
+	exitNodes, err := Unmarshal(bufio.NewReader(strings.NewReader(list)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// An address that does not parse is kept, with no Addr.
+	expected := []netip.Addr{netip.MustParseAddr("185.241.208.231"), netip.MustParseAddr("2001:db8::1"), {}}
+	for i, a := range exitNodes[0].ExitAddresses {
+		if a.Addr != expected[i] {
+			t.Errorf("expected %v for %s, got %v", expected[i], a.ExitAddress, a.Addr)
+		}
+	}
+}
+
+func TestUnmarshalErrorsOnMissingValues(t *testing.T) {
+	for _, line := range []string{"ExitNode", "Published 2024-01-30", "LastStatus", "ExitAddress 185.241.208.231 2024-01-30"} {
+		t.Run(line, func(t *testing.T) {
+			list := "@type tordnsel 1.0\nExitNode FE39F07EBE7870DCE124AB30DF3ABD0700A43F75\n" + line + "\n"
+			_, err := Unmarshal(bufio.NewReader(strings.NewReader(list)))
+			var parse *ParseError
+			if !errors.As(err, &parse) || parse.Line != 3 {
+				t.Errorf("expected a ParseError on line 3, got: %v", err)
+			}
 		})
+	}
+}
+
+func TestUnmarshalLongLines(t *testing.T) {
+	// Longer than the buffer, read in pieces by ReadLine.
+	fingerprint := strings.Repeat("F", 100)
+	list := "@type tordnsel 1.0\n" +
+		"Contact " + strings.Repeat("x", 100) + "\n" +
+		"ExitNode " + fingerprint + "\n" +
+		"ExitAddress 185.241.208.231 2024-01-30 10:21:54\n" +
+		"ExitNode " + fingerprint
+	exitNodes, err := Unmarshal(bufio.NewReaderSize(strings.NewReader(list), 16))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(exitNodes) != 2 || exitNodes[0].ExitNode != fingerprint || exitNodes[1].ExitNode != fingerprint || len(exitNodes[0].ExitAddresses) != 1 {
+		t.Errorf("expected two nodes with a long fingerprint, got %+v", exitNodes)
+	}
 
+	// Too long, whatever the line is.
+	list = "@type tordnsel 1.0\nContact " + strings.Repeat("x", MaxLineLength) + "\n"
+	_, err = Unmarshal(bufio.NewReader(strings.NewReader(list)))
+	var parse *ParseError
+	if !errors.As(err, &parse) || parse.Line != 2 {
+		t.Errorf("expected a ParseError on line 2, got: %v", err)
 	}
 }
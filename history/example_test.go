@@ -0,0 +1,77 @@
+package history_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/robizz/his-tor-y/history"
+)
+
+func ExampleNew() {
+	c, err := history.New(
+		history.WithSource(
+			"https://collector.torproject.org/archive/exit-lists/",
+			"https://mirror.example.com/exit-lists/exit-list-%s.tar.xz",
+		),
+		history.WithCacheDir("/var/cache/his-tor-y"),
+		history.WithHTTPClient(&http.Client{Timeout: 5 * time.Minute}),
+		history.WithConcurrency(2),
+		history.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, nil))),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_ = c
+}
+
+func ExampleClient_Search() {
+	c, err := history.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addr := netip.MustParseAddr("185.241.208.232")
+	r, err := c.Search(context.Background(), history.Query{
+		Prefix: netip.PrefixFrom(addr, addr.BitLen()),
+		From:   time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		To:     time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, n := range r.Nodes {
+		for _, a := range n.Addresses {
+			fmt.Println(n.Fingerprint, a.Addr, a.UpdatedAt)
+		}
+	}
+}
+
+func ExampleClient_Search_fingerprints() {
+	c, err := history.New(history.WithBestEffort())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r, err := c.Search(context.Background(), history.Query{
+		Fingerprints: []string{"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75"},
+		From:         time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC),
+		To:           time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil && !errors.Is(err, history.ErrPartial) {
+		log.Fatal(err)
+	}
+	// Some months may be missing, they tell why.
+	for _, m := range r.Months {
+		if m.Status != history.StatusOK {
+			fmt.Println(m.Month.Format("2006-01"), m.Status, m.Err)
+		}
+	}
+	fmt.Println(len(r.Nodes), "exit lists with the node")
+}
@@ -0,0 +1,317 @@
+// Package history searches the TOR exit lists published on CollecTor, month
+// by month, for the exit nodes that used some addresses or for the
+// addresses some nodes used.
+//
+// It is the library behind the his-tor-y command: a Client downloads the
+// monthly archives from the source, extracts and scans them, keeping the
+// archives in a cache dir if asked to.
+//
+//	c, err := history.New(history.WithCacheDir("/var/cache/his-tor-y"))
+//	...
+//	r, err := c.Search(ctx, history.Query{
+//		Prefix: netip.MustParsePrefix("185.241.208.0/24"),
+//		From:   time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+//		To:     time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC),
+//	})
+package history
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/robizz/his-tor-y/conf"
+	"github.com/robizz/his-tor-y/core"
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/xz"
+)
+
+// Errors returned by Search, to be checked with errors.Is.
+var (
+	// ErrInvalidInput is a query or an option that makes no sense.
+	ErrInvalidInput = core.ErrInvalidInput
+	// ErrCancelled is a search stopped by its context.
+	ErrCancelled = core.ErrCancelled
+	// ErrPartial comes with the Result of a WithBestEffort search where
+	// some months failed.
+	ErrPartial = core.ErrPartial
+	// ErrNotFound is a month missing from every source.
+	ErrNotFound = download.ErrNotFound
+	// ErrUnavailable is a source that cannot be reached or keeps failing.
+	ErrUnavailable = download.ErrUnavailable
+	// ErrCorrupt is an archive that cannot be extracted or parsed.
+	ErrCorrupt = xz.ErrCorrupt
+	// ErrChecksum is an archive not matching the digest its source sent,
+	// an ErrCorrupt too.
+	ErrChecksum = download.ErrChecksum
+)
+
+// Client searches the exit lists. It is safe for concurrent use: each
+// Search works in its own temporary directory, only the cache dir is
+// shared.
+type Client struct {
+	templates   []string
+	cacheDir    string
+	tempDir     string
+	httpClient  *http.Client
+	retries     int
+	concurrency int
+	bestEffort  bool
+	logger      *slog.Logger
+}
+
+// Option configures a Client, see New.
+type Option func(*Client)
+
+// WithSource sets where the monthly archives are downloaded from, CollecTor
+// by default. Each url is either a template with a %s in place of the
+// year-month, like
+// https://collector.torproject.org/archive/exit-lists/exit-list-%s.tar.xz,
+// or a base URL the archive file name is appended to. They are mirrors,
+// tried in order for each month.
+func WithSource(urls ...string) Option {
+	return func(c *Client) {
+		var e conf.ExitNode
+		if len(urls) > 0 {
+			e = conf.ExitNode{DownloadURLTemplate: urls[0], Mirrors: urls[1:]}
+		}
+		c.templates = e.URLTemplates()
+	}
+}
+
+// WithCacheDir keeps the archives in dir between searches. Past months are
+// then read from the cache and the current one is only downloaded again
+// when it changed. No cache by default.
+func WithCacheDir(dir string) Option {
+	return func(c *Client) {
+		c.cacheDir = dir
+	}
+}
+
+// WithTempDir sets where the temporary directory of each search goes, the
+// default of os.MkdirTemp otherwise. The exit lists are extracted there and
+// removed at the end of the search.
+func WithTempDir(dir string) Option {
+	return func(c *Client) {
+		c.tempDir = dir
+	}
+}
+
+// WithHTTPClient sets the HTTP client downloading the archives, with its
+// timeout and transport. http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithRetries sets how many times a failed download is retried, with
+// exponential backoff. download.DefaultRetries by default.
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// WithConcurrency sets how many months are pulled at the same time, 0 for no
+// limit. 4 by default.
+func WithConcurrency(n int) Option {
+	return func(c *Client) {
+		c.concurrency = n
+	}
+}
+
+// WithBestEffort makes a search return the nodes of the months that could
+// be pulled when others fail, along with ErrPartial, instead of failing.
+// The Status of each month tells which ones are missing.
+func WithBestEffort() Option {
+	return func(c *Client) {
+		c.bestEffort = true
+	}
+}
+
+// WithLogger sets where the downloads, the months pulled and the failures
+// are logged. Nothing is logged by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// New returns a Client searching CollecTor unless told otherwise by opts.
+func New(opts ...Option) (*Client, error) {
+	defaults := conf.Default()
+	c := &Client{
+		templates:   defaults.ExitNode.URLTemplates(),
+		retries:     download.DefaultRetries,
+		concurrency: defaults.Concurrency,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	switch {
+	case len(c.templates) == 0:
+		return nil, fmt.Errorf("%w: no source", ErrInvalidInput)
+	case c.retries < 0:
+		return nil, fmt.Errorf("%w: retries must be positive, got %d", ErrInvalidInput, c.retries)
+	case c.concurrency < 0:
+		return nil, fmt.Errorf("%w: concurrency must be positive, got %d", ErrInvalidInput, c.concurrency)
+	}
+	for _, t := range c.templates {
+		if strings.Count(t, "%s") != 1 {
+			return nil, fmt.Errorf("%w: source %q must have a single %%s", ErrInvalidInput, t)
+		}
+	}
+	return c, nil
+}
+
+// Query tells what to search. A node is found when it matches all of the
+// criteria set, at least one is needed.
+type Query struct {
+	// Prefix finds the nodes with an exit address in it, a single address
+	// is netip.PrefixFrom(addr, addr.BitLen()).
+	Prefix netip.Prefix
+	// Fingerprints finds the nodes by fingerprint, in any case.
+	Fingerprints []string
+	// From and To are the first and the last month searched, only the year
+	// and the month count, in UTC.
+	From, To time.Time
+}
+
+// match returns the core.Matcher of q.
+func (q Query) match() (core.Matcher, error) {
+	if !q.Prefix.IsValid() && len(q.Fingerprints) == 0 {
+		return nil, fmt.Errorf("%w: no prefix nor fingerprint to search", ErrInvalidInput)
+	}
+	prefix := q.Prefix.Masked()
+	fingerprints := make(map[string]bool, len(q.Fingerprints))
+	for _, f := range q.Fingerprints {
+		fingerprints[strings.ToUpper(f)] = true
+	}
+
+	return func(n exitnode.ExitNode) bool {
+		if len(fingerprints) > 0 && !fingerprints[strings.ToUpper(n.ExitNode)] {
+			return false
+		}
+		if !prefix.IsValid() {
+			return true
+		}
+		for _, a := range n.ExitAddresses {
+			if a.Addr.IsValid() && prefix.Contains(a.Addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Result is what a Search found, along with how each month was pulled.
+type Result struct {
+	// Nodes are the nodes found, the most recent first. A node shows up
+	// once per exit list it is in.
+	Nodes  []Node
+	Months []Month
+}
+
+// Node is an exit node as described by an exit list.
+type Node struct {
+	Fingerprint string
+	Published   time.Time
+	LastStatus  time.Time
+	// Addresses are all the exit addresses of the node, not only the ones
+	// in the Prefix of the query.
+	Addresses []Address
+}
+
+// Address is an exit address of a Node and when it was last seen.
+type Address struct {
+	Addr      netip.Addr
+	UpdatedAt time.Time
+}
+
+// Status tells how pulling a Month went.
+type Status = core.Status
+
+// Statuses of a Month.
+const (
+	StatusOK          = core.StatusOK
+	StatusMissing     = core.StatusMissing
+	StatusCorrupt     = core.StatusCorrupt
+	StatusUnavailable = core.StatusUnavailable
+	StatusCancelled   = core.StatusCancelled
+	StatusFailed      = core.StatusFailed
+)
+
+// Month tells where the exit lists of a month came from.
+type Month struct {
+	// Month is the first instant of the month, in UTC.
+	Month time.Time
+	// Source is the URL the archive was downloaded from, or "cache".
+	Source string
+	Status Status
+	// Err is why the month could not be pulled, nil when Status is
+	// StatusOK.
+	Err error
+}
+
+// yearDashMonth is how core names the months.
+const yearDashMonth = "2006-01"
+
+// Search pulls the months of q and returns the nodes matching it. With
+// WithBestEffort the Result comes along with ErrPartial when some months
+// failed.
+func (c *Client) Search(ctx context.Context, q Query) (*Result, error) {
+	match, err := q.match()
+	if err != nil {
+		return nil, err
+	}
+	if q.From.IsZero() || q.To.IsZero() {
+		return nil, fmt.Errorf("%w: no months to search", ErrInvalidInput)
+	}
+
+	d := download.New(c.httpClient)
+	d.Retries = c.retries
+	d.Logger = c.logger
+	r, err := core.Search(ctx, core.Options{
+		DownloadURLTemplates: c.templates,
+		CacheDir:             c.cacheDir,
+		TempDir:              c.tempDir,
+		Concurrency:          c.concurrency,
+		Downloader:           d,
+		Logger:               c.logger,
+		BestEffort:           c.bestEffort,
+	}, q.From.UTC().Format(yearDashMonth), q.To.UTC().Format(yearDashMonth), match)
+	if r == nil {
+		return nil, err
+	}
+	return result(r), err
+}
+
+// result turns what core found into typed values.
+func result(r *core.Result) *Result {
+	res := &Result{
+		Nodes:  make([]Node, len(r.Nodes)),
+		Months: make([]Month, len(r.Months)),
+	}
+	for i, n := range r.Nodes {
+		node := Node{Fingerprint: n.ExitNode, Published: n.Published, LastStatus: n.LastStatus}
+		for _, a := range n.ExitAddresses {
+			// Exit lists only have valid addresses, leave out any other.
+			if a.Addr.IsValid() {
+				node.Addresses = append(node.Addresses, Address{Addr: a.Addr, UpdatedAt: a.UpdatedAt})
+			}
+		}
+		res.Nodes[i] = node
+	}
+	for i, m := range r.Months {
+		month, _ := time.Parse(yearDashMonth, m.Date)
+		res.Months[i] = Month{Month: month, Source: m.Source, Status: m.Status, Err: m.Err}
+	}
+	return res
+}
@@ -0,0 +1,194 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/exitnode"
+)
+
+var (
+	january  = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	february = time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// newTestServer serves the archive of 2024-01, with three nodes, and a 404
+// for other months.
+func newTestServer(t *testing.T) *collectortest.Server {
+	t.Helper()
+	s := collectortest.NewServer()
+	t.Cleanup(s.Close)
+	err := s.Set("2024-01", collectortest.Month{Lists: []collectortest.List{{
+		Downloaded: time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC),
+		Nodes: []exitnode.ExitNode{
+			collectortest.Node("FE39F07EBE7870DCE124AB30DF3ABD0700A43F75", "185.241.208.232", time.Date(2023, time.December, 31, 23, 17, 34, 0, time.UTC)),
+			collectortest.Node("23B49521BDC4588C7CCF3C38E552504118326B66", "194.26.192.64", time.Date(2023, time.December, 31, 22, 19, 31, 0, time.UTC)),
+			collectortest.Node("64D74AAA74F30DC2CFB36343CE5D4451B9A4DBA8", "171.25.193.25", time.Date(2023, time.December, 31, 23, 5, 55, 0, time.UTC)),
+		},
+	}}})
+	if err != nil {
+		t.Fatalf("error setup server: %v", err)
+	}
+	return s
+}
+
+// base is the base URL of the archives of s, like a mirror is configured.
+func base(s *collectortest.Server) string {
+	return s.URL + path.Dir(collectortest.ArchivePath) + "/"
+}
+
+func TestSearch(t *testing.T) {
+	ts := newTestServer(t)
+	c, err := New(WithSource(base(ts)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected []string
+	}{
+		{"address", Query{Prefix: netip.MustParsePrefix("194.26.192.64/32")}, []string{"23B49521BDC4588C7CCF3C38E552504118326B66"}},
+		{"prefix", Query{Prefix: netip.MustParsePrefix("185.241.0.0/16")}, []string{"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75"}},
+		{"all", Query{Prefix: netip.MustParsePrefix("0.0.0.0/0")}, []string{"64D74AAA74F30DC2CFB36343CE5D4451B9A4DBA8", "23B49521BDC4588C7CCF3C38E552504118326B66", "FE39F07EBE7870DCE124AB30DF3ABD0700A43F75"}},
+		{"ipv6", Query{Prefix: netip.MustParsePrefix("2001:db8::/32")}, nil},
+		{"fingerprint", Query{Fingerprints: []string{"fe39f07ebe7870dce124ab30df3abd0700a43f75"}}, []string{"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75"}},
+		{"fingerprint and prefix", Query{Prefix: netip.MustParsePrefix("194.26.192.64/32"), Fingerprints: []string{"FE39F07EBE7870DCE124AB30DF3ABD0700A43F75"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.From, tt.query.To = january, january
+			r, err := c.Search(context.Background(), tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, n := range r.Nodes {
+				got = append(got, n.Fingerprint)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSearchResult(t *testing.T) {
+	ts := newTestServer(t)
+	c, err := New(WithSource(ts.URLTemplate()), WithCacheDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Any time in the month will do.
+	r, err := c.Search(context.Background(), Query{
+		Prefix: netip.MustParsePrefix("194.26.192.64/32"),
+		From:   january.Add(10 * 24 * time.Hour),
+		To:     january.Add(20 * 24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n := r.Nodes[0]
+	if len(n.Addresses) != 1 || n.Addresses[0].Addr != netip.MustParseAddr("194.26.192.64") {
+		t.Errorf("unexpected addresses %v", n.Addresses)
+	}
+	if n.Published != time.Date(2023, time.December, 31, 21, 19, 31, 0, time.UTC) {
+		t.Errorf("unexpected published %s", n.Published)
+	}
+	m := r.Months[0]
+	if len(r.Months) != 1 || !m.Month.Equal(january) || m.Status != StatusOK || m.Source != fmt.Sprintf(ts.URLTemplate(), "2024-01") {
+		t.Errorf("unexpected months %+v", r.Months)
+	}
+}
+
+func TestSearchBestEffort(t *testing.T) {
+	ts := newTestServer(t)
+	q := Query{Prefix: netip.MustParsePrefix("194.26.192.64/32"), From: january, To: february}
+
+	c, _ := New(WithSource(base(ts)))
+	r, err := c.Search(context.Background(), q)
+	if r != nil || !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected missing month error, got %v, %v", r, err)
+	}
+
+	c, _ = New(WithSource(base(ts)), WithBestEffort())
+	r, err = c.Search(context.Background(), q)
+	if !errors.Is(err, ErrPartial) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected partial results error, got: %v", err)
+	}
+	if r == nil || len(r.Nodes) != 1 || r.Months[1].Status != StatusMissing || r.Months[1].Err == nil {
+		t.Errorf("expected the node of 2024-01 and 2024-02 missing, got %+v", r)
+	}
+}
+
+func TestSearchTempDir(t *testing.T) {
+	ts := newTestServer(t)
+	dir := t.TempDir()
+	var entries []os.DirEntry
+	// The search dir is in dir while the search runs, and gone after.
+	c, _ := New(WithSource(base(ts)), WithTempDir(dir), WithHTTPClient(&http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			entries, _ = os.ReadDir(dir)
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}))
+	_, err := c.Search(context.Background(), Query{Prefix: netip.MustParsePrefix("194.26.192.64/32"), From: january, To: january})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "his-tor-y-") {
+		t.Errorf("expected the search dir in %s, got %v", dir, entries)
+	}
+	if after, _ := os.ReadDir(dir); len(after) != 0 {
+		t.Errorf("expected the search dir removed, got %v", after)
+	}
+	if _, err := os.Stat(filepath.Join(dir, entries[0].Name())); err == nil {
+		t.Errorf("expected the search dir removed")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestErrorOnInvalidInput(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithSource()},
+		{WithSource("https://example.com/%s/%s")},
+		{WithConcurrency(-1)},
+		{WithRetries(-1)},
+	} {
+		if _, err := New(opts...); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("expected invalid input error, got: %v", err)
+		}
+	}
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	prefix := netip.MustParsePrefix("194.26.192.64/32")
+	for _, q := range []Query{
+		{From: january, To: january},
+		{Prefix: prefix},
+		{Prefix: prefix, From: february, To: january},
+	} {
+		if _, err := c.Search(context.Background(), q); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("expected invalid input error for %+v, got: %v", q, err)
+		}
+	}
+}
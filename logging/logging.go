@@ -0,0 +1,42 @@
+// Package logging builds the *slog.Logger handed to core, download and xz,
+// and gives them a silent one when they are handed none.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// Log formats accepted by New.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Discard is a Logger writing nothing, no record is even built.
+var Discard = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(math.MaxInt)}))
+
+// Or returns l, or Discard when l is nil, so that packages do not have to
+// check.
+func Or(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return Discard
+	}
+	return l
+}
+
+// New returns a Logger writing records of level and above on w, as logfmt
+// text or as one JSON object per line.
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, valid formats are: %s, %s", format, FormatText, FormatJSON)
+}
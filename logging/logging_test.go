@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"text", `level=WARN msg="mirror failed" month=2024-01`},
+		{"", `level=WARN msg="mirror failed" month=2024-01`},
+		{"JSON", `"level":"WARN","msg":"mirror failed","month":"2024-01"`},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		l, err := New(&buf, tt.format, slog.LevelWarn)
+		if err != nil {
+			t.Fatalf("Expected nil for %q, got: %v", tt.format, err)
+		}
+		l.Info("month pulled", "month", "2024-01")
+		l.Warn("mirror failed", "month", "2024-01")
+		if strings.Contains(buf.String(), "month pulled") || !strings.Contains(buf.String(), tt.expected) {
+			t.Errorf("expected only %s for %q, got: %s", tt.expected, tt.format, buf.String())
+		}
+	}
+
+	if _, err := New(&bytes.Buffer{}, "yaml", slog.LevelInfo); err == nil || !strings.Contains(err.Error(), "valid formats are") {
+		t.Errorf("Expected unknown format error, got: %v", err)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Discard {
+		t.Errorf("expected Discard for nil")
+	}
+	l := slog.Default()
+	if Or(l) != l {
+		t.Errorf("expected the logger as is")
+	}
+	if Discard.Enabled(nil, slog.LevelError) {
+		t.Errorf("expected Discard to be disabled at every level")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,6 +11,10 @@ import (
 	"github.com/robizz/his-tor-y/arghandler"
 	"github.com/robizz/his-tor-y/command"
 	"github.com/robizz/his-tor-y/conf"
+	"github.com/robizz/his-tor-y/core"
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/xz"
 )
 
 // TODO:
@@ -33,15 +38,13 @@ packages proposal:
 // command line options to tune the resolution of the compaction
 // when treating multiple days, duplicates management needs to be managed.
 // a final cleanup of all text files must be done
-// are we sure we want to use pointers for exit nodes? for now we have values, maybe a memory footprint and performance instrumentation with a full year of data would be nice
+// are we sure we want to use pointers for exit nodes? for now we have values, the benchmarks on a synthetic year and -memprofile on a real one should tell
 // When program reaches the desired complexity and tests are in place, apply effective go / practical go / bill kennedy refactoring
 // clean comments
 // variable names are ugly
 // create a cache and allow commands to run in the cache (maybe using a bolt db? an embedded database? an in memory struct?)
 // the in memory struct could be also a zipped json or array of zipped items of a struct that you decompress on the fly, perf it would be nice.
 // command should be silent to use pipe or output redirect. errors should be on stderr
-// errors should be constant errors like dave cheney suggests
-// we need an integration test to test the whole flow
 // Main functionality is: I give you the list of nodes that were found for the time range with the last update inside the time range.
 // another funtionality is "IP History":I give you an IP and a parameter like "days", the tool gives me 0 with formatted list of nodes and dates.
 // generate go doc
@@ -52,19 +55,49 @@ packages proposal:
 //
 // END TODO
 
+// Exit codes, grep-style for the result and sysexits.h-style for the
+// failures so that scripts can tell a typo from a mirror being down.
 const (
-	exitCodeErr       = 1
-	exitCodeInterrupt = 2
+	exitCodeNoMatch     = 1   // the IP was not found
+	exitCodeErr         = 2   // anything not listed below
+	exitCodeUsage       = 64  // bad command line, config or query
+	exitCodeData        = 65  // corrupt archive or unparsable exit list
+	exitCodeNoInput     = 66  // a month is missing from every source
+	exitCodeUnavailable = 69  // a source cannot be reached or is failing
+	exitCodeInterrupt   = 130 // cancelled with Ctrl+C
 )
 
+// exitCode maps the errors of run to exit codes. The checks go from the most
+// to the least telling: a month failing for a cancellation is cancelled, a
+// month missing from a mirror and unreachable on another is unavailable.
+func exitCode(err error) int {
+	var usage *arghandler.UsageError
+	var parse *exitnode.ParseError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, command.ErrNoMatch):
+		return exitCodeNoMatch
+	case errors.Is(err, core.ErrCancelled), errors.Is(err, context.Canceled):
+		return exitCodeInterrupt
+	case errors.As(err, &usage), errors.Is(err, core.ErrInvalidInput):
+		return exitCodeUsage
+	case errors.Is(err, download.ErrUnavailable):
+		return exitCodeUnavailable
+	case errors.Is(err, download.ErrNotFound):
+		return exitCodeNoInput
+	case errors.Is(err, xz.ErrCorrupt), errors.As(err, &parse):
+		return exitCodeData
+	}
+	return exitCodeErr
+}
+
 // We do this wrapping to allow all defer()s to run before actually exiting.
 // See https://pace.dev/blog/2020/02/12/why-you-shouldnt-use-func-main-in-golang-by-mat-ryer.html
 func main() {
 
-	// Which configuration?
-	conf := conf.Config{
-		ExitNode: conf.ExitNode{DownloadURLTemplate: "https://collector.torproject.org/archive/exit-lists/exit-list-%s.tar.xz"},
-	}
+	// Built-in defaults, the router layers config file, environment and flags on top.
+	conf := conf.Default()
 
 	// https://pace.dev/blog/2020/02/17/repond-to-ctrl-c-interrupt-signals-gracefully-with-context-in-golang-by-mat-ryer.html
 	ctx := context.Background()
@@ -98,8 +131,11 @@ func main() {
 	}()
 
 	if err := run(ctx, conf, os.Args, os.Stdout); err != nil {
-		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(exitCodeErr)
+		// Not finding the IP is an answer, not a failure: nothing to say.
+		if !errors.Is(err, command.ErrNoMatch) {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		os.Exit(exitCode(err))
 	}
 
 }
@@ -117,7 +153,8 @@ func run(ctx context.Context, conf conf.Config, args []string, stdout io.Writer)
 		default:
 			// create router and register commands
 			r := arghandler.NewRouter()
-			r.Register("history", command.NewHistory())
+			r.Register(command.NewHistory())
+			r.Register(command.NewConfig())
 
 			//execute based on args
 			return r.Execute(ctx, conf, args, stdout)
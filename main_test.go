@@ -1 +1,208 @@
 package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robizz/his-tor-y/arghandler"
+	"github.com/robizz/his-tor-y/collectortest"
+	"github.com/robizz/his-tor-y/command"
+	"github.com/robizz/his-tor-y/conf"
+	"github.com/robizz/his-tor-y/core"
+	"github.com/robizz/his-tor-y/download"
+	"github.com/robizz/his-tor-y/exitnode"
+	"github.com/robizz/his-tor-y/xz"
+)
+
+func TestExitCode(t *testing.T) {
+	// Errors wrapped the way they come out of run.
+	month := func(errs ...error) error {
+		return fmt.Errorf("execute error: month 2024-01: %w", errors.Join(errs...))
+	}
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"ok", nil, 0},
+		{"no match", command.ErrNoMatch, exitCodeNoMatch},
+		{"unknown", errors.New("boom"), exitCodeErr},
+		{"usage", &arghandler.UsageError{Err: errors.New("parse error: bad flag")}, exitCodeUsage},
+		{"invalid input", fmt.Errorf("execute error: %w: start date is after end date", core.ErrInvalidInput), exitCodeUsage},
+		{"not found", month(&download.StatusError{StatusCode: 404}), exitCodeNoInput},
+		{"unavailable", month(&download.StatusError{StatusCode: 503}), exitCodeUnavailable},
+		{"not found and unavailable", month(&download.StatusError{StatusCode: 404}, &download.StatusError{StatusCode: 503}), exitCodeUnavailable},
+		{"corrupt", month(xz.ErrCorrupt), exitCodeData},
+		{"parse", fmt.Errorf("execute error: %w", &exitnode.ParseError{Line: 3, Err: errors.New("bad date")}), exitCodeData},
+		{"cancelled", fmt.Errorf("execute error: %w: %w", core.ErrCancelled, month(xz.ErrCorrupt)), exitCodeInterrupt},
+		{"context cancelled", fmt.Errorf("execute error: %w", context.Canceled), exitCodeInterrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// collector starts a fake CollecTor with a month for each way a month can go:
+// 2024-01 and 2024-02 are fine, 2024-03 is missing, 2024-04 is down and
+// 2024-05 is cut short.
+func collector(t *testing.T) *collectortest.Server {
+	t.Helper()
+	s := collectortest.NewServer()
+	t.Cleanup(s.Close)
+
+	const (
+		relay = "FE39CF1A3D1A2F0F2C8B3B5B19B1EB2A1C9A3F4E"
+		other = "0011BD2485AD45D984EC4159C88FC066E5E3300E"
+	)
+	jan := time.Date(2024, time.January, 1, 0, 2, 0, 0, time.UTC)
+	mid := time.Date(2024, time.January, 15, 12, 2, 0, 0, time.UTC)
+	feb := time.Date(2024, time.February, 10, 6, 2, 0, 0, time.UTC)
+	may := time.Date(2024, time.May, 3, 0, 2, 0, 0, time.UTC)
+	months := map[string]collectortest.Month{
+		"2024-01": {Lists: []collectortest.List{
+			{Downloaded: jan, Nodes: []exitnode.ExitNode{
+				collectortest.Node(relay, "185.241.208.232", jan),
+				collectortest.Node(other, "51.15.43.205", jan),
+			}},
+			{Downloaded: mid, Nodes: []exitnode.ExitNode{
+				collectortest.Node(relay, "185.241.208.232", mid),
+			}},
+		}},
+		"2024-02": {Lists: []collectortest.List{
+			{Downloaded: feb, Nodes: []exitnode.ExitNode{
+				collectortest.Node(relay, "185.241.208.232", feb),
+				collectortest.Node(other, "51.15.43.205", feb),
+			}},
+		}},
+		"2024-03": {Status: http.StatusNotFound},
+		"2024-04": {Status: http.StatusServiceUnavailable},
+		"2024-05": {Truncate: true, Lists: []collectortest.List{
+			{Downloaded: may, Nodes: []exitnode.ExitNode{
+				collectortest.Node(relay, "185.241.208.232", may),
+			}},
+		}},
+	}
+	for month, m := range months {
+		if err := s.Set(month, m); err != nil {
+			t.Fatalf("Expected nil, got: %v", err)
+		}
+	}
+	return s
+}
+
+// isolate keeps the config file and the HISTORY_* variables of whoever runs
+// the tests out of them: run reads the real environment.
+func isolate(t *testing.T) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "HISTORY_") {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+// golden compares got with testdata/name, rewriting it with -update.
+func golden(t *testing.T, name string, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatalf("Expected nil, got: %v", err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected nil, got: %v", err)
+	}
+	if got != string(expected) {
+		t.Errorf("Expected \n%s, got: \n%s", expected, got)
+	}
+}
+
+// TestRun is the integration test for the whole flow: command line, config,
+// download from a fake CollecTor, extraction, scan and output.
+func TestRun(t *testing.T) {
+	isolate(t)
+	s := collector(t)
+	c := conf.Default()
+	c.ExitNode.DownloadURLTemplate = s.URLTemplate()
+	// A 503 is retried with backoff, no need to wait for it here.
+	c.Retries = 0
+
+	history := func(args ...string) []string {
+		return append([]string{"his-tor-y", "-quiet", "history", "-ip", "185.241.208.232"}, args...)
+	}
+	tests := []struct {
+		name string
+		args []string
+		exit int
+		// golden is the file in testdata holding the expected stdout, else
+		// stdout must contain all of contains.
+		golden   string
+		contains []string
+	}{
+		{name: "no command", args: []string{"his-tor-y"}, exit: exitCodeUsage},
+		{name: "unknown command", args: []string{"his-tor-y", "nodes"}, exit: exitCodeUsage},
+		{name: "bad flag", args: history("-bogus"), exit: exitCodeUsage},
+		{name: "help", args: []string{"his-tor-y", "help"}, contains: []string{"history", "config"}},
+		{name: "help history", args: []string{"his-tor-y", "help", "history"}, contains: []string{"-ip", "-best-effort"}},
+		{name: "history -h", args: history("-h"), contains: []string{"-start", "-end"}},
+		{name: "config show", args: []string{"his-tor-y", "config", "show"}, contains: []string{s.URLTemplate(), "default"}},
+		{name: "config without show", args: []string{"his-tor-y", "config"}, exit: exitCodeUsage},
+
+		{name: "text", args: history("-start", "2024-01", "-end", "2024-02"), golden: "history.txt"},
+		{name: "json", args: history("-start", "2024-01", "-end", "2024-02", "-output", "json"), golden: "history.json"},
+		{name: "html", args: history("-start", "2024-01", "-end", "2024-02", "-output", "html"), contains: []string{"<html", "185.241.208.232", "FE39CF1A3D1A2F0F2C8B3B5B19B1EB2A1C9A3F4E"}},
+		{name: "misp", args: history("-start", "2024-01", "-end", "2024-02", "-output", "misp"), contains: []string{`"Event"`, `"ip-dst"`, "185.241.208.232"}},
+		{name: "stix", args: history("-start", "2024-01", "-end", "2024-02", "-output", "stix"), contains: []string{`"type": "bundle"`, "185.241.208.232"}},
+		{name: "template", args: history("-start", "2024-01", "-end", "2024-02", "-output", "template", "-template", "{{.ExitNode}}"), contains: []string{"FE39CF1A3D1A2F0F2C8B3B5B19B1EB2A1C9A3F4E\n"}},
+		{name: "unknown output", args: history("-output", "yaml"), exit: exitCodeUsage},
+
+		{name: "no match", args: []string{"his-tor-y", "history", "-start", "2024-01", "-end", "2024-02", "-ip", "10.0.0.1"}, exit: exitCodeNoMatch, golden: "history-no-match.txt"},
+		{name: "start after end", args: history("-start", "2024-02", "-end", "2024-01"), exit: exitCodeUsage},
+		{name: "missing month", args: history("-start", "2024-03", "-end", "2024-03"), exit: exitCodeNoInput},
+		{name: "unavailable month", args: history("-start", "2024-04", "-end", "2024-04"), exit: exitCodeUnavailable},
+		{name: "corrupt month", args: history("-start", "2024-05", "-end", "2024-05"), exit: exitCodeData},
+		{name: "too many files", args: history("-start", "2024-01", "-end", "2024-01", "-max-files", "1"), exit: exitCodeData},
+		{name: "no file limit", args: history("-start", "2024-01", "-end", "2024-01", "-max-files", "0"), contains: []string{"185.241.208.232"}},
+		{name: "bad size limit", args: history("-max-file-bytes", "huge"), exit: exitCodeUsage},
+
+		{name: "best effort text", args: history("-start", "2024-01", "-end", "2024-05", "-best-effort"), exit: exitCodeUnavailable, golden: "history-best-effort.txt"},
+		{name: "best effort json", args: history("-start", "2024-01", "-end", "2024-05", "-best-effort", "-output", "json"), exit: exitCodeUnavailable, golden: "history-best-effort.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := run(context.Background(), c, tt.args, &stdout)
+			if got := exitCode(err); got != tt.exit {
+				t.Fatalf("Expected exit code %d, got %d: %v", tt.exit, got, err)
+			}
+			// The port of the fake CollecTor changes at every run.
+			got := strings.ReplaceAll(stdout.String(), s.URL, "http://collector.test")
+			if tt.golden != "" {
+				golden(t, tt.golden, got)
+			}
+			for _, c := range tt.contains {
+				if !strings.Contains(got, strings.ReplaceAll(c, s.URL, "http://collector.test")) {
+					t.Errorf("Expected %q in \n%s", c, got)
+				}
+			}
+		})
+	}
+}
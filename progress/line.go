@@ -0,0 +1,120 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Line renders the events as a single line, rewritten in place, like:
+//
+//	download 3/12 4.1MB, extract 2/12 3120 files, scan 0/0
+//
+// It redraws at most every Interval so that many small events do not flood
+// the terminal.
+type Line struct {
+	// Interval is the minimum time between two redraws.
+	Interval time.Duration
+
+	mu        sync.Mutex
+	w         io.Writer
+	downloads map[string]Event
+	extracts  map[string]Event
+	scan      *Event
+	drawn     time.Time
+	width     int
+}
+
+// NewLine returns a Line writing on w, usually a terminal.
+func NewLine(w io.Writer) *Line {
+	return &Line{
+		Interval:  100 * time.Millisecond,
+		w:         w,
+		downloads: map[string]Event{},
+		extracts:  map[string]Event{},
+	}
+}
+
+// Report records e and redraws the line if it is time to.
+func (l *Line) Report(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch e.Stage {
+	case Download:
+		l.downloads[e.Name] = e
+	case Extract:
+		l.extracts[e.Name] = e
+	case Scan:
+		l.scan = &e
+	}
+	if now := time.Now(); now.Sub(l.drawn) >= l.Interval || e.Done {
+		l.draw(l.String())
+		l.drawn = now
+	}
+}
+
+// Close clears the line, leaving the terminal clean for what comes next.
+func (l *Line) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.width == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(l.w, "\r%s\r", strings.Repeat(" ", l.width))
+	l.width = 0
+	return err
+}
+
+// draw overwrites the previous line, padding with spaces when s is shorter.
+func (l *Line) draw(s string) {
+	pad := max(l.width-len(s), 0)
+	fmt.Fprintf(l.w, "\r%s%s", s, strings.Repeat(" ", pad))
+	l.width = len(s)
+}
+
+// String is the current line.
+func (l *Line) String() string {
+	var parts []string
+	if len(l.downloads) > 0 {
+		var done int
+		var bytes int64
+		for _, e := range l.downloads {
+			bytes += e.N
+			if e.Done {
+				done++
+			}
+		}
+		parts = append(parts, fmt.Sprintf("download %d/%d %s", done, len(l.downloads), Bytes(bytes)))
+	}
+	if len(l.extracts) > 0 {
+		var done int
+		var files int64
+		for _, e := range l.extracts {
+			files += e.N
+			if e.Done {
+				done++
+			}
+		}
+		parts = append(parts, fmt.Sprintf("extract %d/%d %d files", done, len(l.extracts), files))
+	}
+	if l.scan != nil {
+		parts = append(parts, fmt.Sprintf("scan %d/%d", l.scan.N, l.scan.Total))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Bytes writes n with a decimal unit, one digit after the point.
+func Bytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
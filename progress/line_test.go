@@ -0,0 +1,72 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLine(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLine(&buf)
+	l.Interval = 0
+
+	l.Report(Event{Stage: Download, Name: "a", N: 1500, Total: 3000})
+	l.Report(Event{Stage: Download, Name: "b", N: 2000000, Total: 2000000, Done: true})
+	l.Report(Event{Stage: Extract, Name: "b", N: 31})
+	l.Report(Event{Stage: Scan, N: 3, Total: 31})
+
+	l.Report(Event{Stage: Extract, Name: "a", Done: true})
+
+	// Bytes and files add up, only b is done downloading and only a extracting.
+	expected := "download 1/2 2.0MB, extract 1/2 31 files, scan 3/31"
+	if l.String() != expected {
+		t.Errorf("expected %q, got %q", expected, l.String())
+	}
+	lines := strings.Split(buf.String(), "\r")
+	if last := strings.TrimRight(lines[len(lines)-1], " "); last != expected {
+		t.Errorf("expected the line to be redrawn as %q, got %q", expected, last)
+	}
+
+	buf.Reset()
+	if err := l.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.TrimSpace(buf.String()) != "" || !strings.HasSuffix(buf.String(), "\r") {
+		t.Errorf("expected the line to be cleared, got %q", buf.String())
+	}
+}
+
+func TestLineInterval(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLine(&buf)
+	l.Interval = time.Hour
+
+	for i := 0; i < 100; i++ {
+		l.Report(Event{Stage: Scan, N: int64(i), Total: 100})
+	}
+	if n := strings.Count(buf.String(), "\r"); n != 1 {
+		t.Errorf("expected a single redraw within the interval, got %d", n)
+	}
+	// The end of a step is always drawn.
+	l.Report(Event{Stage: Scan, N: 100, Total: 100, Done: true})
+	if !strings.HasSuffix(buf.String(), "scan 100/100") {
+		t.Errorf("expected the last event drawn, got %q", buf.String())
+	}
+}
+
+func TestBytes(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:          "0B",
+		999:        "999B",
+		1000:       "1.0kB",
+		1500:       "1.5kB",
+		2500000:    "2.5MB",
+		3000000000: "3.0GB",
+	} {
+		if got := Bytes(n); got != expected {
+			t.Errorf("expected %s for %d, got %s", expected, n, got)
+		}
+	}
+}
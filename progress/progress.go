@@ -0,0 +1,73 @@
+// Package progress carries the progress of the long running steps of a
+// query, downloading, extracting and scanning, from the packages doing them
+// to whoever wants to show it.
+package progress
+
+import (
+	"os"
+)
+
+// Stage is the step of a query an Event is about.
+type Stage int
+
+const (
+	// Download events count the bytes of an archive, Total is the size of
+	// the archive when the server tells it.
+	Download Stage = iota
+	// Extract events count the files extracted from an archive.
+	Extract
+	// Scan events count the exit lists scanned, Total is how many there are.
+	Scan
+)
+
+// Event is a step forward in a Stage.
+type Event struct {
+	Stage Stage
+	// Name tells apart events of the same Stage running at the same time,
+	// like the URL of a download or the path of an archive.
+	Name string
+	// N is the progress so far, not since the last event.
+	N int64
+	// Total is the value of N at the end, 0 when not known.
+	Total int64
+	// Done is set on the last event of Name.
+	Done bool
+}
+
+// Reporter receives the events, from many goroutines at the same time.
+type Reporter interface {
+	Report(Event)
+}
+
+// ReporterFunc adapts a function to a Reporter.
+type ReporterFunc func(Event)
+
+func (f ReporterFunc) Report(e Event) {
+	f(e)
+}
+
+// Discard is a Reporter ignoring all the events.
+var Discard Reporter = discard{}
+
+type discard struct{}
+
+func (discard) Report(Event) {}
+
+// Or returns r, or Discard when r is nil, so that publishers do not have to
+// check.
+func Or(r Reporter) Reporter {
+	if r == nil {
+		return Discard
+	}
+	return r
+}
+
+// IsTerminal tells if f is a terminal, where a progress line makes sense,
+// rather than a pipe or a file.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
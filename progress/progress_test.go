@@ -0,0 +1,45 @@
+package progress
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatalf("error setup file: %v", err)
+	}
+	defer f.Close()
+	if IsTerminal(f) {
+		t.Errorf("expected a file not to be a terminal")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error setup pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if IsTerminal(w) {
+		t.Errorf("expected a pipe not to be a terminal")
+	}
+
+	w.Close()
+	if IsTerminal(w) {
+		t.Errorf("expected a closed file not to be a terminal")
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Discard {
+		t.Errorf("expected Discard for nil")
+	}
+	var got Event
+	r := ReporterFunc(func(e Event) { got = e })
+	Or(r).Report(Event{N: 1})
+	if got.N != 1 {
+		t.Errorf("expected the event to go through, got %+v", got)
+	}
+}
@@ -0,0 +1,38 @@
+package xz
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/robizz/his-tor-y/collectortest"
+)
+
+func BenchmarkExtractTo(b *testing.B) {
+	// A synthetic month, a list a day of 1500 nodes: a 24th of what
+	// CollecTor publishes, a year is twelve of them.
+	lists, err := collectortest.Lists("2024-01", 1, 1500)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	archive, err := collectortest.Archive("2024-01", lists...)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	dir := b.TempDir()
+	fileURI := filepath.Join(dir, "exit-list-2024-01.tar.xz")
+	if err := os.WriteFile(fileURI, archive, 0644); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.SetBytes(int64(len(archive)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Extracting again over the same files, truncated.
+		if err := ExtractTo(context.Background(), fileURI, filepath.Join(dir, "lists")); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
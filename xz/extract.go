@@ -6,81 +6,248 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/robizz/his-tor-y/ctxio"
+	"github.com/robizz/his-tor-y/logging"
+	"github.com/robizz/his-tor-y/progress"
 	"github.com/ulikunitz/xz"
 )
 
+// Extract extracts the tar.xz archive at fileURI next to it and removes the
+// archive once the extraction is complete.
 func Extract(ctx context.Context, fileURI string) error {
-	// here debug and find a place where toiplement the contect cancellation
+	err := ExtractTo(ctx, fileURI, filepath.Dir(fileURI))
+	if err != nil {
+		return err
+	}
+	// if extraction is ok delete xz file
+	err = os.Remove(fileURI)
+	if err != nil {
+		return fmt.Errorf("tar reader error: %w", err)
+	}
+	return nil
+}
+
+// Errors of the extraction, to be checked with errors.Is.
+var (
+	// ErrCorrupt is an archive that is not a valid tar.xz, is truncated or
+	// cannot be trusted.
+	ErrCorrupt = errors.New("corrupt archive")
+	// ErrTooLarge is an archive going over the Limits of the Extractor. It
+	// is an ErrCorrupt too: exit lists are nowhere near the limits.
+	ErrTooLarge = errors.New("archive too large")
+)
+
+// Default limits, generous for the monthly exit lists: about 30 files of a
+// few MB each.
+const (
+	DefaultMaxEntries   = 10000
+	DefaultMaxFileSize  = 256 << 20
+	DefaultMaxTotalSize = 2 << 30
+)
+
+// Limits caps what an archive can extract, so that a decompression bomb
+// from a compromised mirror cannot fill the disk. Zero values stand for the
+// defaults, negative ones for no limit.
+type Limits struct {
+	// MaxEntries is the number of entries in the archive, of any type.
+	MaxEntries int
+	// MaxFileSize is the size of each file, in bytes.
+	MaxFileSize int64
+	// MaxTotalSize is the size of all the files together, in bytes.
+	MaxTotalSize int64
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxEntries == 0 {
+		l.MaxEntries = DefaultMaxEntries
+	}
+	if l.MaxFileSize == 0 {
+		l.MaxFileSize = DefaultMaxFileSize
+	}
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = DefaultMaxTotalSize
+	}
+	return l
+}
+
+// ExtractTo extracts the tar.xz archive at fileURI inside dir, leaving the
+// archive untouched so that it can be kept in a cache.
+func ExtractTo(ctx context.Context, fileURI, dir string) error {
+	var x Extractor
+	return x.ExtractTo(ctx, fileURI, dir)
+}
+
+// Extractor extracts tar.xz archives. The zero value is ready to use.
+//
+// Archives come from mirrors that may be compromised, so only directories
+// and regular files are extracted, inside the destination only: entries with
+// an absolute path or climbing out with .. fail the extraction, symlinks,
+// hard links and devices are skipped. Files and directories get 0644 and
+// 0755 whatever the archive says.
+type Extractor struct {
+	// Progress receives the files extracted, named after the archive.
+	Progress progress.Reporter
+	// Logger gets a record per archive and, at debug level, per file.
+	// Silent when nil.
+	Logger *slog.Logger
+	Limits Limits
+}
+
+// ExtractTo extracts the tar.xz archive at fileURI inside dir, leaving the
+// archive untouched so that it can be kept in a cache.
+func (x *Extractor) ExtractTo(ctx context.Context, fileURI, dir string) error {
+	reporter := progress.Or(x.Progress)
+	logger := logging.Or(x.Logger).With("archive", fileURI)
+	limits := x.Limits.withDefaults()
+	e := progress.Event{Stage: progress.Extract, Name: fileURI}
+	var size int64
+	entries := 0
+	start := time.Now()
+	defer func() {
+		e.Done = true
+		reporter.Report(e)
+	}()
+
 	fileHandle, err := os.Open(fileURI)
 	if err != nil {
 		return fmt.Errorf("extract file error: %w", err)
 	}
 	defer fileHandle.Close()
-	r, err := xz.NewReader(fileHandle)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("extract dir error: %w", err)
+	}
+	// Decompressing is where the time goes: stop in the middle of an entry
+	// too, not only between entries.
+	r, err := xz.NewReader(ctxio.Reader(ctx, fileHandle))
 	if err != nil {
-		return fmt.Errorf("xz reader error: %w", err)
+		if ctx.Err() != nil {
+			return fmt.Errorf("extraction cancelled: %w", ctx.Err())
+		}
+		return fmt.Errorf("xz reader error: %w: %w", ErrCorrupt, err)
 	}
 
 	// untar
-	tr := tar.NewReader(r)
+	tr := tar.NewReader(ctxio.Reader(ctx, r))
 	for {
 		select {
 		case <-ctx.Done():
-			return errors.New("extraction cancelled")
+			return fmt.Errorf("extraction cancelled: %w", ctx.Err())
 		default:
 			header, err := tr.Next()
 			switch {
 			// no more files
 			case err == io.EOF:
-				// if extraction is ok delete xz file
-				fileHandle.Close()
-				err = os.Remove(fileURI)
-				if err != nil {
-					return fmt.Errorf("tar reader error: %w", err)
-				}
+				logger.Info("extracted", "files", e.N, "bytes", size, "duration", time.Since(start))
 				return nil
+			case err != nil && ctx.Err() != nil:
+				return fmt.Errorf("extraction cancelled: %w", ctx.Err())
 			case err != nil:
-				return fmt.Errorf("tar reader error: %w", err)
+				return fmt.Errorf("tar reader error: %w: %w", ErrCorrupt, err)
 			case header == nil:
 				continue
 			}
 
+			entries++
+			if limits.MaxEntries > 0 && entries > limits.MaxEntries {
+				return fmt.Errorf("%w: %w: more than %d entries", ErrCorrupt, ErrTooLarge, limits.MaxEntries)
+			}
+
+			switch header.Typeflag {
+			case tar.TypeDir, tar.TypeReg:
+			case tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+				// Nothing an exit list needs, and a way out of dir.
+				logger.Warn("skipped entry", "name", header.Name, "type", string(header.Typeflag))
+				continue
+			default:
+				// Extended headers and the like, not a file.
+				continue
+			}
+
+			if header.Typeflag == tar.TypeReg {
+				if limits.MaxFileSize > 0 && header.Size > limits.MaxFileSize {
+					return fmt.Errorf("%w: %w: %s is %d bytes, more than %d", ErrCorrupt, ErrTooLarge, header.Name, header.Size, limits.MaxFileSize)
+				}
+				if limits.MaxTotalSize > 0 && size+header.Size > limits.MaxTotalSize {
+					return fmt.Errorf("%w: %w: more than %d bytes in total", ErrCorrupt, ErrTooLarge, limits.MaxTotalSize)
+				}
+			}
+
 			// create directory if doesn't exit
 			// create file
 			// copy contents to file
-			err = extractFileOrFolder(fileURI, header, tr)
+			err = extractFileOrFolder(dir, header, corruptReader{tr})
+			if err != nil && ctx.Err() != nil {
+				return fmt.Errorf("extraction cancelled: %w", ctx.Err())
+			}
 			if err != nil {
 				return fmt.Errorf("file or folder extraction error: %w", err)
 			}
+			if header.Typeflag == tar.TypeReg {
+				e.N++
+				size += header.Size
+				reporter.Report(e)
+				logger.Debug("extracted file", "name", header.Name, "bytes", header.Size)
+			}
 
 		}
 	}
 }
 
-func extractFileOrFolder(fileURI string, header *tar.Header, tr *tar.Reader) error {
-	target := filepath.Join(filepath.Dir(fileURI), header.Name)
+// corruptReader marks the errors reading the archive as ErrCorrupt, telling
+// them apart from the errors writing the files.
+type corruptReader struct {
+	r io.Reader
+}
+
+func (c corruptReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return n, err
+}
+
+// extractFileOrFolder creates the directory or the regular file of header
+// inside dir, which it must not escape.
+func extractFileOrFolder(dir string, header *tar.Header, tr io.Reader) error {
+	// IsLocal rejects absolute paths, .. climbing out and, on Windows,
+	// reserved names. Where the archive comes from there is no legit use.
+	name := filepath.FromSlash(header.Name)
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("%w: entry %q escapes the destination", ErrCorrupt, header.Name)
+	}
+	target := filepath.Join(dir, name)
 
 	switch header.Typeflag {
 
 	case tar.TypeDir:
-		if _, err := os.Stat(target); err != nil {
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return fmt.Errorf("tar reader error: %w", err)
-
-			}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("tar reader error: %w", err)
 		}
 
 	case tar.TypeReg:
-		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+		// Directory entries are not mandatory in a tar.
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("tar reader error: %w", err)
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
 			return fmt.Errorf("tar reader error: %w", err)
 		}
 		defer f.Close()
 
 		if _, err := io.Copy(f, tr); err != nil {
+			// No half written exit list left behind.
+			f.Close()
+			os.Remove(target)
+			return fmt.Errorf("tar reader error: %w", err)
+		}
+		if err := f.Close(); err != nil {
 			return fmt.Errorf("tar reader error: %w", err)
 		}
 	}
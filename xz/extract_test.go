@@ -1,11 +1,19 @@
 package xz
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+
+	"github.com/robizz/his-tor-y/progress"
 )
 
 func TestExtractFiles(t *testing.T) {
@@ -145,7 +153,151 @@ func TestExtractFilesErrorMalformedXZ(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	err = Extract(context.Background(), dir+string(os.PathSeparator)+"test.tar.xz")
-	if err == nil {
-		t.Errorf("expected error")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected corrupt archive error, got: %v", err)
+	}
+}
+
+func TestExtractTo(t *testing.T) {
+	var xz = "/Td6WFoAAATm1rRGAgAhARYAAAB0L+Wj4Cf/AIVdADIaSqdFdWDG5DyioorqbKzrYutpz48hW6T+6+aNVA3T8jf0PzyS9ALcmnLhrtM7easSylimqAcho4xEVMQvj0WUss4+rmkoIJai40j22THQcF1sgaTYr2WFsc30TdspFJG2juRj05Obtr1i4YsH5bI9TfNStOkr9x7IyHFMvIuvPA+92QAAAAAA6zfzwvuhqRYAAaEBgFAAAK2nkK2xxGf7AgAAAAAEWVo="
+
+	dec, err := base64.StdEncoding.DecodeString(xz)
+	if err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+
+	dir := t.TempDir()
+	archive := dir + string(os.PathSeparator) + "test.tar.xz"
+	if err := os.WriteFile(archive, dec, 0644); err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+
+	target := dir + string(os.PathSeparator) + "out" + string(os.PathSeparator) + "2024-01"
+	err = ExtractTo(context.Background(), archive, target)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(target + string(os.PathSeparator) + "dir1" + string(os.PathSeparator) + "test")
+	if err != nil {
+		t.Errorf("error reading extracted file:  %v", err)
+	}
+	if strings.TrimSpace(string(content)) != "hello" {
+		t.Errorf("expected hello, but got %s.", content)
+	}
+
+	// ExtractTo leaves the archive where it is.
+	if _, err := os.Stat(archive); err != nil {
+		t.Errorf("tar.xz file should still be there: %v", err)
+	}
+}
+
+func TestExtractorReports(t *testing.T) {
+	var xz = "/Td6WFoAAATm1rRGAgAhARYAAAB0L+Wj4Cf/AIVdADIaSqdFdWDG5DyioorqbKzrYutpz48hW6T+6+aNVA3T8jf0PzyS9ALcmnLhrtM7easSylimqAcho4xEVMQvj0WUss4+rmkoIJai40j22THQcF1sgaTYr2WFsc30TdspFJG2juRj05Obtr1i4YsH5bI9TfNStOkr9x7IyHFMvIuvPA+92QAAAAAA6zfzwvuhqRYAAaEBgFAAAK2nkK2xxGf7AgAAAAAEWVo="
+
+	dec, err := base64.StdEncoding.DecodeString(xz)
+	if err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "test.tar.xz")
+	if err := os.WriteFile(archive, dec, 0644); err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+
+	var events []progress.Event
+	var buf bytes.Buffer
+	x := Extractor{
+		Progress: progress.ReporterFunc(func(e progress.Event) { events = append(events, e) }),
+		Logger:   slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	if err := x.ExtractTo(context.Background(), archive, filepath.Join(dir, "out")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	last := events[len(events)-1]
+	if !last.Done || last.N != 1 || last.Stage != progress.Extract || last.Name != archive {
+		t.Errorf("expected 1 file extracted, got %+v", last)
+	}
+	for _, expected := range []string{
+		"level=DEBUG msg=\"extracted file\" archive=" + archive + " name=dir1/test bytes=6",
+		"level=INFO msg=extracted archive=" + archive + " files=1 bytes=6",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected log to contain %q, got: %s", expected, buf.String())
+		}
+	}
+}
+
+func TestExtractToErrors(t *testing.T) {
+	var xz = "/Td6WFoAAATm1rRGAgAhARYAAAB0L+Wj4Cf/AIVdADIaSqdFdWDG5DyioorqbKzrYutpz48hW6T+6+aNVA3T8jf0PzyS9ALcmnLhrtM7easSylimqAcho4xEVMQvj0WUss4+rmkoIJai40j22THQcF1sgaTYr2WFsc30TdspFJG2juRj05Obtr1i4YsH5bI9TfNStOkr9x7IyHFMvIuvPA+92QAAAAAA6zfzwvuhqRYAAaEBgFAAAK2nkK2xxGf7AgAAAAAEWVo="
+
+	dec, err := base64.StdEncoding.DecodeString(xz)
+	if err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "test.tar.xz")
+	truncated := filepath.Join(dir, "truncated.tar.xz")
+	if err := os.WriteFile(archive, dec, 0644); err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+	if err := os.WriteFile(truncated, dec[:len(dec)/2], 0644); err != nil {
+		t.Errorf("error setting up tar.xz test: %v", err)
+	}
+
+	err = ExtractTo(context.Background(), truncated, filepath.Join(dir, "truncated"))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected corrupt archive error, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = ExtractTo(ctx, archive, filepath.Join(dir, "cancelled"))
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected cancelled error, got: %v", err)
+	}
+
+	err = ExtractTo(context.Background(), filepath.Join(dir, "missing.tar.xz"), filepath.Join(dir, "missing"))
+	if err == nil || errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected a missing file not to be corrupt, got: %v", err)
+	}
+}
+
+// cancelAfter is a context cancelled after n calls to Err, to stop an
+// extraction at a precise point rather than racing it.
+type cancelAfter struct {
+	context.Context
+	n atomic.Int64
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n.Add(-1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestExtractToCancelledMidEntry(t *testing.T) {
+	dir := t.TempDir()
+	// 8MB of zeros compress to almost nothing and take many reads to copy.
+	archive := craft(t, dir,
+		entry{name: "small", typeflag: tar.TypeReg, body: "exit list"},
+		entry{name: "big", typeflag: tar.TypeReg, body: strings.Repeat("\x00", 8<<20)},
+	)
+	ctx := &cancelAfter{Context: context.Background()}
+	ctx.n.Store(50)
+
+	out := filepath.Join(dir, "out")
+	err := ExtractTo(ctx, archive, out)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected cancelled error, got: %v", err)
+	}
+	// The file being written is removed, the complete one stays.
+	if _, err := os.Stat(filepath.Join(out, "big")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the partial file to be removed, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "small")); err != nil {
+		t.Errorf("expected the complete file to stay, got: %v", err)
 	}
 }
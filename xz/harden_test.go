@@ -0,0 +1,207 @@
+package xz
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// entry is a tar entry of a crafted archive.
+type entry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+	// size overrides len(body) in the header.
+	size int64
+}
+
+// craft writes a tar.xz holding entries in dir and returns its path.
+func craft(t *testing.T, dir string, entries ...entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("error setting up xz writer: %v", err)
+	}
+	tw := tar.NewWriter(xw)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: e.mode, Size: int64(len(e.body))}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if e.typeflag != tar.TypeReg {
+			h.Size = 0
+		}
+		if e.size != 0 {
+			h.Size = e.size
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("error writing header %s: %v", e.name, err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil && e.size == 0 {
+				t.Fatalf("error writing %s: %v", e.name, err)
+			}
+		}
+	}
+	// A lying size leaves the tar writer unhappy, the archive is what we want.
+	tw.Close()
+	if err := xw.Close(); err != nil {
+		t.Fatalf("error closing xz writer: %v", err)
+	}
+	archive := filepath.Join(dir, "crafted.tar.xz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("error writing archive: %v", err)
+	}
+	return archive
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	for _, name := range []string{
+		"../escaped",
+		"dir/../../escaped",
+		"/tmp/escaped-absolute",
+		"..",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := craft(t, dir,
+				entry{name: "ok", typeflag: tar.TypeReg, body: "fine"},
+				entry{name: name, typeflag: tar.TypeReg, body: "evil"},
+			)
+			out := filepath.Join(dir, "out", "2024-01")
+			err := ExtractTo(context.Background(), archive, out)
+			if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "escapes the destination") {
+				t.Fatalf("expected escape error, got: %v", err)
+			}
+			for _, p := range []string{filepath.Join(dir, "out", "escaped"), filepath.Join(dir, "escaped"), "/tmp/escaped-absolute"} {
+				if _, err := os.Stat(p); err == nil {
+					t.Errorf("expected nothing written at %s", p)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractSkipsLinksAndDevices(t *testing.T) {
+	dir := t.TempDir()
+	archive := craft(t, dir,
+		entry{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		entry{name: "up", typeflag: tar.TypeSymlink, linkname: ".."},
+		entry{name: "hard", typeflag: tar.TypeLink, linkname: "/etc/passwd"},
+		entry{name: "dev", typeflag: tar.TypeChar},
+		entry{name: "fifo", typeflag: tar.TypeFifo},
+		// Through the skipped symlink this would land outside.
+		entry{name: "up/escaped", typeflag: tar.TypeReg, body: "evil"},
+		entry{name: "list", typeflag: tar.TypeReg, body: "exit list"},
+	)
+	out := filepath.Join(dir, "out")
+	if err := ExtractTo(context.Background(), archive, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatalf("error reading out: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+		if e.Type()&(os.ModeSymlink|os.ModeDevice|os.ModeNamedPipe) != 0 {
+			t.Errorf("expected %s not to be extracted as %s", e.Name(), e.Type())
+		}
+	}
+	// up is a plain directory, created for up/escaped.
+	if strings.Join(names, ",") != "list,up" {
+		t.Errorf("expected list and up only, got %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+		t.Errorf("expected nothing written outside")
+	}
+}
+
+func TestExtractSafeModes(t *testing.T) {
+	dir := t.TempDir()
+	archive := craft(t, dir,
+		entry{name: "dir", typeflag: tar.TypeDir, mode: 0777},
+		entry{name: "dir/setuid", typeflag: tar.TypeReg, body: "x", mode: 04777},
+	)
+	out := filepath.Join(dir, "out")
+	if err := ExtractTo(context.Background(), archive, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(out, "dir", "setuid"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Mode()&(os.ModeSetuid|0111) != 0 || info.Mode().Perm()&0600 != 0600 {
+		t.Errorf("expected a plain readable file, got %s", info.Mode())
+	}
+	info, err = os.Stat(filepath.Join(out, "dir"))
+	if err != nil || info.Mode().Perm()&0002 != 0 {
+		t.Errorf("expected a directory not writable by others, got %v (%v)", info, err)
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	files := func(n int, size int) []entry {
+		var entries []entry
+		for i := 0; i < n; i++ {
+			entries = append(entries, entry{name: "f" + strings.Repeat("x", i), typeflag: tar.TypeReg, body: strings.Repeat("a", size)})
+		}
+		return entries
+	}
+
+	tests := []struct {
+		name     string
+		limits   Limits
+		entries  []entry
+		contains string
+	}{
+		{"entries", Limits{MaxEntries: 3}, files(4, 1), "more than 3 entries"},
+		{"file size", Limits{MaxFileSize: 100}, files(1, 101), "more than 100"},
+		{"total size", Limits{MaxTotalSize: 250}, files(3, 100), "more than 250 bytes in total"},
+		// A bomb compresses to almost nothing.
+		{"bomb", Limits{MaxTotalSize: 1 << 20}, files(1, 2<<20), "more than 1048576"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := craft(t, dir, tt.entries...)
+			x := Extractor{Limits: tt.limits}
+			err := x.ExtractTo(context.Background(), archive, filepath.Join(dir, "out"))
+			if !errors.Is(err, ErrTooLarge) || !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), tt.contains) {
+				t.Errorf("expected too large error containing %q, got: %v", tt.contains, err)
+			}
+		})
+	}
+
+	// Within the limits, and with no limits at all.
+	for _, limits := range []Limits{{MaxEntries: 4, MaxFileSize: 100, MaxTotalSize: 400}, {MaxEntries: -1, MaxFileSize: -1, MaxTotalSize: -1}} {
+		dir := t.TempDir()
+		archive := craft(t, dir, files(4, 100)...)
+		x := Extractor{Limits: limits}
+		if err := x.ExtractTo(context.Background(), archive, filepath.Join(dir, "out")); err != nil {
+			t.Errorf("unexpected error with %+v: %v", limits, err)
+		}
+	}
+}
+
+func TestExtractErrorOnLyingSize(t *testing.T) {
+	// The header promises more than the archive holds.
+	dir := t.TempDir()
+	archive := craft(t, dir, entry{name: "short", typeflag: tar.TypeReg, body: "abc", size: 1000})
+	err := ExtractTo(context.Background(), archive, filepath.Join(dir, "out"))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected corrupt archive error, got: %v", err)
+	}
+}